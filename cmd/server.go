@@ -17,6 +17,10 @@ package main
 import (
 	"flag"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/Mirantis/k8s-netchecker-server/pkg/utils"
@@ -30,12 +34,20 @@ func main() {
 		repTTL        int
 		pingTimeout   int
 		checkInterval int
+		configFile    string
+		podCIDRs      string
+		selectors     string
+		namespaces    string
+		exclusions    string
+		webhooks      string
+		alertmanagers string
 	)
 
 	config := utils.GetOrCreateConfig()
 
 	flag.StringVar(&config.HttpListen, "endpoint", "0.0.0.0:8081", "Endpoint (IP address, port) for server to listen on")
 	flag.BoolVar(&config.UseKubeClient, "kubeproxyinit", false, "use k8s TPR (true) or Etcd (false) as a data storage")
+	flag.StringVar(&config.Storage, "storage", "", "Data storage for agents reports: k8s, etcd, etcdv3, bolt or memory (overrides -kubeproxyinit)")
 	flag.IntVar(&repTTL, "report-ttl", 300, "TTL for agents reports data stored in Etcd (sec)")
 	flag.IntVar(&pingTimeout, "ping-timeout", 5, "Etcd server ping timeout (sec)")
 	flag.StringVar(&config.EtcdEndpoints, "etcd-endpoints", "", "Etcd server endpoints list")
@@ -43,22 +55,155 @@ func main() {
 	flag.StringVar(&config.EtcdKeyFile, "etcd-key", "", "SSL key file when using HTTPS to connect to etcd")
 	flag.StringVar(&config.EtcdCertFile, "etcd-cert", "", "SSL certificate file when using HTTPS to connect to etcd")
 	flag.StringVar(&config.EtcdCAFile, "etcd-ca", "", "SSL CA file when using HTTPS to connect to etcd")
+	flag.StringVar(&config.BoltPath, "bolt-path", "/var/lib/netchecker/agents.db", "BoltDB file to store agents reports in")
+	flag.IntVar(&config.HistorySize, "history-size", 100, "Number of reports kept per agent (bolt and memory storages)")
 	flag.IntVar(&checkInterval, "check-interval", 10, "Interval of checking that agents data is up-to-date (sec)")
+	flag.Float64Var(&config.Staleness.GraceMultiplier, "staleness-grace", config.Staleness.GraceMultiplier,
+		"Agent report is late after its report interval multiplied by this value")
+	flag.DurationVar(&config.Staleness.MinStaleness, "staleness-min", config.Staleness.MinStaleness,
+		"Minimal period after which agent report is late (e.g. 30s, 0 means no limit)")
+	flag.DurationVar(&config.Staleness.MaxStaleness, "staleness-max", config.Staleness.MaxStaleness,
+		"Maximal period after which agent report is late (e.g. 5m, 0 means no limit)")
+	flag.IntVar(&config.Staleness.MissThreshold, "staleness-misses", config.Staleness.MissThreshold,
+		"Number of consecutive missed reports before agent is considered outdated")
+	flag.BoolVar(&config.Probes.Enabled, "check-probes", false,
+		"Fail connectivity check when HTTP probes of the agents fail")
+	flag.DurationVar(&config.ClockSkew.MaxSkew, "max-clock-skew", 0,
+		"Mark agents which node clock differs from the server one by more than this period (e.g. 5s, 0 disables)")
+	flag.BoolVar(&config.ClockSkew.FailCheck, "clock-skew-fails-check", false,
+		"Fail connectivity check when clock of agent's node is skewed")
+	flag.StringVar(&podCIDRs, "pod-cidr", "",
+		"Comma separated pod network CIDRs, pod network agents without address in them are reported")
+	flag.StringVar(&config.RackLabel, "rack-label", "",
+		"Node label which value is the rack of the node, racks are not reported when empty")
+	flag.StringVar(&selectors, "agent-selectors", "",
+		"Semicolon separated label selectors of agent pods, each one optionally followed by ':' and the agent flavor "+
+			"(e.g. 'app=netchecker-agent:pod_network;app=netchecker-agent-hostnet:hostnet')")
+	flag.StringVar(&namespaces, "agent-namespaces", "",
+		"Comma separated namespaces to look for agent pods in (all namespaces when empty)")
+	flag.BoolVar(&config.PodCache, "pod-cache", true,
+		"Watch agent pods and serve them from local cache instead of listing them on every request")
+	flag.StringVar(&exclusions, "exclusions", "",
+		"Comma separated rules excluding failing agents from connectivity check: pod_terminating, pod_pending, "+
+			"pod_not_ready, node_not_ready, node_unschedulable or none (all but pod_not_ready by default)")
+	flag.StringVar(&webhooks, "webhook-urls", "",
+		"Comma separated URLs to POST connectivity events to (agent went absent, outdated, recovered)")
+	flag.IntVar(&config.Notifier.Retries, "webhook-retries", config.Notifier.Retries,
+		"Number of retries of failed webhook delivery")
+	flag.DurationVar(&config.Notifier.Backoff, "webhook-backoff", config.Notifier.Backoff,
+		"Delay before the first retry of failed webhook delivery, doubled for every next one")
+	flag.DurationVar(&config.Notifier.Timeout, "webhook-timeout", config.Notifier.Timeout,
+		"Timeout of a single webhook delivery attempt")
+	flag.StringVar(&alertmanagers, "alertmanager-urls", "",
+		"Comma separated base URLs of Alertmanagers to push alerts to (e.g. http://alertmanager:9093)")
+	flag.DurationVar(&config.Alertmanager.ResendInterval, "alertmanager-resend", config.Alertmanager.ResendInterval,
+		"Interval of resending active alerts to Alertmanager")
+	flag.DurationVar(&config.Alertmanager.Timeout, "alertmanager-timeout", config.Alertmanager.Timeout,
+		"Timeout of pushing alerts to Alertmanager")
+	flag.BoolVar(&config.Events.Enabled, "k8s-events", config.Events.Enabled,
+		"Record k8s events on agent pods and their nodes when agents start failing connectivity check or recover")
+	flag.IntVar(&config.Events.Burst, "k8s-events-burst", config.Events.Burst,
+		"Number of k8s events which can be recorded for a pod or node at once (0 disables rate limiting)")
+	flag.DurationVar(&config.Events.Interval, "k8s-events-interval", config.Events.Interval,
+		"Period in which one more k8s event can be recorded for a pod or node once the burst is used up")
+	flag.BoolVar(&config.Conditions.Enabled, "node-conditions", config.Conditions.Enabled,
+		"Patch NetcheckerConnectivity condition onto the status of the nodes (needs nodes/status patch permission)")
+	flag.DurationVar(&config.Conditions.Heartbeat, "node-conditions-heartbeat", config.Conditions.Heartbeat,
+		"Period after which unchanged node condition is patched again to refresh its heartbeat time")
+	flag.StringVar(&configFile, "config", "", "YAML configuration file (command line parameters take precedence)")
 	flag.Parse()
+
+	// durations given in seconds on the command line
+	seconds := map[string]struct {
+		value *int
+		dst   *time.Duration
+	}{
+		"report-ttl":     {&repTTL, &config.ReportTTL},
+		"ping-timeout":   {&pingTimeout, &config.PingTimeout},
+		"check-interval": {&checkInterval, &config.CheckInterval},
+	}
+	for _, s := range seconds {
+		*s.dst = time.Duration(*s.value) * time.Second
+	}
+	if configFile != "" {
+		// parameters given explicitly take precedence over the file
+		explicit := map[string]string{}
+		flag.Visit(func(f *flag.Flag) {
+			explicit[f.Name] = f.Value.String()
+		})
+		if err := config.LoadFile(configFile); err != nil {
+			glog.Fatalf("Error while loading configuration file '%s': %v", configFile, err)
+		}
+		for name, value := range explicit {
+			flag.Set(name, value)
+			if s, ok := seconds[name]; ok {
+				*s.dst = time.Duration(*s.value) * time.Second
+			}
+		}
+	}
 	glog.Infof("K8s netchecker. Compiled at: %s", version)
 
-	config.ReportTTL = time.Duration(repTTL) * time.Second
-	config.PingTimeout = time.Duration(pingTimeout) * time.Second
-	config.CheckInterval = time.Duration(checkInterval) * time.Second
+	if podCIDRs != "" {
+		config.PodCIDRs = strings.Split(podCIDRs, ",")
+	}
+	if _, err := utils.ParseCIDRs(config.PodCIDRs); err != nil {
+		glog.Fatal(err)
+	}
+	if selectors != "" {
+		parsed, err := utils.ParseAgentSelectors(selectors)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		config.Agents.Selectors = parsed
+	}
+	if namespaces != "" {
+		config.Agents.Namespaces = strings.Split(namespaces, ",")
+	}
+	if err := config.Agents.Validate(); err != nil {
+		glog.Fatal(err)
+	}
+	if exclusions == "none" {
+		config.Exclusions = utils.ExclusionPolicy{}
+	} else if exclusions != "" {
+		config.Exclusions = strings.Split(exclusions, ",")
+	}
+	if err := config.Exclusions.Validate(); err != nil {
+		glog.Fatal(err)
+	}
+	if webhooks != "" {
+		config.Notifier.Webhooks = strings.Split(webhooks, ",")
+	}
+	if alertmanagers != "" {
+		config.Alertmanager.URLs = strings.Split(alertmanagers, ",")
+	}
+	if config.Storage == "" {
+		config.Storage = utils.StorageEtcd
+		if config.UseKubeClient {
+			config.Storage = utils.StorageK8s
+		}
+	}
 
 	glog.V(5).Infof("Start listening on %v", config.HttpListen)
 
-	handler, err := utils.NewHandler(config.UseKubeClient)
+	handler, err := utils.NewHandler(config.Storage)
 	if err != nil {
 		glog.Errorf("Error while setting up the handler. Details: %v", err)
 		panic(err.Error())
 	}
 
-	go handler.CollectAgentsMetrics(config.CheckInterval, config.UseKubeClient)
+	// stop the background work and release the storage on shutdown
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		glog.Infof("Got %v, shutting down", sig)
+		if err := handler.Close(); err != nil {
+			glog.Errorf("Error while closing the handler. Details: %v", err)
+		}
+		glog.Flush()
+		os.Exit(0)
+	}()
+
+	go handler.CollectAgentsMetrics(config.CheckInterval, config.Storage)
 	glog.Fatal(http.ListenAndServe(config.HttpListen, handler.HTTPHandler))
 }
@@ -34,6 +34,13 @@ type AgentSpec struct {
 	LookupHost     map[string][]string `json:"nslookup"`
 	NetworkProbes  []ProbeResult       `json:"network_probes"`
 	IPs            map[string][]string `json:"ips"`
+	PeerProbes     []PeerProbeResult   `json:"peer_probes,omitempty"`
+	// Set by the server when uptime of the agent goes backwards
+	Restarts    int        `json:"restarts,omitempty"`
+	LastRestart *time.Time `json:"last_restart,omitempty"`
+	// Set by the server when addresses of the agent change
+	PreviousIPs  []string   `json:"previous_ips,omitempty"`
+	LastIPChange *time.Time `json:"last_ip_change,omitempty"`
 }
 
 // ProbeResult structure for network probing results
@@ -49,11 +56,33 @@ type ProbeResult struct {
 	ServerProcessing int
 }
 
+// PeerProbeResult structure for results of probing other agents
+type PeerProbeResult struct {
+	Peer      string `json:"peer"`
+	IP        string `json:"ip"`
+	Reachable bool   `json:"reachable"`
+	RTT       int    `json:"rtt_ms"`
+}
+
+// States of the agent computed by the server
+const (
+	AgentStateFresh    = "fresh"
+	AgentStateOutdated = "outdated"
+)
+
+// AgentStatus is the state of the agent computed by the server, it's kept
+// in the status subresource
+type AgentStatus struct {
+	State     string     `json:"state,omitempty"`
+	LastCheck *time.Time `json:"last_check,omitempty"`
+}
+
 // Agent struct to store AgentSpec info as json
 type Agent struct {
 	meta_v1.TypeMeta   `json:",inline"`
 	meta_v1.ObjectMeta `json:"metadata"`
-	Spec               AgentSpec `json:"spec"`
+	Spec               AgentSpec   `json:"spec"`
+	Status             AgentStatus `json:"status,omitempty"`
 }
 
 // AgentList struct to store many of agents
@@ -15,15 +15,273 @@
 package client
 
 import (
+	"encoding/json"
 	"reflect"
+	"strconv"
+
+	"github.com/golang/glog"
+
 	ext_v1 "github.com/Mirantis/k8s-netchecker-server/pkg/extensions/apis/v1"
-	apiextensionsclient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
 	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	apiextensionsclient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	api_errors "k8s.io/apimachinery/pkg/api/errors"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-// CreateAgentCustomResourceDefinition is a function to initialize schema for custom reource
-func CreateAgentCustomResourceDefinition(clientset apiextensionsclient.Interface) error {
+// Versions of apiextensions API the agents CRD can be served through
+const (
+	CRDVersionV1      = "v1"
+	CRDVersionV1beta1 = "v1beta1"
+)
+
+// crdRevision is increased whenever the definition changes, existing CRDs
+// with lower revision are updated in place, the ones written by newer server
+// are left intact
+const crdRevision = 3
+
+// crdRevisionAnnotation holds the revision of the definition the CRD was
+// last written with
+const crdRevisionAnnotation = ext_v1.GroupName + "/crd-revision"
+
+// crdPath is the path of the CRDs in apiextensions.k8s.io/v1 API
+const crdPath = "/apis/apiextensions.k8s.io/v1/customresourcedefinitions"
+
+// The types below mirror apiextensions.k8s.io/v1 API, which the vendored
+// apiextensions-apiserver predates. They hold the fields the agents CRD uses
+// only.
+
+// JSONSchemaProps is a structural OpenAPI v3 schema
+type JSONSchemaProps struct {
+	Type                 string                     `json:"type,omitempty"`
+	Format               string                     `json:"format,omitempty"`
+	Description          string                     `json:"description,omitempty"`
+	Enum                 []json.RawMessage          `json:"enum,omitempty"`
+	Nullable             bool                       `json:"nullable,omitempty"`
+	Properties           map[string]JSONSchemaProps `json:"properties,omitempty"`
+	Items                *JSONSchemaProps           `json:"items,omitempty"`
+	AdditionalProperties *JSONSchemaProps           `json:"additionalProperties,omitempty"`
+}
+
+// CustomResourceColumnDefinition is a column printed by kubectl get
+type CustomResourceColumnDefinition struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+	JSONPath    string `json:"jsonPath"`
+}
+
+// CustomResourceSubresources enables the subresources of the custom resource
+type CustomResourceSubresources struct {
+	Status *struct{} `json:"status,omitempty"`
+}
+
+// CustomResourceValidation holds the schema of the custom resource
+type CustomResourceValidation struct {
+	OpenAPIV3Schema *JSONSchemaProps `json:"openAPIV3Schema,omitempty"`
+}
+
+// CustomResourceDefinitionVersion is a version of the custom resource
+type CustomResourceDefinitionVersion struct {
+	Name                     string                           `json:"name"`
+	Served                   bool                             `json:"served"`
+	Storage                  bool                             `json:"storage"`
+	Schema                   *CustomResourceValidation        `json:"schema,omitempty"`
+	Subresources             *CustomResourceSubresources      `json:"subresources,omitempty"`
+	AdditionalPrinterColumns []CustomResourceColumnDefinition `json:"additionalPrinterColumns,omitempty"`
+}
+
+// CustomResourceDefinitionNames are the names of the custom resource
+type CustomResourceDefinitionNames struct {
+	Plural   string `json:"plural"`
+	Singular string `json:"singular,omitempty"`
+	Kind     string `json:"kind"`
+	ListKind string `json:"listKind,omitempty"`
+}
+
+// CustomResourceDefinitionSpec describes the custom resource
+type CustomResourceDefinitionSpec struct {
+	Group                 string                            `json:"group"`
+	Names                 CustomResourceDefinitionNames     `json:"names"`
+	Scope                 string                            `json:"scope"`
+	Versions              []CustomResourceDefinitionVersion `json:"versions"`
+	PreserveUnknownFields bool                              `json:"preserveUnknownFields"`
+}
+
+// CustomResourceDefinition is apiextensions.k8s.io/v1 CRD
+type CustomResourceDefinition struct {
+	meta_v1.TypeMeta   `json:",inline"`
+	meta_v1.ObjectMeta `json:"metadata"`
+	Spec               CustomResourceDefinitionSpec `json:"spec"`
+}
+
+func stringSchema(format string) JSONSchemaProps {
+	return JSONSchemaProps{Type: "string", Format: format}
+}
+
+func integerSchema() JSONSchemaProps {
+	return JSONSchemaProps{Type: "integer"}
+}
+
+// agentSchema is the schema of the agent, it follows the JSON encoding of
+// ext_v1.Agent. Maps and slices the agents leave empty are encoded as
+// null, so they are nullable.
+func agentSchema() *JSONSchemaProps {
+	stringList := &JSONSchemaProps{Type: "array", Items: &JSONSchemaProps{Type: "string"}}
+	stringListMap := JSONSchemaProps{Type: "object", Nullable: true, AdditionalProperties: stringList}
+
+	probe := &JSONSchemaProps{Type: "object", Properties: map[string]JSONSchemaProps{
+		"URL":              {Type: "string"},
+		"ConnectionResult": integerSchema(),
+		"HTTPCode":         integerSchema(),
+		"Total":            integerSchema(),
+		"ContentTransfer":  integerSchema(),
+		"TCPConnection":    integerSchema(),
+		"DNSLookup":        integerSchema(),
+		"Connect":          integerSchema(),
+		"ServerProcessing": integerSchema(),
+	}}
+	peerProbe := &JSONSchemaProps{Type: "object", Properties: map[string]JSONSchemaProps{
+		"peer":      {Type: "string"},
+		"ip":        {Type: "string"},
+		"reachable": {Type: "boolean"},
+		"rtt_ms":    integerSchema(),
+	}}
+
+	spec := JSONSchemaProps{Type: "object", Properties: map[string]JSONSchemaProps{
+		"report_interval": integerSchema(),
+		"nodename":        {Type: "string"},
+		"podname":         {Type: "string"},
+		"hostdate":        stringSchema("date-time"),
+		"uptime":          integerSchema(),
+		"last_updated":    stringSchema("date-time"),
+		"nslookup":        stringListMap,
+		"network_probes":  {Type: "array", Nullable: true, Items: probe},
+		"ips":             stringListMap,
+		"peer_probes":     {Type: "array", Items: peerProbe},
+		"restarts":        integerSchema(),
+		"last_restart":    stringSchema("date-time"),
+		"previous_ips":    {Type: "array", Items: &JSONSchemaProps{Type: "string"}},
+		"last_ip_change":  stringSchema("date-time"),
+	}}
+	status := JSONSchemaProps{
+		Type:        "object",
+		Description: "State of the agent computed by netchecker server",
+		Properties: map[string]JSONSchemaProps{
+			"state": {Type: "string", Enum: []json.RawMessage{
+				json.RawMessage(`"` + ext_v1.AgentStateFresh + `"`),
+				json.RawMessage(`"` + ext_v1.AgentStateOutdated + `"`),
+			}},
+			"last_check": stringSchema("date-time"),
+		},
+	}
+
+	return &JSONSchemaProps{Type: "object", Properties: map[string]JSONSchemaProps{
+		"apiVersion": {Type: "string"},
+		"kind":       {Type: "string"},
+		"metadata":   {Type: "object"},
+		"spec":       spec,
+		"status":     status,
+	}}
+}
+
+// AgentCustomResourceDefinition returns apiextensions.k8s.io/v1 definition of
+// the agents with the schema, status subresource and printer columns
+func AgentCustomResourceDefinition() *CustomResourceDefinition {
+	kind := reflect.TypeOf(ext_v1.Agent{}).Name()
+	return &CustomResourceDefinition{
+		TypeMeta: meta_v1.TypeMeta{
+			APIVersion: "apiextensions.k8s.io/" + CRDVersionV1,
+			Kind:       "CustomResourceDefinition",
+		},
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:        ext_v1.AgentResourcePlural + "." + ext_v1.GroupName,
+			Annotations: map[string]string{crdRevisionAnnotation: strconv.Itoa(crdRevision)},
+		},
+		Spec: CustomResourceDefinitionSpec{
+			Group: ext_v1.GroupName,
+			Names: CustomResourceDefinitionNames{
+				Plural:   ext_v1.AgentResourcePlural,
+				Singular: "agent",
+				Kind:     kind,
+				ListKind: kind + "List",
+			},
+			Scope: string(apiextensionsv1beta1.NamespaceScoped),
+			Versions: []CustomResourceDefinitionVersion{{
+				Name:         ext_v1.SchemeGroupVersion.Version,
+				Served:       true,
+				Storage:      true,
+				Schema:       &CustomResourceValidation{OpenAPIV3Schema: agentSchema()},
+				Subresources: &CustomResourceSubresources{Status: &struct{}{}},
+				AdditionalPrinterColumns: []CustomResourceColumnDefinition{
+					{Name: "Node", Type: "string", JSONPath: ".spec.nodename"},
+					{Name: "State", Type: "string", JSONPath: ".status.state"},
+					{Name: "Last-Report", Type: "date", JSONPath: ".spec.last_updated"},
+					{Name: "Age", Type: "date", JSONPath: ".metadata.creationTimestamp"},
+				},
+			}},
+		},
+	}
+}
+
+// CreateAgentCustomResourceDefinition is a function to initialize schema for
+// custom resource. The CRD is created with apiextensions.k8s.io/v1 API, the
+// existing one written by older server (e.g. with v1beta1 API and without
+// schema) is updated in place. Clusters which don't serve v1 API get v1beta1
+// CRD as before. The version the CRD is served through is returned.
+func CreateAgentCustomResourceDefinition(clientset apiextensionsclient.Interface) (string, error) {
+	crd := AgentCustomResourceDefinition()
+	body, err := json.Marshal(crd)
+	if err != nil {
+		return "", err
+	}
+
+	client := clientset.ApiextensionsV1beta1().RESTClient()
+	_, err = client.Post().AbsPath(crdPath).Body(body).DoRaw()
+	switch {
+	case err == nil:
+		glog.Infof("Created %s CRD with apiextensions/%s API", crd.Name, CRDVersionV1)
+		return CRDVersionV1, nil
+	case api_errors.IsNotFound(err):
+		glog.Warningf("apiextensions/%s API is not served, creating %s CRD with %s one",
+			CRDVersionV1, crd.Name, CRDVersionV1beta1)
+		return CRDVersionV1beta1, createLegacyAgentCustomResourceDefinition(clientset)
+	case !api_errors.IsAlreadyExists(err):
+		return "", err
+	}
+
+	resp, err := client.Get().AbsPath(crdPath, crd.Name).DoRaw()
+	if err != nil {
+		return "", err
+	}
+	current := &CustomResourceDefinition{}
+	if err = json.Unmarshal(resp, current); err != nil {
+		return "", err
+	}
+	// CRD without the annotation predates the revisions
+	revision, _ := strconv.Atoi(current.Annotations[crdRevisionAnnotation])
+	if revision >= crdRevision {
+		return CRDVersionV1, nil
+	}
+
+	// the rest of the metadata and the status are kept intact
+	current.Spec = crd.Spec
+	if current.Annotations == nil {
+		current.Annotations = map[string]string{}
+	}
+	current.Annotations[crdRevisionAnnotation] = strconv.Itoa(crdRevision)
+	if body, err = json.Marshal(current); err != nil {
+		return "", err
+	}
+	if _, err = client.Put().AbsPath(crdPath, crd.Name).Body(body).DoRaw(); err != nil {
+		return "", err
+	}
+	glog.Infof("Updated %s CRD from revision %d to %d", crd.Name, revision, crdRevision)
+	return CRDVersionV1, nil
+}
+
+// createLegacyAgentCustomResourceDefinition creates the CRD without schema
+// and subresources with apiextensions.k8s.io/v1beta1 API
+func createLegacyAgentCustomResourceDefinition(clientset apiextensionsclient.Interface) error {
 	agent := &apiextensionsv1beta1.CustomResourceDefinition{
 		ObjectMeta: meta_v1.ObjectMeta{
 			Name: ext_v1.AgentResourcePlural + "." + ext_v1.GroupName,
@@ -41,5 +299,8 @@ func CreateAgentCustomResourceDefinition(clientset apiextensionsclient.Interface
 	_, err := clientset.ApiextensionsV1beta1().
 		CustomResourceDefinitions().
 		Create(agent)
+	if api_errors.IsAlreadyExists(err) {
+		return nil
+	}
 	return err
 }
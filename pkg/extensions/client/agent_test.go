@@ -0,0 +1,154 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	apiextensionsclient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+// fakeCRDServer serves apiextensions API with a single CRD.
+type fakeCRDServer struct {
+	sync.Mutex
+	servesV1 bool
+	crd      *CustomResourceDefinition // existing CRD, nil when there is none
+	requests []string
+}
+
+func (s *fakeCRDServer) status(rw http.ResponseWriter, code int, reason meta_v1.StatusReason) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	json.NewEncoder(rw).Encode(&meta_v1.Status{
+		TypeMeta: meta_v1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   meta_v1.StatusFailure,
+		Code:     int32(code),
+		Reason:   reason,
+	})
+}
+
+func (s *fakeCRDServer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+	body, _ := ioutil.ReadAll(r.Body)
+	switch {
+	case r.URL.Path == crdPath+"/"+AgentCustomResourceDefinition().Name && s.servesV1 && s.crd != nil:
+		if r.Method == "PUT" {
+			s.crd = &CustomResourceDefinition{}
+			json.Unmarshal(body, s.crd)
+		}
+		json.NewEncoder(rw).Encode(s.crd)
+	case r.URL.Path == crdPath && s.servesV1:
+		if s.crd != nil {
+			s.status(rw, http.StatusConflict, meta_v1.StatusReasonAlreadyExists)
+			return
+		}
+		s.crd = &CustomResourceDefinition{}
+		json.Unmarshal(body, s.crd)
+		rw.WriteHeader(http.StatusCreated)
+		rw.Write(body)
+	case r.URL.Path == "/apis/apiextensions.k8s.io/v1beta1/customresourcedefinitions":
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusCreated)
+		rw.Write(body)
+	default:
+		s.status(rw, http.StatusNotFound, meta_v1.StatusReasonNotFound)
+	}
+}
+
+func (s *fakeCRDServer) checkRequests(t *testing.T, step string, expected ...string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.requests) != len(expected) {
+		t.Fatalf("%s: requests %v are not as expected %v", step, s.requests, expected)
+	}
+	for i := range expected {
+		if s.requests[i] != expected[i] {
+			t.Fatalf("%s: requests %v are not as expected %v", step, s.requests, expected)
+		}
+	}
+	s.requests = nil
+}
+
+func TestCreateAgentCustomResourceDefinition(t *testing.T) {
+	server := &fakeCRDServer{servesV1: true}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	clientset, err := apiextensionsclient.NewForConfig(&rest.Config{Host: ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := AgentCustomResourceDefinition().Name
+
+	version, err := CreateAgentCustomResourceDefinition(clientset)
+	if err != nil || version != CRDVersionV1 {
+		t.Fatalf("CRD must be created with v1 API, got %q (%v)", version, err)
+	}
+	server.checkRequests(t, "create", "POST "+crdPath)
+	spec := server.crd.Spec.Versions[0]
+	if spec.Schema == nil || spec.Subresources == nil || spec.Subresources.Status == nil ||
+		len(spec.AdditionalPrinterColumns) == 0 {
+		t.Errorf("CRD must have schema, status subresource and printer columns: %+v", spec)
+	}
+
+	// CRD of the current revision is left intact
+	if _, err = CreateAgentCustomResourceDefinition(clientset); err != nil {
+		t.Fatal(err)
+	}
+	server.checkRequests(t, "up to date", "POST "+crdPath, "GET "+crdPath+"/"+name)
+
+	// CRD created by older server with v1beta1 API is updated in place
+	server.crd = &CustomResourceDefinition{
+		ObjectMeta: meta_v1.ObjectMeta{Name: name, ResourceVersion: "42"},
+		Spec: CustomResourceDefinitionSpec{
+			Versions:              []CustomResourceDefinitionVersion{{Name: "v1", Served: true, Storage: true}},
+			PreserveUnknownFields: true,
+		},
+	}
+	if _, err = CreateAgentCustomResourceDefinition(clientset); err != nil {
+		t.Fatal(err)
+	}
+	server.checkRequests(t, "upgrade", "POST "+crdPath, "GET "+crdPath+"/"+name, "PUT "+crdPath+"/"+name)
+	if server.crd.ResourceVersion != "42" || server.crd.Annotations[crdRevisionAnnotation] != strconv.Itoa(crdRevision) ||
+		server.crd.Spec.PreserveUnknownFields || server.crd.Spec.Versions[0].Schema == nil {
+		t.Errorf("CRD must be updated keeping its resource version: %+v", server.crd)
+	}
+
+	// CRD written by newer server is not downgraded
+	server.crd.Annotations[crdRevisionAnnotation] = strconv.Itoa(crdRevision + 1)
+	if _, err = CreateAgentCustomResourceDefinition(clientset); err != nil {
+		t.Fatal(err)
+	}
+	server.checkRequests(t, "newer revision", "POST "+crdPath, "GET "+crdPath+"/"+name)
+
+	// clusters without v1 API get v1beta1 CRD
+	server.servesV1 = false
+	version, err = CreateAgentCustomResourceDefinition(clientset)
+	if err != nil || version != CRDVersionV1beta1 {
+		t.Fatalf("CRD must be created with v1beta1 API, got %q (%v)", version, err)
+	}
+	server.checkRequests(t, "legacy", "POST "+crdPath, "POST /apis/apiextensions.k8s.io/v1beta1/customresourcedefinitions")
+}
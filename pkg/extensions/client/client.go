@@ -79,6 +79,7 @@ type AgentsInterface interface {
 	Get(name string) (*ext_v1.Agent, error)
 	List() (*ext_v1.AgentList, error)
 	Update(*ext_v1.Agent) (*ext_v1.Agent, error)
+	UpdateStatus(*ext_v1.Agent) (*ext_v1.Agent, error)
 	Delete(string, *api_v1.DeleteOptions) error
 }
 
@@ -138,6 +139,22 @@ func (c *AgentsClient) Update(agent *ext_v1.Agent) (result *ext_v1.Agent, err er
 	return result, decodeResponseInto(resp, result)
 }
 
+// UpdateStatus updates the status subresource of the agent
+func (c *AgentsClient) UpdateStatus(agent *ext_v1.Agent) (result *ext_v1.Agent, err error) {
+	result = &ext_v1.Agent{}
+	resp, err := c.client.Put().
+		Namespace("default").
+		Resource("agents").
+		Name(agent.ObjectMeta.Name).
+		SubResource("status").
+		Body(agent).
+		DoRaw()
+	if err != nil {
+		return result, err
+	}
+	return result, decodeResponseInto(resp, result)
+}
+
 // Delete agent function
 func (c *AgentsClient) Delete(name string, options *api_v1.DeleteOptions) error {
 	return c.client.Delete().
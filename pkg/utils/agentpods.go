@@ -0,0 +1,103 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// AgentSelector maps the pods matching label selector to the flavor of
+// agents. When the flavor is empty, it is told by the network of the pod.
+type AgentSelector struct {
+	Selector string `yaml:"selector"`
+	Flavor   string `yaml:"flavor"`
+}
+
+// AgentPodsPolicy defines which pods are the agents and which flavor they
+// are of. Pods are looked up in all the namespaces when none is given.
+type AgentPodsPolicy struct {
+	Namespaces []string        `yaml:"namespaces"`
+	Selectors  []AgentSelector `yaml:"selectors"`
+}
+
+// DefaultAgentPodsPolicy selects the agents deployed by the helm chart.
+func DefaultAgentPodsPolicy() AgentPodsPolicy {
+	return AgentPodsPolicy{
+		Selectors: []AgentSelector{
+			{Selector: "app=netchecker-agent", Flavor: AgentFlavorPodNetwork},
+			{Selector: "app=netchecker-agent-hostnet", Flavor: AgentFlavorHostnet},
+		},
+	}
+}
+
+// ParseAgentSelectors parses semicolon separated list of selectors, the
+// flavor of each one is given after the last colon, e.g.
+// "app=netchecker-agent:pod_network;app in (a, b)".
+func ParseAgentSelectors(value string) ([]AgentSelector, error) {
+	rv := []AgentSelector{}
+	for _, item := range strings.Split(value, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		selector := AgentSelector{Selector: item}
+		if i := strings.LastIndex(item, ":"); i != -1 {
+			selector.Selector = strings.TrimSpace(item[:i])
+			selector.Flavor = strings.TrimSpace(item[i+1:])
+		}
+		if selector.Selector == "" {
+			return nil, fmt.Errorf("empty selector in %q", item)
+		}
+		rv = append(rv, selector)
+	}
+	return rv, nil
+}
+
+// Validate checks that there are selectors and all of them can be parsed.
+func (p *AgentPodsPolicy) Validate() error {
+	if len(p.Selectors) == 0 {
+		return fmt.Errorf("at least one agent pods selector is required")
+	}
+	for _, selector := range p.Selectors {
+		if _, err := labels.Parse(selector.Selector); err != nil {
+			return fmt.Errorf("invalid agent pods selector %q: %v", selector.Selector, err)
+		}
+	}
+	return nil
+}
+
+// Flavor returns the flavor of the first selector matching the pod. Pods
+// which have no flavor set are hostnet agents if they run in host network,
+// pod network ones otherwise.
+func (p *AgentPodsPolicy) Flavor(pod *v1.Pod) string {
+	for _, item := range p.Selectors {
+		selector, err := labels.Parse(item.Selector)
+		if err != nil || !selector.Matches(labels.Set(pod.ObjectMeta.Labels)) {
+			continue
+		}
+		if item.Flavor != "" {
+			return item.Flavor
+		}
+		break
+	}
+	if pod.Spec.HostNetwork {
+		return AgentFlavorHostnet
+	}
+	return AgentFlavorPodNetwork
+}
@@ -0,0 +1,148 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestParseAgentSelectors(t *testing.T) {
+	selectors, err := ParseAgentSelectors("app=agent:pod_network; tier in (a, b):sriov;app=other")
+	if err != nil {
+		t.Fatalf("Selectors must be parsed. Details: %v", err)
+	}
+	expected := []AgentSelector{
+		{Selector: "app=agent", Flavor: AgentFlavorPodNetwork},
+		{Selector: "tier in (a, b)", Flavor: "sriov"},
+		{Selector: "app=other"},
+	}
+	if !reflect.DeepEqual(selectors, expected) {
+		t.Errorf("Selectors %+v are not as expected %+v", selectors, expected)
+	}
+	if _, err := ParseAgentSelectors(":hostnet"); err == nil {
+		t.Error("Empty selector must be rejected")
+	}
+
+	policy := AgentPodsPolicy{Selectors: []AgentSelector{{Selector: "app in (a"}}}
+	if err := policy.Validate(); err == nil {
+		t.Error("Invalid selector must be rejected")
+	}
+}
+
+func TestAgentPodsPolicyFlavor(t *testing.T) {
+	policy := AgentPodsPolicy{Selectors: []AgentSelector{
+		{Selector: "app=sriov-agent", Flavor: "sriov"},
+		{Selector: "app=agent"},
+	}}
+	for _, tc := range []struct {
+		app     string
+		hostnet bool
+		flavor  string
+	}{
+		{"sriov-agent", true, "sriov"},
+		{"agent", false, AgentFlavorPodNetwork},
+		{"agent", true, AgentFlavorHostnet},
+	} {
+		pod := &v1.Pod{
+			ObjectMeta: meta_v1.ObjectMeta{Labels: map[string]string{"app": tc.app}},
+			Spec:       v1.PodSpec{HostNetwork: tc.hostnet},
+		}
+		if flavor := policy.Flavor(pod); flavor != tc.flavor {
+			t.Errorf("Flavor %q is not as expected %q for %+v", flavor, tc.flavor, tc)
+		}
+	}
+}
+
+func TestAgentMetricsName(t *testing.T) {
+	agent := agentExample()
+	agent.NodeName = "node-1"
+	for _, tc := range []struct {
+		podName string
+		flavor  string
+		name    string
+	}{
+		{"netchecker-agent-hostnet-x1", "", "node-1-host_network"},
+		{"netchecker-agent-x1", "", "node-1-private_network"},
+		{"agent-on-host-x1", AgentFlavorHostnet, "node-1-host_network"},
+		{"sriov-agent-x1", "sriov", "node-1-sriov"},
+	} {
+		agent.PodName = tc.podName
+		if name := agentMetricsName(&agent, tc.flavor); name != tc.name {
+			t.Errorf("Metrics name %q is not as expected %q for %+v", name, tc.name, tc)
+		}
+	}
+}
+
+func TestKubeProxyPods(t *testing.T) {
+	cfg := GetOrCreateConfig()
+	defer func(policy AgentPodsPolicy) { cfg.Agents = policy }(cfg.Agents)
+	cfg.Agents = AgentPodsPolicy{
+		Namespaces: []string{"netchecker"},
+		Selectors: []AgentSelector{
+			{Selector: "app=agent"},
+			{Selector: "tier=agents"},
+		},
+	}
+
+	pod := func(name, namespace string, labels map[string]string) *v1.Pod {
+		return &v1.Pod{ObjectMeta: meta_v1.ObjectMeta{Name: name, Namespace: namespace, Labels: labels}}
+	}
+	proxy := &KubeProxy{Client: fake.NewSimpleClientset(
+		pod("agent-1", "netchecker", map[string]string{"app": "agent", "tier": "agents"}),
+		pod("agent-2", "netchecker", map[string]string{"tier": "agents"}),
+		pod("agent-3", "default", map[string]string{"app": "agent"}),
+		pod("other", "netchecker", map[string]string{"app": "other"}),
+	)}
+
+	pods, err := proxy.Pods()
+	if err != nil {
+		t.Fatalf("Pods must be listed. Details: %v", err)
+	}
+	names := []string{}
+	for _, pod := range pods.Items {
+		names = append(names, pod.ObjectMeta.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"agent-1", "agent-2"}) {
+		t.Errorf("Pods %v are not as expected", names)
+	}
+}
+
+func TestConnectivityReportCustomFlavor(t *testing.T) {
+	cfg := GetOrCreateConfig()
+	defer func(policy AgentPodsPolicy) { cfg.Agents = policy }(cfg.Agents)
+	cfg.Agents.Selectors = append([]AgentSelector{{Selector: "app=sriov-agent", Flavor: "sriov"}},
+		cfg.Agents.Selectors...)
+
+	now := time.Now()
+	custom := agentPod("sriov-agent-1", "node-1", false)
+	custom.ObjectMeta.Labels["app"] = "sriov-agent"
+	pods := &v1.PodList{Items: []v1.Pod{agentPod("agent-1", "node-1", false), custom}}
+	agent := agentExample()
+	agent.LastUpdated = now
+	agents := NcAgentCache{"agent-1": agent}
+
+	report := BuildConnectivityReport(pods, agents, nil, nil, now)
+
+	node := report.Nodes[0]
+	if node.Healthy || node.PodNetwork != ReasonOK || node.Flavors["sriov"] != ReasonAbsent {
+		t.Errorf("Custom flavor must be checked separately, got %+v", node)
+	}
+}
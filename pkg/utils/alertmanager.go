@@ -0,0 +1,308 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Names of the alerts pushed to Alertmanager
+const (
+	AlertAgentAbsent     = "NetcheckerAgentAbsent"
+	AlertAgentOutdated   = "NetcheckerAgentOutdated"
+	AlertProbeFailed     = "NetcheckerProbeFailed"
+	AlertDNSInconsistent = "NetcheckerDNSInconsistent"
+)
+
+// alertmanagerAlertsPath is the path of Alertmanager v2 API alerts are
+// posted to.
+const alertmanagerAlertsPath = "/api/v2/alerts"
+
+// AlertmanagerConfig defines where and how often the alerts are pushed.
+type AlertmanagerConfig struct {
+	// Base URLs of Alertmanager instances, pushing is disabled when empty
+	URLs []string `yaml:"urls"`
+	// Active alerts are sent again after this period, so Alertmanager
+	// doesn't resolve them
+	ResendInterval time.Duration `yaml:"resend_interval"`
+	// Timeout of a single push
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// DefaultAlertmanagerConfig returns the configuration resending active
+// alerts every minute.
+func DefaultAlertmanagerConfig() AlertmanagerConfig {
+	return AlertmanagerConfig{
+		ResendInterval: time.Minute,
+		Timeout:        5 * time.Second,
+	}
+}
+
+// Alert is an alert in the format of Alertmanager v2 API.
+type Alert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      *time.Time        `json:"endsAt,omitempty"`
+}
+
+// key identifies the alert by its labels.
+func (a *Alert) key() string {
+	names := make([]string, 0, len(a.Labels))
+	for name := range a.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, name+"="+a.Labels[name])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// agentAlert creates the alert about the agent, labeled with the node, zone
+// and flavor of the agent.
+func agentAlert(name, severity string, node *NodeVerdict, verdict *AgentVerdict, now time.Time) Alert {
+	labels := map[string]string{
+		"alertname": name,
+		"severity":  severity,
+		"agent":     verdict.Name,
+		"flavor":    verdict.Flavor,
+	}
+	if node.Node != "" {
+		labels["node"] = node.Node
+	}
+	if node.Zone != "" {
+		labels["zone"] = node.Zone
+	}
+	return Alert{Labels: labels, StartsAt: now}
+}
+
+// BuildAlerts creates the alerts about absent and outdated agents, failed
+// probes and names resolved inconsistently. Excluded and silenced agents
+// don't raise alerts, nor are they counted among the agents resolving
+// names inconsistently.
+func BuildAlerts(report *ConnectivityReport, dns *DNSCheckInfo, now time.Time) []Alert {
+	alerts := []Alert{}
+	muted := map[string]bool{}
+	for i := range report.Nodes {
+		node := &report.Nodes[i]
+		for j := range node.Agents {
+			verdict := &node.Agents[j]
+			if reasonMuted(verdict.Reason) {
+				muted[verdict.Name] = true
+			}
+			switch verdict.Reason {
+			case ReasonAbsent:
+				alert := agentAlert(AlertAgentAbsent, "critical", node, verdict, now)
+				alert.Annotations = map[string]string{
+					"summary": fmt.Sprintf("Agent %s has never reported to netchecker server", verdict.Name),
+				}
+				alerts = append(alerts, alert)
+			case ReasonOutdated:
+				alert := agentAlert(AlertAgentOutdated, "critical", node, verdict, now)
+				alert.Annotations = map[string]string{
+					"summary": fmt.Sprintf("Agent %s has stopped reporting to netchecker server", verdict.Name),
+				}
+				if verdict.LastSeen != nil {
+					alert.Annotations["last_seen"] = verdict.LastSeen.Format(time.RFC3339)
+				}
+				alerts = append(alerts, alert)
+			case ReasonProbeFailed:
+				for _, failure := range verdict.FailedProbes {
+					alert := agentAlert(AlertProbeFailed, "warning", node, verdict, now)
+					alert.Labels["url"] = failure.URL
+					alert.Annotations = map[string]string{
+						"summary": fmt.Sprintf("Probe of %s by agent %s fails", failure.URL, verdict.Name),
+						"reason":  failure.Reason,
+					}
+					alerts = append(alerts, alert)
+				}
+			}
+		}
+	}
+
+	if dns != nil {
+		for _, name := range dns.Names {
+			if name.Consistent {
+				continue
+			}
+			agents := make([]string, 0, len(name.Inconsistent))
+			for _, answer := range name.Inconsistent {
+				if !muted[answer.Agent] {
+					agents = append(agents, answer.Agent)
+				}
+			}
+			if len(agents) == 0 {
+				continue
+			}
+			alerts = append(alerts, Alert{
+				Labels: map[string]string{
+					"alertname": AlertDNSInconsistent,
+					"severity":  "warning",
+					"name":      name.Name,
+				},
+				Annotations: map[string]string{
+					"summary": fmt.Sprintf("Agents resolve %s inconsistently", name.Name),
+					"agents":  strings.Join(agents, ", "),
+				},
+				StartsAt: now,
+			})
+		}
+	}
+	return alerts
+}
+
+// pushedAlert is the alert known to Alertmanagers, or the one still to be
+// pushed to them.
+type pushedAlert struct {
+	alert  Alert
+	sentAt map[string]time.Time // time the alert was last pushed to each of Alertmanagers
+}
+
+// Alerter pushes the alerts to Alertmanagers. Active alerts are pushed when
+// they fire and then every ResendInterval, resolved ones are pushed once
+// with endsAt. Delivery is tracked for every Alertmanager, alerts which
+// failed to be pushed to one of them are retried on the next call.
+type Alerter struct {
+	sync.Mutex // protects the alerts
+	config     AlertmanagerConfig
+	client     *http.Client
+	alerts     map[string]*pushedAlert
+}
+
+// NewAlerter creates the alerter pushing to the configured Alertmanagers.
+func NewAlerter(config AlertmanagerConfig) *Alerter {
+	return &Alerter{
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+		alerts: map[string]*pushedAlert{},
+	}
+}
+
+// update updates the known alerts with the firing ones, the ones which are
+// no longer firing are resolved.
+func (a *Alerter) update(firing []Alert, now time.Time) {
+	seen := map[string]bool{}
+	for _, alert := range firing {
+		key := alert.key()
+		seen[key] = true
+
+		known, exists := a.alerts[key]
+		if !exists {
+			a.alerts[key] = &pushedAlert{alert: alert, sentAt: map[string]time.Time{}}
+			continue
+		}
+		// alert is active since it has fired first
+		alert.StartsAt = known.alert.StartsAt
+		if known.alert.EndsAt != nil {
+			// resolution is not pushed everywhere yet, the alert is active again
+			known.sentAt = map[string]time.Time{}
+		}
+		known.alert = alert
+	}
+
+	for key, known := range a.alerts {
+		if !seen[key] && known.alert.EndsAt == nil {
+			endsAt := now
+			known.alert.EndsAt = &endsAt
+			known.sentAt = map[string]time.Time{}
+		}
+	}
+}
+
+// due returns the keys of the alerts to be pushed to the Alertmanager.
+func (a *Alerter) due(url string, now time.Time) []string {
+	keys := []string{}
+	for key, known := range a.alerts {
+		sentAt, sent := known.sentAt[url]
+		if !sent || (known.alert.EndsAt == nil && now.Sub(sentAt) >= a.config.ResendInterval) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Push sends the new, resolved and due for resending alerts to every
+// Alertmanager.
+func (a *Alerter) Push(firing []Alert, now time.Time) error {
+	a.Lock()
+	defer a.Unlock()
+
+	a.update(firing, now)
+
+	var errs []string
+	for _, url := range a.config.URLs {
+		keys := a.due(url, now)
+		if len(keys) == 0 {
+			continue
+		}
+		alerts := make([]Alert, 0, len(keys))
+		for _, key := range keys {
+			alerts = append(alerts, a.alerts[key].alert)
+		}
+
+		if err := a.post(url, alerts); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		glog.V(5).Infof("%v alerts pushed to %s", len(alerts), url)
+		for _, key := range keys {
+			a.alerts[key].sentAt[url] = now
+		}
+	}
+
+	// resolved alerts are forgotten once every Alertmanager got them
+	for key, known := range a.alerts {
+		if known.alert.EndsAt != nil && len(known.sentAt) >= len(a.config.URLs) {
+			delete(a.alerts, key)
+		}
+	}
+
+	if len(errs) != 0 {
+		return fmt.Errorf("pushing alerts failed: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// post sends the alerts to the Alertmanager.
+func (a *Alerter) post(url string, alerts []Alert) error {
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+
+	url = strings.TrimSuffix(url, "/") + alertmanagerAlertsPath
+	resp, err := a.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s responded with status %v", url, resp.Status)
+	}
+	return nil
+}
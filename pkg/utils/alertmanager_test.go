@@ -0,0 +1,197 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBuildAlerts(t *testing.T) {
+	now := time.Now()
+	report := &ConnectivityReport{Nodes: []NodeVerdict{{
+		Node:         "node-1",
+		NodeTopology: NodeTopology{Zone: "zone-a"},
+		Agents: []AgentVerdict{
+			{Name: "agent-1", Flavor: AgentFlavorPodNetwork, Reason: ReasonAbsent},
+			{Name: "agent-2", Flavor: AgentFlavorHostnet, Reason: ReasonProbeFailed, FailedProbes: []ProbeFailure{
+				{URL: "http://example.com", Reason: ProbeConnectionFailed},
+			}},
+			{Name: "agent-3", Flavor: AgentFlavorPodNetwork, Reason: ReasonSilenced},
+			{Name: "agent-4", Flavor: AgentFlavorPodNetwork, Reason: ReasonOK},
+		},
+	}}}
+	dns := &DNSCheckInfo{Names: []DNSNameVerdict{
+		{Name: "kubernetes.default", Consistent: true},
+		{Name: "example.com", Inconsistent: []DNSAgentAnswer{{Agent: "agent-4"}}},
+		{Name: "silenced.example.com", Inconsistent: []DNSAgentAnswer{{Agent: "agent-3"}}},
+	}}
+
+	alerts := BuildAlerts(report, dns, now)
+
+	expected := []map[string]string{
+		{"alertname": AlertAgentAbsent, "severity": "critical", "agent": "agent-1",
+			"flavor": AgentFlavorPodNetwork, "node": "node-1", "zone": "zone-a"},
+		{"alertname": AlertProbeFailed, "severity": "warning", "agent": "agent-2",
+			"flavor": AgentFlavorHostnet, "node": "node-1", "zone": "zone-a", "url": "http://example.com"},
+		{"alertname": AlertDNSInconsistent, "severity": "warning", "name": "example.com"},
+	}
+	if len(alerts) != len(expected) {
+		t.Fatalf("Alerts %+v are not as expected", alerts)
+	}
+	for i := range alerts {
+		if !reflect.DeepEqual(alerts[i].Labels, expected[i]) {
+			t.Errorf("Labels %v are not as expected %v", alerts[i].Labels, expected[i])
+		}
+		if !alerts[i].StartsAt.Equal(now) || alerts[i].EndsAt != nil {
+			t.Errorf("Alert %+v must be active since now", alerts[i])
+		}
+	}
+}
+
+// fakeAlertmanager records the alerts pushed to it.
+type fakeAlertmanager struct {
+	sync.Mutex
+	pushes [][]Alert
+	fail   bool
+}
+
+func (am *fakeAlertmanager) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	am.Lock()
+	defer am.Unlock()
+
+	if r.URL.Path != alertmanagerAlertsPath || am.fail {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	alerts := []Alert{}
+	if err := json.NewDecoder(r.Body).Decode(&alerts); err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	am.pushes = append(am.pushes, alerts)
+}
+
+func (am *fakeAlertmanager) lastPush(t *testing.T, count int) []Alert {
+	am.Lock()
+	defer am.Unlock()
+
+	if len(am.pushes) != count {
+		t.Fatalf("%v pushes are expected, got %v", count, len(am.pushes))
+	}
+	if count == 0 {
+		return nil
+	}
+	return am.pushes[count-1]
+}
+
+func TestAlerterPush(t *testing.T) {
+	am := &fakeAlertmanager{}
+	server := httptest.NewServer(am)
+	defer server.Close()
+
+	alerter := NewAlerter(AlertmanagerConfig{
+		URLs:           []string{server.URL + "/"},
+		ResendInterval: time.Minute,
+		Timeout:        time.Second,
+	})
+	start := time.Now()
+	firing := func(now time.Time) []Alert {
+		return []Alert{{Labels: map[string]string{"alertname": AlertAgentOutdated, "agent": "agent-1"}, StartsAt: now}}
+	}
+
+	// failed push is retried next time
+	am.fail = true
+	if err := alerter.Push(firing(start), start); err == nil {
+		t.Error("Push must fail when Alertmanager fails")
+	}
+	am.fail = false
+	if err := alerter.Push(firing(start.Add(time.Second)), start.Add(time.Second)); err != nil {
+		t.Fatalf("Failed to push alerts. Details: %v", err)
+	}
+	pushed := am.lastPush(t, 1)
+	if len(pushed) != 1 || !pushed[0].StartsAt.Equal(start) {
+		t.Errorf("Alert active since the first check is expected, got %+v", pushed)
+	}
+
+	// active alert is not resent until the resend interval passes
+	alerter.Push(firing(start.Add(30*time.Second)), start.Add(30*time.Second))
+	am.lastPush(t, 1)
+	alerter.Push(firing(start.Add(2*time.Minute)), start.Add(2*time.Minute))
+	if pushed = am.lastPush(t, 2); !pushed[0].StartsAt.Equal(start) || pushed[0].EndsAt != nil {
+		t.Errorf("Resent alert must keep its start, got %+v", pushed)
+	}
+
+	resolvedAt := start.Add(3 * time.Minute)
+	alerter.Push(nil, resolvedAt)
+	if pushed = am.lastPush(t, 3); pushed[0].EndsAt == nil || !pushed[0].EndsAt.Equal(resolvedAt) {
+		t.Errorf("Resolved alert must be sent with endsAt, got %+v", pushed)
+	}
+	alerter.Push(nil, start.Add(10*time.Minute))
+	am.lastPush(t, 3)
+}
+
+func TestAlerterPushPerAlertmanager(t *testing.T) {
+	healthy, failing := &fakeAlertmanager{}, &fakeAlertmanager{fail: true}
+	healthyServer, failingServer := httptest.NewServer(healthy), httptest.NewServer(failing)
+	defer healthyServer.Close()
+	defer failingServer.Close()
+
+	alerter := NewAlerter(AlertmanagerConfig{
+		URLs:           []string{healthyServer.URL, failingServer.URL},
+		ResendInterval: time.Minute,
+		Timeout:        time.Second,
+	})
+	start := time.Now()
+	firing := []Alert{{Labels: map[string]string{"alertname": AlertAgentOutdated, "agent": "agent-1"}, StartsAt: start}}
+
+	if err := alerter.Push(firing, start); err == nil {
+		t.Error("Push must fail when one of Alertmanagers fails")
+	}
+	healthy.lastPush(t, 1)
+
+	// the alert is retried for the failed Alertmanager only
+	failing.Lock()
+	failing.fail = false
+	failing.Unlock()
+	if err := alerter.Push(firing, start.Add(time.Second)); err != nil {
+		t.Fatalf("Failed to push alerts. Details: %v", err)
+	}
+	healthy.lastPush(t, 1)
+	failing.lastPush(t, 1)
+
+	// resolution is kept until every Alertmanager gets it
+	failing.Lock()
+	failing.fail = true
+	failing.Unlock()
+	alerter.Push(nil, start.Add(2*time.Second))
+	healthy.lastPush(t, 2)
+	failing.Lock()
+	failing.fail = false
+	failing.Unlock()
+	alerter.Push(nil, start.Add(3*time.Second))
+	if pushed := failing.lastPush(t, 2); pushed[0].EndsAt == nil {
+		t.Errorf("Resolved alert must be sent with endsAt, got %+v", pushed)
+	}
+	healthy.lastPush(t, 2)
+	if len(alerter.alerts) != 0 {
+		t.Errorf("Resolved alert must be forgotten, got %+v", alerter.alerts)
+	}
+}
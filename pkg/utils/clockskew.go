@@ -0,0 +1,71 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	ext_v1 "github.com/Mirantis/k8s-netchecker-server/pkg/extensions/apis/v1"
+)
+
+// ClockSkewPolicy defines when clock of the agent's node is considered
+// skewed relative to the server one.
+type ClockSkewPolicy struct {
+	// Zero value disables the detection
+	MaxSkew time.Duration `yaml:"max_skew"`
+	// Skewed agents fail the connectivity check instead of being marked only
+	FailCheck bool `yaml:"fail_check"`
+}
+
+// ClockSkew returns how far the agent's clock is ahead of the server one at
+// the time of the report, negative value means the agent's clock is behind.
+func ClockSkew(agent *ext_v1.AgentSpec) time.Duration {
+	if agent.HostDate.IsZero() || agent.LastUpdated.IsZero() {
+		return 0
+	}
+	return agent.HostDate.Sub(agent.LastUpdated)
+}
+
+// Skewed tells whether the agent's clock skew exceeds the limit.
+func (p *ClockSkewPolicy) Skewed(agent *ext_v1.AgentSpec) bool {
+	if p.MaxSkew <= 0 {
+		return false
+	}
+	skew := ClockSkew(agent)
+	return skew > p.MaxSkew || skew < -p.MaxSkew
+}
+
+var clockSkewSeconds = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "ncagent",
+		Name:      "clock_skew_seconds",
+		Help:      "Difference between the node's clock and the server one at the time of the latest report.",
+	},
+	[]string{"node"},
+)
+
+func init() {
+	clockSkewSeconds, _ = tryRegisterGaugeVec(clockSkewSeconds)
+}
+
+// UpdateClockSkewMetric exports the clock skew of the reporting agent's node.
+func UpdateClockSkewMetric(agent *ext_v1.AgentSpec) {
+	if agent.NodeName == "" {
+		return
+	}
+	clockSkewSeconds.WithLabelValues(agent.NodeName).Set(ClockSkew(agent).Seconds())
+}
@@ -0,0 +1,86 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"testing"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestClockSkewed(t *testing.T) {
+	policy := ClockSkewPolicy{MaxSkew: 5 * time.Second}
+	agent := agentExample()
+
+	for _, tc := range []struct {
+		skew   time.Duration
+		skewed bool
+	}{
+		{0, false},
+		{4 * time.Second, false},
+		{6 * time.Second, true},
+		{-6 * time.Second, true},
+	} {
+		agent.LastUpdated = agent.HostDate.Add(-tc.skew)
+		if ClockSkew(&agent) != tc.skew {
+			t.Errorf("Clock skew must be %v, got %v", tc.skew, ClockSkew(&agent))
+		}
+		if policy.Skewed(&agent) != tc.skewed {
+			t.Errorf("Clock skew %v must be detected: %v", tc.skew, tc.skewed)
+		}
+	}
+
+	policy.MaxSkew = 0
+	if policy.Skewed(&agent) {
+		t.Error("Zero limit must disable the detection")
+	}
+}
+
+func TestConnectivityReportClockSkew(t *testing.T) {
+	cfg := GetOrCreateConfig()
+	defer func(policy ClockSkewPolicy) { cfg.ClockSkew = policy }(cfg.ClockSkew)
+	cfg.ClockSkew = ClockSkewPolicy{MaxSkew: time.Second}
+
+	now := time.Now()
+	agent := agentExample()
+	agent.LastUpdated = now
+	agent.HostDate = now.Add(time.Minute)
+	agents := NcAgentCache{"agent": agent}
+
+	report := BuildConnectivityReport(nil, agents, nil, nil, now)
+	if !report.Healthy || !report.Nodes[0].ClockSkewed || report.Counts.ClockSkewed != 1 {
+		t.Errorf("Node must be marked but stay healthy, got %+v", report)
+	}
+
+	cfg.ClockSkew.FailCheck = true
+	report = BuildConnectivityReport(nil, agents, nil, nil, now)
+	if report.Healthy || report.Nodes[0].Agents[0].Reason != ReasonClockSkew {
+		t.Errorf("Skewed clock must fail the check, got %+v", report)
+	}
+}
+
+func TestClockSkewPolicyFromYaml(t *testing.T) {
+	cfg := AppConfig{}
+	data := []byte("clock_skew:\n  max_skew: 2s\n  fail_check: true\n")
+
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		t.Fatalf("Failed to parse the configuration. Details: %v", err)
+	}
+	expected := ClockSkewPolicy{MaxSkew: 2 * time.Second, FailCheck: true}
+	if cfg.ClockSkew != expected {
+		t.Errorf("Clock skew policy %v is not as expected %v", cfg.ClockSkew, expected)
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"encoding/json"
 	"github.com/golang/glog"
 	"gopkg.in/yaml.v2"
+	"io/ioutil"
 	"sync"
 	"time"
 )
@@ -25,18 +26,42 @@ import (
 type AppConfig struct {
 	sync.Mutex                  // ensures atomic writes; protects the following fields
 	UseKubeClient bool          // use k8s TPR (true) or etcd (false) as a data storage
+	Storage       string        // agents data storage backend: k8s, etcd, etcdv3, bolt or memory
 	EtcdEndpoints string        // endpoints (IPaddress1:PORT1[,IPaddress2:PORT2]) of etcd server
 	                            // when etcd is being used as a data storage
 	EtcdTree      string        // Root of NetChecker server etcd tree
 	EtcdCertFile  string        // SSL certificate file when using HTTPS to connect to etcd
 	EtcdKeyFile   string        // SSL key file when using HTTPS to connect to etcd
 	EtcdCAFile    string        // SSL CA file when using HTTPS to connect to etcd
+	BoltPath      string        // path to BoltDB file when bolt is being used as a data storage
+	HistorySize   int           // number of reports kept per agent by storages supporting history
 	HttpListen    string        // REST API endpoint (IPaddress:PORT) for netchecker server to listen to
 	PingTimeout   time.Duration // etcd ping timeout (sec)
 	ReportTTL     time.Duration // TTL for Agent report data when etcd is in use (sec)
 	CheckInterval time.Duration // Interval of checking that agents data is up-to-date
+	Staleness     StalenessPolicy      `yaml:"staleness"`       // when agents which stopped reporting are outdated
+	Probes        ProbePolicy          `yaml:"probes"`          // whether probe results of the agents affect connectivity check
+	ClockSkew     ClockSkewPolicy      `yaml:"clock_skew"`      // when clocks of the agents' nodes are skewed
+	PodCIDRs      []string             `yaml:"pod_cidrs"`       // pod network agents must have an address in one of them
+	RackLabel     string               `yaml:"rack_label"`      // node label holding the rack of the node
+	Agents        AgentPodsPolicy      `yaml:"agents"`          // which pods are the agents and of which flavor
+	PodCache      bool                 `yaml:"pod_cache"`       // serve agent pods from informers instead of listing them
+	Exclusions    ExclusionPolicy      `yaml:"exclusions"`      // rules excluding failing agents from connectivity check
+	Notifier      NotifierConfig       `yaml:"notifier"`        // webhooks the connectivity events are sent to
+	Alertmanager  AlertmanagerConfig   `yaml:"alertmanager"`    // Alertmanagers the alerts are pushed to
+	Events        EventsConfig         `yaml:"events"`          // k8s events about the agent pods and their nodes
+	Conditions    NodeConditionsConfig `yaml:"node_conditions"` // condition patched onto the status of the nodes
 }
 
+// Supported values of AppConfig.Storage
+const (
+	StorageK8s    = "k8s"
+	StorageEtcd   = "etcd"
+	StorageEtcdV3 = "etcdv3"
+	StorageMemory = "memory"
+	StorageBolt   = "bolt"
+)
+
 var main_config *AppConfig
 
 func (c *AppConfig) ToJson() ([]byte, error) {
@@ -61,10 +86,124 @@ func (c *AppConfig) ToYaml() ([]byte, error) {
 	return rv, err
 }
 
+// fileConfig is the layout of YAML configuration file, values left out of
+// the file keep the current ones. Durations are given as strings (e.g. "30s").
+type fileConfig struct {
+	UseKubeClient *bool                `yaml:"kubeproxyinit"`
+	Storage       *string              `yaml:"storage"`
+	EtcdEndpoints *string              `yaml:"etcd_endpoints"`
+	EtcdTree      *string              `yaml:"etcd_tree"`
+	EtcdCertFile  *string              `yaml:"etcd_cert"`
+	EtcdKeyFile   *string              `yaml:"etcd_key"`
+	EtcdCAFile    *string              `yaml:"etcd_ca"`
+	BoltPath      *string              `yaml:"bolt_path"`
+	HistorySize   *int                 `yaml:"history_size"`
+	HttpListen    *string              `yaml:"endpoint"`
+	PingTimeout   *time.Duration       `yaml:"ping_timeout"`
+	ReportTTL     *time.Duration       `yaml:"report_ttl"`
+	CheckInterval *time.Duration       `yaml:"check_interval"`
+	Staleness     StalenessPolicy      `yaml:"staleness"`
+	Probes        ProbePolicy          `yaml:"probes"`
+	ClockSkew     ClockSkewPolicy      `yaml:"clock_skew"`
+	PodCIDRs      []string             `yaml:"pod_cidrs"`
+	RackLabel     *string              `yaml:"rack_label"`
+	Agents        AgentPodsPolicy      `yaml:"agents"`
+	PodCache      *bool                `yaml:"pod_cache"`
+	Exclusions    ExclusionPolicy      `yaml:"exclusions"`
+	Notifier      NotifierConfig       `yaml:"notifier"`
+	Alertmanager  AlertmanagerConfig   `yaml:"alertmanager"`
+	Events        EventsConfig         `yaml:"events"`
+	Conditions    NodeConditionsConfig `yaml:"node_conditions"`
+}
+
+// LoadFile overrides the configuration with values from YAML file
+func (c *AppConfig) LoadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	file := fileConfig{
+		Staleness:    c.Staleness,
+		Probes:       c.Probes,
+		ClockSkew:    c.ClockSkew,
+		PodCIDRs:     c.PodCIDRs,
+		Agents:       c.Agents,
+		Exclusions:   c.Exclusions,
+		Notifier:     c.Notifier,
+		Alertmanager: c.Alertmanager,
+		Events:       c.Events,
+		Conditions:   c.Conditions,
+	}
+	if err = yaml.Unmarshal(data, &file); err != nil {
+		return err
+	}
+	for _, d := range []struct {
+		value *time.Duration
+		dst   *time.Duration
+	}{
+		{file.PingTimeout, &c.PingTimeout},
+		{file.ReportTTL, &c.ReportTTL},
+		{file.CheckInterval, &c.CheckInterval},
+	} {
+		if d.value != nil {
+			*d.dst = *d.value
+		}
+	}
+	for _, s := range []struct {
+		value *string
+		dst   *string
+	}{
+		{file.Storage, &c.Storage},
+		{file.EtcdEndpoints, &c.EtcdEndpoints},
+		{file.EtcdTree, &c.EtcdTree},
+		{file.EtcdCertFile, &c.EtcdCertFile},
+		{file.EtcdKeyFile, &c.EtcdKeyFile},
+		{file.EtcdCAFile, &c.EtcdCAFile},
+		{file.BoltPath, &c.BoltPath},
+		{file.HttpListen, &c.HttpListen},
+		{file.RackLabel, &c.RackLabel},
+	} {
+		if s.value != nil {
+			*s.dst = *s.value
+		}
+	}
+	if file.UseKubeClient != nil {
+		c.UseKubeClient = *file.UseKubeClient
+	}
+	if file.HistorySize != nil {
+		c.HistorySize = *file.HistorySize
+	}
+	if file.PodCache != nil {
+		c.PodCache = *file.PodCache
+	}
+	c.Staleness = file.Staleness
+	c.Probes = file.Probes
+	c.ClockSkew = file.ClockSkew
+	c.PodCIDRs = file.PodCIDRs
+	c.Agents = file.Agents
+	c.Exclusions = file.Exclusions
+	c.Notifier = file.Notifier
+	c.Alertmanager = file.Alertmanager
+	c.Events = file.Events
+	c.Conditions = file.Conditions
+	return nil
+}
+
 func GetOrCreateConfig() *AppConfig {
 	return main_config
 }
 
 func init() {
-	main_config = new(AppConfig)
+	main_config = &AppConfig{
+		Staleness:    DefaultStalenessPolicy(),
+		Agents:       DefaultAgentPodsPolicy(),
+		Exclusions:   DefaultExclusionPolicy(),
+		Notifier:     DefaultNotifierConfig(),
+		Alertmanager: DefaultAlertmanagerConfig(),
+		Events:       DefaultEventsConfig(),
+		Conditions:   DefaultNodeConditionsConfig(),
+	}
 }
@@ -0,0 +1,61 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLoadFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "netchecker-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`
+storage: bolt
+bolt_path: /data/agents.db
+report_ttl: 5m
+check_interval: 20s
+reportttl: 1
+staleness:
+  miss_threshold: 3
+  min_staleness: 30s
+`)
+	file.Close()
+
+	config := &AppConfig{
+		PingTimeout:   5 * time.Second,
+		ReportTTL:     300 * time.Second,
+		CheckInterval: 10 * time.Second,
+		Staleness:     DefaultStalenessPolicy(),
+	}
+	if err = config.LoadFile(file.Name()); err != nil {
+		t.Fatalf("Failed to load configuration file. Details: %v", err)
+	}
+	if config.Storage != StorageBolt || config.BoltPath != "/data/agents.db" {
+		t.Errorf("Storage settings are not loaded: %q, %q", config.Storage, config.BoltPath)
+	}
+	if config.ReportTTL != 5*time.Minute || config.CheckInterval != 20*time.Second || config.PingTimeout != 5*time.Second {
+		t.Errorf("Durations are not as expected: %v, %v, %v", config.ReportTTL, config.CheckInterval, config.PingTimeout)
+	}
+	if config.Staleness.MissThreshold != 3 || config.Staleness.MinStaleness != 30*time.Second ||
+		config.Staleness.GraceMultiplier != DefaultStalenessPolicy().GraceMultiplier {
+		t.Errorf("Staleness policy must be merged with the current one, got %+v", config.Staleness)
+	}
+}
@@ -0,0 +1,355 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/pkg/api/v1"
+
+	ext_v1 "github.com/Mirantis/k8s-netchecker-server/pkg/extensions/apis/v1"
+)
+
+// Flavors of the agents
+const (
+	AgentFlavorPodNetwork = "pod_network"
+	AgentFlavorHostnet    = "hostnet"
+)
+
+// Reason codes of the agent verdicts
+const (
+	ReasonOK          = "ok"           // agent reports in time
+	ReasonAbsent      = "absent"       // agent pod exists but there are no reports from it
+	ReasonOutdated    = "outdated"     // agent stopped reporting
+	ReasonProbeFailed = "probe_failed" // agent reports its probes fail
+	ReasonClockSkew   = "clock_skew"   // clock of the agent's node is skewed
+	ReasonNoAgent     = "no_agent"     // there is no agent of the flavor on the node
+	ReasonExcluded    = "excluded"     // agent fails, but its pod or node is excluded from the check
+	ReasonSilenced    = "silenced"     // agent fails, but its node, zone or itself is silenced
+)
+
+// reasonSeverity orders the reasons so the worst one represents the node
+var reasonSeverity = map[string]int{
+	ReasonNoAgent:     0,
+	ReasonExcluded:    1,
+	ReasonSilenced:    2,
+	ReasonOK:          3,
+	ReasonClockSkew:   4,
+	ReasonProbeFailed: 5,
+	ReasonOutdated:    6,
+	ReasonAbsent:      7,
+}
+
+// reasonMuted tells whether the agent fails, but it's left out of the check.
+func reasonMuted(reason string) bool {
+	return reason == ReasonExcluded || reason == ReasonSilenced
+}
+
+// reasonFailing tells whether the reason fails the connectivity check.
+func reasonFailing(reason string) bool {
+	return reason != ReasonOK && reason != ReasonNoAgent && !reasonMuted(reason)
+}
+
+// AgentVerdict is the result of connectivity check for a single agent.
+type AgentVerdict struct {
+	Name               string         `json:"name"`
+	Flavor             string         `json:"flavor"`
+	Reason             string         `json:"reason"`
+	Exclusion          string         `json:"exclusion,omitempty"` // rule which excluded the agent
+	Silence            string         `json:"silence,omitempty"`   // ID of the silence muting the agent
+	LastSeen           *time.Time     `json:"last_seen,omitempty"`
+	LastSeenAgeSeconds float64        `json:"last_seen_age_seconds,omitempty"`
+	FailedProbes       []ProbeFailure `json:"failed_probes,omitempty"`
+	ClockSkewSeconds   float64        `json:"clock_skew_seconds,omitempty"`
+	ClockSkewed        bool           `json:"clock_skewed,omitempty"`
+	Restarts           int            `json:"restarts,omitempty"`
+	LastRestart        *time.Time     `json:"last_restart,omitempty"`
+}
+
+// NodeVerdict groups the verdicts of the agents running on the same node.
+// PodNetwork and Hostnet hold the worst reason among the agents of
+// the corresponding flavor, Flavors holds it for the custom flavors.
+// Diagnosis tells which of the networks fails.
+type NodeVerdict struct {
+	Node        string            `json:"node"`
+	Healthy     bool              `json:"healthy"`
+	PodNetwork  string            `json:"pod_network"`
+	Hostnet     string            `json:"hostnet"`
+	Flavors     map[string]string `json:"flavors,omitempty"`
+	Diagnosis   string            `json:"diagnosis"`
+	ClockSkewed bool              `json:"clock_skewed,omitempty"`
+	Agents      []AgentVerdict    `json:"agents"`
+	NodeTopology
+}
+
+// ConnectivityCounts summarizes the connectivity check.
+type ConnectivityCounts struct {
+	Nodes        int `json:"nodes"`
+	HealthyNodes int `json:"healthy_nodes"`
+	Agents       int `json:"agents"`
+	OK           int `json:"ok"`
+	Absent       int `json:"absent"`
+	Outdated     int `json:"outdated"`
+	ProbeFailed  int `json:"probe_failed"`
+	ClockSkewed  int `json:"clock_skewed"`
+	Excluded     int `json:"excluded"`
+	Silenced     int `json:"silenced"`
+}
+
+// ConnectivityReport is payload structure for server answer to version 2 of
+// connectivity check request.
+type ConnectivityReport struct {
+	Healthy   bool               `json:"healthy"`
+	Message   string             `json:"message"`
+	CheckedAt time.Time          `json:"checked_at"`
+	Counts    ConnectivityCounts `json:"counts"`
+	Nodes     []NodeVerdict      `json:"nodes"`
+	// nodes grouped by zone, when the zones are known
+	Zones []ZoneVerdict `json:"zones,omitempty"`
+	// HTTP probes of the agents grouped by zone and by rack, when known
+	ZoneProbes []ProbeLatency `json:"zone_probes,omitempty"`
+	RackProbes []ProbeLatency `json:"rack_probes,omitempty"`
+	// connected components of the nodes and the server
+	Partitions []NetworkPartition `json:"partitions"`
+	// nodes cut off from the server which have no peer probe results
+	ServerUnreachable []string `json:"server_unreachable,omitempty"`
+	// silences which are in effect
+	Silences []Silence `json:"silences,omitempty"`
+}
+
+// worseReason returns the more severe one of the reasons.
+func worseReason(a, b string) string {
+	if reasonSeverity[b] > reasonSeverity[a] {
+		return b
+	}
+	return a
+}
+
+// agentFlavor tells which network the agent checks, the flavor of the pod is
+// given by the selector matching it. Pod network agents are assumed when the
+// pod is unknown and its name doesn't tell otherwise.
+func agentFlavor(name string, pod *v1.Pod) string {
+	if pod != nil {
+		return GetOrCreateConfig().Agents.Flavor(pod)
+	}
+	if strings.Contains(name, "hostnet") {
+		return AgentFlavorHostnet
+	}
+	return AgentFlavorPodNetwork
+}
+
+// agentVerdict checks the report of the agent, nil report means the agent
+// has never reported.
+func agentVerdict(name, flavor string, agent *ext_v1.AgentSpec, now time.Time) AgentVerdict {
+	rv := AgentVerdict{Name: name, Flavor: flavor, Reason: ReasonAbsent}
+	if agent == nil {
+		return rv
+	}
+
+	lastSeen := agent.LastUpdated
+	rv.LastSeen = &lastSeen
+	rv.LastSeenAgeSeconds = now.Sub(lastSeen).Seconds()
+	rv.Restarts = agent.Restarts
+	rv.LastRestart = agent.LastRestart
+	rv.ClockSkewSeconds = ClockSkew(agent).Seconds()
+	skewPolicy := &GetOrCreateConfig().ClockSkew
+	rv.ClockSkewed = skewPolicy.Skewed(agent)
+	rv.Reason = ReasonOK
+	if agentOutdated(agent, now) {
+		// probe results of outdated report are not relevant anymore
+		rv.Reason = ReasonOutdated
+		return rv
+	}
+	if rv.FailedProbes = GetOrCreateConfig().Probes.FailedProbes(agent); len(rv.FailedProbes) != 0 {
+		rv.Reason = ReasonProbeFailed
+	} else if rv.ClockSkewed && skewPolicy.FailCheck {
+		rv.Reason = ReasonClockSkew
+	}
+	return rv
+}
+
+// BuildConnectivityReport checks the latest reports of the agents against
+// the agent pods and groups the results by node, and by zone when the
+// nodes are given. Failing agents matching the exclusion rules are marked
+// as excluded, the rest of failing agents muted by active silences are
+// marked as silenced. Without pods (k8s API is not accessible) only the
+// agents which have reported are checked.
+func BuildConnectivityReport(pods *v1.PodList, agents NcAgentCache, clusterNodes *v1.NodeList, silences []Silence, now time.Time) *ConnectivityReport {
+	cfg := GetOrCreateConfig()
+	topology := NodesTopology(clusterNodes, cfg.RackLabel)
+	nodeIndex := nodesByName(clusterNodes)
+	silences = activeSilences(silences, now)
+
+	nodes := map[string]*NodeVerdict{}
+	addVerdict := func(nodeName string, verdict AgentVerdict) {
+		if reasonFailing(verdict.Reason) {
+			if silence := silenceFor(silences, verdict.Name, nodeName, topology[nodeName].Zone, now); silence != nil {
+				verdict.Reason = ReasonSilenced
+				verdict.Silence = silence.ID
+			}
+		}
+
+		node, exists := nodes[nodeName]
+		if !exists {
+			node = &NodeVerdict{
+				Node:         nodeName,
+				PodNetwork:   ReasonNoAgent,
+				Hostnet:      ReasonNoAgent,
+				Agents:       []AgentVerdict{},
+				NodeTopology: topology[nodeName],
+			}
+			nodes[nodeName] = node
+		}
+		node.Agents = append(node.Agents, verdict)
+		node.ClockSkewed = node.ClockSkewed || verdict.ClockSkewed
+
+		switch verdict.Flavor {
+		case AgentFlavorPodNetwork:
+			node.PodNetwork = worseReason(node.PodNetwork, verdict.Reason)
+		case AgentFlavorHostnet:
+			node.Hostnet = worseReason(node.Hostnet, verdict.Reason)
+		default:
+			if node.Flavors == nil {
+				node.Flavors = map[string]string{}
+			}
+			reason, exists := node.Flavors[verdict.Flavor]
+			if !exists {
+				reason = ReasonNoAgent
+			}
+			node.Flavors[verdict.Flavor] = worseReason(reason, verdict.Reason)
+		}
+	}
+
+	if pods != nil {
+		for i := range pods.Items {
+			pod := &pods.Items[i]
+			name := pod.ObjectMeta.Name
+			nodeName := pod.Spec.NodeName
+
+			var report *ext_v1.AgentSpec
+			if agent, exists := agents[name]; exists {
+				report = &agent
+				if nodeName == "" {
+					nodeName = agent.NodeName
+				}
+			}
+			verdict := agentVerdict(name, agentFlavor(name, pod), report, now)
+			if reasonFailing(verdict.Reason) {
+				if rule := cfg.Exclusions.Exclusion(pod, nodeIndex[nodeName]); rule != "" {
+					verdict.Reason = ReasonExcluded
+					verdict.Exclusion = rule
+				}
+			}
+			addVerdict(nodeName, verdict)
+		}
+	} else {
+		for name := range agents {
+			agent := agents[name]
+			addVerdict(agent.NodeName, agentVerdict(name, agentFlavor(name, nil), &agent, now))
+		}
+	}
+
+	rv := &ConnectivityReport{
+		Healthy:   true,
+		CheckedAt: now,
+		Nodes:     make([]NodeVerdict, 0, len(nodes)),
+	}
+	if len(silences) != 0 {
+		rv.Silences = silences
+	}
+	for _, node := range nodes {
+		node.Healthy = true
+		sort.Slice(node.Agents, func(i, j int) bool {
+			return node.Agents[i].Name < node.Agents[j].Name
+		})
+		for _, verdict := range node.Agents {
+			rv.Counts.Agents++
+			switch verdict.Reason {
+			case ReasonOK:
+				rv.Counts.OK++
+			case ReasonAbsent:
+				rv.Counts.Absent++
+			case ReasonOutdated:
+				rv.Counts.Outdated++
+			case ReasonProbeFailed:
+				rv.Counts.ProbeFailed++
+			case ReasonExcluded:
+				rv.Counts.Excluded++
+			case ReasonSilenced:
+				rv.Counts.Silenced++
+			}
+			if verdict.ClockSkewed {
+				rv.Counts.ClockSkewed++
+			}
+			if reasonFailing(verdict.Reason) {
+				node.Healthy = false
+			}
+		}
+
+		node.Diagnosis = diagnoseNode(node)
+		rv.Counts.Nodes++
+		if node.Healthy {
+			rv.Counts.HealthyNodes++
+		} else {
+			rv.Healthy = false
+		}
+		rv.Nodes = append(rv.Nodes, *node)
+	}
+	sort.Slice(rv.Nodes, func(i, j int) bool {
+		return rv.Nodes[i].Node < rv.Nodes[j].Node
+	})
+
+	rv.Zones = aggregateZones(rv.Nodes)
+	rv.ZoneProbes, rv.RackProbes = aggregateProbes(agents, topology, now)
+	rv.Partitions, rv.ServerUnreachable = FindPartitions(rv.Nodes, BuildReachabilityMatrix(agents, now))
+
+	if rv.Healthy {
+		rv.Message = fmt.Sprintf(
+			"All %v agents on %v nodes successfully reported back to the server",
+			rv.Counts.Agents-rv.Counts.Excluded-rv.Counts.Silenced, rv.Counts.Nodes)
+		if rv.Counts.Excluded != 0 {
+			rv.Message += fmt.Sprintf(", %v agents are excluded", rv.Counts.Excluded)
+		}
+		if rv.Counts.Silenced != 0 {
+			rv.Message += fmt.Sprintf(", %v agents are silenced", rv.Counts.Silenced)
+		}
+	} else {
+		rv.Message = fmt.Sprintf(
+			"Connectivity check fails on %v out of %v nodes",
+			rv.Counts.Nodes-rv.Counts.HealthyNodes, rv.Counts.Nodes)
+		down := []string{}
+		for _, zone := range rv.Zones {
+			if zone.State == ZoneDown {
+				down = append(down, zone.Zone)
+			}
+		}
+		if len(down) != 0 {
+			rv.Message += fmt.Sprintf(
+				", zones down: %v", strings.Join(down, ", "))
+		}
+		if len(rv.Partitions) > 1 {
+			rv.Message += fmt.Sprintf(
+				", network is split into %v partitions", len(rv.Partitions))
+		}
+		if len(rv.ServerUnreachable) != 0 {
+			rv.Message += fmt.Sprintf(
+				", %v nodes can't reach the server", len(rv.ServerUnreachable))
+		}
+	}
+	return rv
+}
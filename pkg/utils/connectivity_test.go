@@ -0,0 +1,113 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"testing"
+	"time"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func agentPod(name, node string, hostnet bool) v1.Pod {
+	label := "netchecker-agent"
+	if hostnet {
+		label = "netchecker-agent-hostnet"
+	}
+	return v1.Pod{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{"app": label},
+		},
+		Spec: v1.PodSpec{NodeName: node, HostNetwork: hostnet},
+	}
+}
+
+func TestBuildConnectivityReport(t *testing.T) {
+	now := time.Now()
+	pods := &v1.PodList{Items: []v1.Pod{
+		agentPod("agent-1", "node-1", false),
+		agentPod("agent-hostnet-1", "node-1", true),
+		agentPod("agent-2", "node-2", false),
+		agentPod("agent-hostnet-2", "node-2", true),
+		agentPod("agent-3", "node-3", false),
+	}}
+
+	agents := NcAgentCache{}
+	for _, name := range []string{"agent-1", "agent-hostnet-1", "agent-hostnet-2"} {
+		agent := agentExample()
+		agent.LastUpdated = now.Add(-time.Second)
+		agents[name] = agent
+	}
+	outdated := agentExample()
+	outdated.LastUpdated = now.Add(-time.Minute)
+	agents["agent-3"] = outdated
+
+	report := BuildConnectivityReport(pods, agents, nil, nil, now)
+
+	if report.Healthy {
+		t.Error("Report with absent and outdated agents must not be healthy")
+	}
+	expected := ConnectivityCounts{Nodes: 3, HealthyNodes: 1, Agents: 5, OK: 3, Absent: 1, Outdated: 1}
+	if report.Counts != expected {
+		t.Errorf("Counts %v are not as expected %v", report.Counts, expected)
+	}
+
+	for i, tc := range []struct {
+		node       string
+		healthy    bool
+		podNetwork string
+		hostnet    string
+		diagnosis  string
+	}{
+		{"node-1", true, ReasonOK, ReasonOK, DiagnosisOK},
+		{"node-2", false, ReasonAbsent, ReasonOK, DiagnosisPodNetwork},
+		{"node-3", false, ReasonOutdated, ReasonNoAgent, DiagnosisUnpaired},
+	} {
+		node := report.Nodes[i]
+		if node.Node != tc.node || node.Healthy != tc.healthy ||
+			node.PodNetwork != tc.podNetwork || node.Hostnet != tc.hostnet ||
+			node.Diagnosis != tc.diagnosis {
+			t.Errorf("Verdict %+v is not as expected %+v", node, tc)
+		}
+	}
+
+	absent := report.Nodes[1].Agents[0]
+	if absent.Name != "agent-2" || absent.LastSeen != nil {
+		t.Errorf("Absent agent verdict %+v must have no last seen time", absent)
+	}
+	seen := report.Nodes[2].Agents[0]
+	if seen.LastSeen == nil || seen.LastSeenAgeSeconds != 60 {
+		t.Errorf("Outdated agent verdict %+v must be last seen a minute ago", seen)
+	}
+}
+
+func TestBuildConnectivityReportWithoutPods(t *testing.T) {
+	now := time.Now()
+	agent := agentExample()
+	agent.LastUpdated = now
+	agents := NcAgentCache{"netchecker-agent-hostnet-x": agent}
+
+	report := BuildConnectivityReport(nil, agents, nil, nil, now)
+
+	if !report.Healthy || len(report.Nodes) != 1 {
+		t.Fatalf("Report %+v must contain single healthy node", report)
+	}
+	node := report.Nodes[0]
+	if node.Node != agent.NodeName || node.Hostnet != ReasonOK || node.PodNetwork != ReasonNoAgent {
+		t.Errorf("Node verdict %+v is not as expected", node)
+	}
+}
@@ -48,9 +48,18 @@ type ProbeResult struct {
 // CheckConnectivityInfo is payload structure for server answer to connectivity
 // check request.
 type CheckConnectivityInfo struct {
-	Message  string   `json="message"`
-	Absent   []string `json="outdated,omitempty"`
-	Outdated []string `json="absent,omitempty"`
+	Message  string   `json:"message"`
+	Absent   []string `json:"absent,omitempty"`
+	Outdated []string `json:"outdated,omitempty"`
+	// failed probes of the agents which report in time
+	FailedProbes map[string][]ProbeFailure `json:"failed_probes,omitempty"`
+	// agents which clock is skewed relative to the server one
+	ClockSkewed []string `json:"clock_skewed,omitempty"`
+	// failing agents which are muted by active silences
+	Silenced []string `json:"silenced,omitempty"`
+	// failing agents excluded from the check, mapped to the rule which
+	// excluded them
+	Excluded map[string]string `json:"excluded,omitempty"`
 }
 
 // AgentMetrics contains Prometheus entities and agent data required for
@@ -58,7 +67,9 @@ type CheckConnectivityInfo struct {
 type AgentMetrics struct {
 	ErrorCount            prometheus.Counter
 	ReportCount           prometheus.Counter
+	RestartCount          prometheus.Counter
 	PodName               string
+	Flavor                string // flavor of the agent pod, empty until the pod is known
 	ErrorsFromLastReport  int
 	ProbeConnectionResult *prometheus.GaugeVec
 	ProbeHTTPCode         *prometheus.GaugeVec
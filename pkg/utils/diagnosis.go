@@ -0,0 +1,96 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Diagnoses of the nodes made by pairing the pod network and hostnet agents
+// running on them
+const (
+	DiagnosisOK          = "ok"           // both networks are fine
+	DiagnosisPodNetwork  = "pod_network"  // only pod network fails, CNI is to blame
+	DiagnosisHostNetwork = "host_network" // only host network fails
+	DiagnosisNode        = "node"         // both networks fail, the node itself is to blame
+	DiagnosisUnpaired    = "unpaired"     // agent of one flavor fails and there is no checked agent of the other one
+)
+
+var nodeNetworkState = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "ncagent",
+		Name:      "node_network_state",
+		Help:      "State of the network layer of the node: 0 - failing, 1 - ok.",
+	},
+	[]string{"node", "layer"},
+)
+
+var nodeNetworkSeries *gaugeSeries
+
+func init() {
+	nodeNetworkState, _ = tryRegisterGaugeVec(nodeNetworkState)
+	nodeNetworkSeries = newGaugeSeries(nodeNetworkState)
+}
+
+// reasonChecked tells whether there is an agent which network is checked.
+func reasonChecked(reason string) bool {
+	return reason != ReasonNoAgent && !reasonMuted(reason)
+}
+
+// diagnoseNode tells which network of the node is to blame from the
+// verdicts of its pod network and hostnet agents.
+func diagnoseNode(node *NodeVerdict) string {
+	podFails, hostFails := reasonFailing(node.PodNetwork), reasonFailing(node.Hostnet)
+	switch {
+	case !podFails && !hostFails:
+		return DiagnosisOK
+	case !reasonChecked(node.PodNetwork) || !reasonChecked(node.Hostnet):
+		return DiagnosisUnpaired
+	case podFails && hostFails:
+		return DiagnosisNode
+	case podFails:
+		return DiagnosisPodNetwork
+	default:
+		return DiagnosisHostNetwork
+	}
+}
+
+// UpdateNodeNetworkMetrics exports the state of the networks of the nodes
+// checked by the agents of each flavor, including the custom ones. Layers
+// which have no checked agent on the node are not exported.
+func UpdateNodeNetworkMetrics(report *ConnectivityReport) {
+	states := gaugeValues{}
+	for i := range report.Nodes {
+		node := &report.Nodes[i]
+		layers := map[string]string{
+			AgentFlavorPodNetwork: node.PodNetwork,
+			AgentFlavorHostnet:    node.Hostnet,
+		}
+		for flavor, reason := range node.Flavors {
+			layers[flavor] = reason
+		}
+		for layer, reason := range layers {
+			if !reasonChecked(reason) {
+				continue
+			}
+			state := 1.0
+			if reasonFailing(reason) {
+				state = 0
+			}
+			states.add(state, node.Node, layer)
+		}
+	}
+	nodeNetworkSeries.Set(states)
+}
@@ -0,0 +1,80 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestDiagnoseNode(t *testing.T) {
+	for _, tc := range []struct {
+		podNetwork string
+		hostnet    string
+		diagnosis  string
+	}{
+		{ReasonOK, ReasonOK, DiagnosisOK},
+		{ReasonOK, ReasonNoAgent, DiagnosisOK},
+		{ReasonOutdated, ReasonOK, DiagnosisPodNetwork},
+		{ReasonOK, ReasonProbeFailed, DiagnosisHostNetwork},
+		{ReasonAbsent, ReasonOutdated, DiagnosisNode},
+		{ReasonNoAgent, ReasonOutdated, DiagnosisUnpaired},
+	} {
+		node := &NodeVerdict{PodNetwork: tc.podNetwork, Hostnet: tc.hostnet}
+		if diagnosis := diagnoseNode(node); diagnosis != tc.diagnosis {
+			t.Errorf("Diagnosis %q for pod network %q and hostnet %q is not as expected %q",
+				diagnosis, tc.podNetwork, tc.hostnet, tc.diagnosis)
+		}
+	}
+}
+
+// collectGauges returns values of the series exported by the gauge vector.
+func collectGauges(vec *prometheus.GaugeVec) map[string]float64 {
+	ch := make(chan prometheus.Metric, 100)
+	vec.Collect(ch)
+	close(ch)
+	rv := map[string]float64{}
+	for metric := range ch {
+		m := &dto.Metric{}
+		metric.Write(m)
+		key := ""
+		for _, label := range m.GetLabel() {
+			key += "/" + label.GetValue()
+		}
+		rv[key] = m.GetGauge().GetValue()
+	}
+	return rv
+}
+
+func TestUpdateNodeNetworkMetrics(t *testing.T) {
+	report := &ConnectivityReport{Nodes: []NodeVerdict{
+		{Node: "node-1", PodNetwork: ReasonOK, Hostnet: ReasonOutdated},
+		{Node: "node-2", PodNetwork: ReasonOK, Hostnet: ReasonNoAgent},
+	}}
+	UpdateNodeNetworkMetrics(report)
+	states := collectGauges(nodeNetworkState)
+	if len(states) != 3 || states["/pod_network/node-1"] != 1 || states["/hostnet/node-1"] != 0 {
+		t.Errorf("Node network states are not as expected: %v", states)
+	}
+
+	// series of the nodes which are gone are dropped
+	report.Nodes = report.Nodes[1:]
+	UpdateNodeNetworkMetrics(report)
+	if states = collectGauges(nodeNetworkState); len(states) != 1 || states["/pod_network/node-2"] != 1 {
+		t.Errorf("Only node-2 state must be left, got %v", states)
+	}
+}
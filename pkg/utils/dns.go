@@ -0,0 +1,219 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// Reasons of DNS answer inconsistency
+const (
+	DNSAnswerEmpty    = "empty"    // agent couldn't resolve the name
+	DNSAnswerMismatch = "mismatch" // agent got addresses other than the majority
+)
+
+// DNSAgentAnswer is the answer of an agent which differs from the majority.
+type DNSAgentAnswer struct {
+	Agent     string   `json:"agent"`
+	Node      string   `json:"node"`
+	Reason    string   `json:"reason"`
+	Addresses []string `json:"addresses"`
+}
+
+// DNSNameVerdict compares the answers the agents got for the same name.
+type DNSNameVerdict struct {
+	Name         string           `json:"name"`
+	Consistent   bool             `json:"consistent"`
+	Agents       int              `json:"agents"`
+	Majority     []string         `json:"majority"`
+	Inconsistent []DNSAgentAnswer `json:"inconsistent,omitempty"`
+}
+
+// DNSCheckInfo is payload structure for server answer to DNS check request.
+type DNSCheckInfo struct {
+	Consistent bool             `json:"consistent"`
+	CheckedAt  time.Time        `json:"checked_at"`
+	Names      []DNSNameVerdict `json:"names"`
+}
+
+var (
+	dnsInconsistentAgents = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "ncagent",
+			Name:      "dns_inconsistent_agents",
+			Help:      "Number of agents which got empty or minority answer for the name.",
+		},
+		[]string{"name"},
+	)
+	dnsAnswerConsistent = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "ncagent",
+			Name:      "dns_answer_consistent",
+			Help:      "Answer of the agent for the name: 0 - empty or minority, 1 - majority.",
+		},
+		[]string{"agent", "name"},
+	)
+	dnsInconsistentSeries, dnsAnswerSeries *gaugeSeries
+)
+
+func init() {
+	dnsInconsistentAgents, _ = tryRegisterGaugeVec(dnsInconsistentAgents)
+	dnsAnswerConsistent, _ = tryRegisterGaugeVec(dnsAnswerConsistent)
+	dnsInconsistentSeries = newGaugeSeries(dnsInconsistentAgents)
+	dnsAnswerSeries = newGaugeSeries(dnsAnswerConsistent)
+}
+
+// dnsAnswerKey normalizes addresses so the answers can be compared.
+func dnsAnswerKey(addresses []string) ([]string, string) {
+	seen := map[string]bool{}
+	rv := []string{}
+	for _, addr := range addresses {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			rv = append(rv, addr)
+		}
+	}
+	sort.Strings(rv)
+	return rv, strings.Join(rv, ",")
+}
+
+// CheckDNS compares the addresses the agents resolved for every name against
+// the answer of the majority of them. Outdated reports are not considered.
+func CheckDNS(agents NcAgentCache, now time.Time) *DNSCheckInfo {
+	type answer struct {
+		agent     string
+		node      string
+		addresses []string
+		key       string
+	}
+	answers := map[string][]answer{}
+
+	for agentName := range agents {
+		agent := agents[agentName]
+		if agentOutdated(&agent, now) {
+			continue
+		}
+		for name, addresses := range agent.LookupHost {
+			normalized, key := dnsAnswerKey(addresses)
+			answers[name] = append(answers[name], answer{agentName, agent.NodeName, normalized, key})
+		}
+	}
+
+	rv := &DNSCheckInfo{
+		Consistent: true,
+		CheckedAt:  now,
+		Names:      []DNSNameVerdict{},
+	}
+	for name, nameAnswers := range answers {
+		// ties are broken in favour of the lesser answer to keep the
+		// verdict stable
+		votes := map[string]int{}
+		majority := ""
+		for _, a := range nameAnswers {
+			if a.key == "" {
+				continue
+			}
+			votes[a.key]++
+			if majority == "" || votes[a.key] > votes[majority] ||
+				(votes[a.key] == votes[majority] && a.key < majority) {
+				majority = a.key
+			}
+		}
+
+		verdict := DNSNameVerdict{
+			Name:       name,
+			Consistent: true,
+			Agents:     len(nameAnswers),
+			Majority:   []string{},
+		}
+		if majority != "" {
+			verdict.Majority = strings.Split(majority, ",")
+		}
+		for _, a := range nameAnswers {
+			reason := ""
+			switch {
+			case a.key == "":
+				reason = DNSAnswerEmpty
+			case a.key != majority:
+				reason = DNSAnswerMismatch
+			default:
+				continue
+			}
+			verdict.Inconsistent = append(verdict.Inconsistent, DNSAgentAnswer{
+				Agent:     a.agent,
+				Node:      a.node,
+				Reason:    reason,
+				Addresses: a.addresses,
+			})
+		}
+		sort.Slice(verdict.Inconsistent, func(i, j int) bool {
+			return verdict.Inconsistent[i].Agent < verdict.Inconsistent[j].Agent
+		})
+
+		if len(verdict.Inconsistent) != 0 {
+			verdict.Consistent = false
+			rv.Consistent = false
+		}
+		rv.Names = append(rv.Names, verdict)
+	}
+	sort.Slice(rv.Names, func(i, j int) bool {
+		return rv.Names[i].Name < rv.Names[j].Name
+	})
+
+	return rv
+}
+
+// UpdateDNSMetrics exports results of the DNS check, metrics of the names
+// and agents which are gone are dropped. Agents are labelled by the flavors
+// of their pods when the pods are given.
+func UpdateDNSMetrics(agents NcAgentCache, pods *v1.PodList, info *DNSCheckInfo) {
+	podsByName := map[string]*v1.Pod{}
+	if pods != nil {
+		for i := range pods.Items {
+			podsByName[pods.Items[i].ObjectMeta.Name] = &pods.Items[i]
+		}
+	}
+
+	inconsistentAgents, answerConsistent := gaugeValues{}, gaugeValues{}
+	for _, verdict := range info.Names {
+		inconsistentAgents.add(float64(len(verdict.Inconsistent)), verdict.Name)
+
+		inconsistent := map[string]bool{}
+		for _, a := range verdict.Inconsistent {
+			inconsistent[a.Agent] = true
+		}
+		for agentName, agent := range agents {
+			if _, resolved := agent.LookupHost[verdict.Name]; !resolved || agentOutdated(&agent, info.CheckedAt) {
+				continue
+			}
+			consistent := 1.0
+			if inconsistent[agentName] {
+				consistent = 0
+			}
+			flavor := ""
+			if pod := podsByName[agentName]; pod != nil {
+				flavor = agentFlavor(agentName, pod)
+			}
+			answerConsistent.add(consistent, agentMetricsName(&agent, flavor), verdict.Name)
+		}
+	}
+	dnsInconsistentSeries.Set(inconsistentAgents)
+	dnsAnswerSeries.Set(answerConsistent)
+}
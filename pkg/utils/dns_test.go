@@ -0,0 +1,103 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func dnsAgents(now time.Time, answers map[string][]string) NcAgentCache {
+	rv := NcAgentCache{}
+	for name, addresses := range answers {
+		agent := agentExample()
+		agent.PodName = name
+		agent.NodeName = name + "-node"
+		agent.LastUpdated = now
+		agent.LookupHost = map[string][]string{"kubernetes.default": addresses}
+		rv[name] = agent
+	}
+	return rv
+}
+
+func TestCheckDNS(t *testing.T) {
+	now := time.Now()
+	agents := dnsAgents(now, map[string][]string{
+		"agent-1": {"10.0.0.1", "10.0.0.2"},
+		"agent-2": {"10.0.0.2", "10.0.0.1", "10.0.0.1"},
+		"agent-3": {"10.0.0.1", "10.0.0.2"},
+		"agent-4": {"10.0.0.9"},
+		"agent-5": {},
+	})
+	outdated := agents["agent-4"]
+	outdated.PodName = "agent-6"
+	outdated.LastUpdated = now.Add(-time.Hour)
+	agents["agent-6"] = outdated
+
+	info := CheckDNS(agents, now)
+
+	if info.Consistent || len(info.Names) != 1 {
+		t.Fatalf("DNS check result %+v must have single inconsistent name", info)
+	}
+	verdict := info.Names[0]
+	if verdict.Agents != 5 {
+		t.Errorf("Outdated agent must not be considered, got %v agents", verdict.Agents)
+	}
+	if !reflect.DeepEqual(verdict.Majority, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Errorf("Majority answer %v is not as expected", verdict.Majority)
+	}
+	expected := []DNSAgentAnswer{
+		{Agent: "agent-4", Node: "agent-4-node", Reason: DNSAnswerMismatch, Addresses: []string{"10.0.0.9"}},
+		{Agent: "agent-5", Node: "agent-5-node", Reason: DNSAnswerEmpty, Addresses: []string{}},
+	}
+	if !reflect.DeepEqual(verdict.Inconsistent, expected) {
+		t.Errorf("Inconsistent answers %+v are not as expected %+v", verdict.Inconsistent, expected)
+	}
+}
+
+func TestDNSCheckHandler(t *testing.T) {
+	handler := newHandler()
+	for name, agent := range dnsAgents(time.Now(), map[string][]string{
+		"agent-1": {"10.0.0.1"},
+		"agent-2": {"10.0.0.1"},
+	}) {
+		handler.Agents.AgentCacheUpdate(name, &agent)
+	}
+
+	router := httprouter.New()
+	router.GET("/api/v1/dns_check", handler.DNSCheck)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/api/v1/dns_check")
+	if err != nil {
+		t.Fatalf("Failed to GET DNS check from server. Details: %v", err)
+	}
+	checkRespStatus(http.StatusOK, res.StatusCode, t)
+
+	info := &DNSCheckInfo{}
+	if err := json.NewDecoder(res.Body).Decode(info); err != nil {
+		t.Fatalf("Failed to decode DNS check response body. Details: %v", err)
+	}
+	if !info.Consistent || len(info.Names) != 1 || info.Names[0].Agents != 2 {
+		t.Errorf("Unexpected DNS check result %+v", info)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// Rules excluding failing agents from the connectivity check
+const (
+	ExcludePodTerminating    = "pod_terminating"    // agent pod is being deleted
+	ExcludePodPending        = "pod_pending"        // agent pod hasn't started yet
+	ExcludePodNotReady       = "pod_not_ready"      // agent pod is not ready
+	ExcludeNodeNotReady      = "node_not_ready"     // node of the agent is not ready
+	ExcludeNodeUnschedulable = "node_unschedulable" // node of the agent is cordoned or being drained
+)
+
+// exclusionRules lists all the rules in the order they are applied in
+var exclusionRules = []string{
+	ExcludePodTerminating,
+	ExcludePodPending,
+	ExcludePodNotReady,
+	ExcludeNodeNotReady,
+	ExcludeNodeUnschedulable,
+}
+
+// ExclusionPolicy is the list of enabled exclusion rules.
+type ExclusionPolicy []string
+
+// DefaultExclusionPolicy excludes agents of terminating and pending pods and
+// those running on the nodes which are not ready or are unschedulable.
+func DefaultExclusionPolicy() ExclusionPolicy {
+	return ExclusionPolicy{
+		ExcludePodTerminating,
+		ExcludePodPending,
+		ExcludeNodeNotReady,
+		ExcludeNodeUnschedulable,
+	}
+}
+
+// Validate checks that all the rules are known.
+func (p ExclusionPolicy) Validate() error {
+	for _, rule := range p {
+		known := false
+		for _, existing := range exclusionRules {
+			known = known || rule == existing
+		}
+		if !known {
+			return fmt.Errorf("unknown exclusion rule %q", rule)
+		}
+	}
+	return nil
+}
+
+func (p ExclusionPolicy) enabled(rule string) bool {
+	for _, item := range p {
+		if item == rule {
+			return true
+		}
+	}
+	return false
+}
+
+func podReady(pod *v1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1.PodReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func nodeReady(node *v1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v1.NodeReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// Exclusion returns the first enabled rule excluding the agent pod, empty
+// string when there is none. Node rules are skipped when the node is unknown.
+func (p ExclusionPolicy) Exclusion(pod *v1.Pod, node *v1.Node) string {
+	for _, rule := range exclusionRules {
+		if !p.enabled(rule) {
+			continue
+		}
+		var excluded bool
+		switch rule {
+		case ExcludePodTerminating:
+			excluded = pod.ObjectMeta.DeletionTimestamp != nil
+		case ExcludePodPending:
+			excluded = pod.Status.Phase == v1.PodPending
+		case ExcludePodNotReady:
+			excluded = !podReady(pod)
+		case ExcludeNodeNotReady:
+			excluded = node != nil && !nodeReady(node)
+		case ExcludeNodeUnschedulable:
+			excluded = node != nil && node.Spec.Unschedulable
+		}
+		if excluded {
+			return rule
+		}
+	}
+	return ""
+}
+
+// nodesByName indexes the nodes by name, nil list gives empty index.
+func nodesByName(nodes *v1.NodeList) map[string]*v1.Node {
+	rv := map[string]*v1.Node{}
+	if nodes != nil {
+		for i := range nodes.Items {
+			rv[nodes.Items[i].ObjectMeta.Name] = &nodes.Items[i]
+		}
+	}
+	return rv
+}
+
+// agentNodes lists the nodes for the exclusion rules and topology. Failure
+// to get them is not fatal for the checks, so it is only logged and node
+// rules don't apply then.
+func agentNodes(kubeClient Proxy) *v1.NodeList {
+	if kubeClient == nil {
+		return nil
+	}
+	nodes, err := kubeClient.Nodes()
+	if err != nil {
+		glog.Errorf("Failed to get nodes from k8s cluster. Details: %v", err)
+		return nil
+	}
+	return nodes
+}
@@ -0,0 +1,106 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"testing"
+	"time"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func exclusionNode(name string, ready, unschedulable bool) v1.Node {
+	status := v1.ConditionTrue
+	if !ready {
+		status = v1.ConditionFalse
+	}
+	return v1.Node{
+		ObjectMeta: meta_v1.ObjectMeta{Name: name},
+		Spec:       v1.NodeSpec{Unschedulable: unschedulable},
+		Status: v1.NodeStatus{Conditions: []v1.NodeCondition{
+			{Type: v1.NodeReady, Status: status},
+		}},
+	}
+}
+
+func TestExclusion(t *testing.T) {
+	ready := exclusionNode("ready", true, false)
+	notReady := exclusionNode("not-ready", false, false)
+	cordoned := exclusionNode("cordoned", true, true)
+	deleted := meta_v1.Now()
+
+	for _, tc := range []struct {
+		policy ExclusionPolicy
+		pod    v1.Pod
+		node   *v1.Node
+		rule   string
+	}{
+		{DefaultExclusionPolicy(), v1.Pod{}, &ready, ""},
+		{DefaultExclusionPolicy(), v1.Pod{}, nil, ""},
+		{DefaultExclusionPolicy(), v1.Pod{}, &notReady, ExcludeNodeNotReady},
+		{DefaultExclusionPolicy(), v1.Pod{}, &cordoned, ExcludeNodeUnschedulable},
+		{DefaultExclusionPolicy(), v1.Pod{Status: v1.PodStatus{Phase: v1.PodPending}}, &ready, ExcludePodPending},
+		{DefaultExclusionPolicy(), v1.Pod{ObjectMeta: meta_v1.ObjectMeta{DeletionTimestamp: &deleted}}, &notReady,
+			ExcludePodTerminating},
+		{ExclusionPolicy{ExcludePodNotReady}, v1.Pod{}, &cordoned, ExcludePodNotReady},
+		{ExclusionPolicy{}, v1.Pod{}, &notReady, ""},
+	} {
+		if rule := tc.policy.Exclusion(&tc.pod, tc.node); rule != tc.rule {
+			t.Errorf("Exclusion rule %q is not as expected %q for %+v", rule, tc.rule, tc)
+		}
+	}
+
+	if err := (ExclusionPolicy{"node_on_fire"}).Validate(); err == nil {
+		t.Error("Unknown exclusion rule must be rejected")
+	}
+}
+
+func TestConnectivityReportExclusions(t *testing.T) {
+	now := time.Now()
+	pods := &v1.PodList{Items: []v1.Pod{
+		agentPod("agent-1", "node-1", false),
+		agentPod("agent-hostnet-1", "node-1", true),
+		agentPod("agent-2", "node-2", false),
+		agentPod("agent-hostnet-2", "node-2", true),
+	}}
+	agent := agentExample()
+	agent.LastUpdated = now
+	agents := NcAgentCache{"agent-1": agent, "agent-hostnet-1": agent}
+	nodes := &v1.NodeList{Items: []v1.Node{
+		exclusionNode("node-1", true, true),
+		exclusionNode("node-2", false, false),
+	}}
+
+	report := BuildConnectivityReport(pods, agents, nodes, nil, now)
+
+	if !report.Healthy {
+		t.Errorf("Agents on not ready node must not fail the check: %+v", report)
+	}
+	if report.Counts.Excluded != 2 || report.Counts.OK != 2 {
+		t.Errorf("Counts %+v are not as expected", report.Counts)
+	}
+	// healthy agents on cordoned node are still checked
+	if node := report.Nodes[0]; node.PodNetwork != ReasonOK || node.Hostnet != ReasonOK {
+		t.Errorf("Agents on cordoned node must be ok: %+v", node)
+	}
+	excluded := report.Nodes[1]
+	if excluded.PodNetwork != ReasonExcluded || excluded.Agents[0].Exclusion != ExcludeNodeNotReady {
+		t.Errorf("Agents on not ready node must be excluded: %+v", excluded)
+	}
+	if len(report.Partitions) != 1 {
+		t.Errorf("Excluded node must not be a partition: %+v", report.Partitions)
+	}
+}
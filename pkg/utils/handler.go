@@ -16,28 +16,45 @@ package utils
 
 import (
 	"fmt"
+	"io"
 	"net/http"
+	"sort"
 	"time"
 
 	"github.com/golang/glog"
 	"github.com/julienschmidt/httprouter"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/urfave/negroni"
+	"k8s.io/client-go/pkg/api/v1"
 )
 
-func NewHandler(useKubeClient bool) (*Handler, error) {
+func NewHandler(storage string) (*Handler, error) {
 	h := &Handler{
 		Metrics: NcAgentMetrics{},
+		started: time.Now(),
+		stop:    make(chan struct{}),
 	}
 
 	var err error
 
-	if useKubeClient {
+	switch storage {
+	case StorageK8s:
 		// use k8s TPR as a persistent storage for agents data
 		h.Agents, err = NewK8sStorer()
-	} else {
+	case StorageEtcd:
 		// use etcd as a persistent storage for agents data
 		h.Agents, err = NewEtcdStorer()
+	case StorageEtcdV3:
+		// use etcd v3 API (leases instead of TTL of directories)
+		h.Agents, err = NewEtcdV3Storer()
+	case StorageBolt:
+		// use embedded BoltDB file as a persistent storage for agents data
+		h.Agents, err = NewBoltStorer()
+	case StorageMemory:
+		// keep agents data in memory, nothing survives a restart
+		h.Agents, err = NewMemoryStorer()
+	default:
+		err = fmt.Errorf("Unknown storage type '%s'", storage)
 	}
 
 	if err == nil {
@@ -45,17 +62,60 @@ func NewHandler(useKubeClient bool) (*Handler, error) {
 		h.AddMiddleware()
 	}
 
+	if config := GetOrCreateConfig().Notifier; len(config.Webhooks) != 0 && err == nil {
+		h.Notifier = NewNotifier(config)
+		go h.Notifier.Run(h.stop)
+	}
+	if config := GetOrCreateConfig().Alertmanager; len(config.URLs) != 0 {
+		h.Alerter = NewAlerter(config)
+	}
+	if config := GetOrCreateConfig().Events; config.Enabled && err == nil {
+		if client, clientErr := kubeClientset(h.Agents.GetKubeClient()); clientErr == nil {
+			h.Events = NewEventRecorder(config, client)
+		} else {
+			glog.Warningf("K8s events are not recorded: %v", clientErr)
+		}
+	}
+	if config := GetOrCreateConfig().Conditions; config.Enabled && err == nil {
+		if client, clientErr := kubeClientset(h.Agents.GetKubeClient()); clientErr == nil {
+			h.Conditions = NewConditionPublisher(config, client)
+		} else {
+			glog.Warningf("Node conditions are not published: %v", clientErr)
+		}
+	}
+
 	return h, err
 }
 
+// Close stops the notifier and releases the storage when it holds any
+// resources.
+func (h *Handler) Close() error {
+	if h.stop != nil {
+		close(h.stop)
+	}
+	if closer, ok := h.Agents.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
 func (h *Handler) SetupRouter() {
 	glog.V(10).Info("Setting up the url multiplexer")
 
 	router := httprouter.New()
 	router.POST("/api/v1/agents/:name", h.UpdateAgents)
 	router.GET("/api/v1/agents/:name", h.CleanCache(h.Agents.GetSingleAgent))
+	router.GET("/api/v1/agents/:name/history", h.CleanCache(h.GetAgentHistory))
 	router.GET("/api/v1/agents/", h.CleanCache(h.Agents.GetAgents))
 	router.GET("/api/v1/connectivity_check", h.CleanCache(h.ConnectivityCheck))
+	router.GET("/api/v2/connectivity_check", h.CleanCache(h.ConnectivityCheckV2))
+	router.GET("/api/v1/dns_check", h.CleanCache(h.DNSCheck))
+	router.GET("/api/v1/ip_check", h.CleanCache(h.IPCheck))
+	router.GET("/api/v1/peers", h.CleanCache(h.GetPeers))
+	router.GET("/api/v1/matrix", h.CleanCache(h.ReachabilityMatrix))
+	router.POST("/api/v1/silences", h.CreateSilence)
+	router.GET("/api/v1/silences", h.GetSilences)
+	router.DELETE("/api/v1/silences/:id", h.DeleteSilence)
 	router.GET("/api/v1/ping", func(_ http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
 	})
 	router.Handler("GET", "/metrics", promhttp.Handler())
@@ -78,9 +138,45 @@ func (h *Handler) UpdateAgents(rw http.ResponseWriter, r *http.Request, rp httpr
 		glog.Error(err)
 	}
 
-	h.Metrics[agentName] = NewAgentMetrics(&agentData)
+	h.metricsLock.Lock()
+	defer h.metricsLock.Unlock()
+
+	// flavor of the agent is resolved from its pod by the metrics loop, until
+	// then it's guessed from the name of the agent
+	h.Metrics[agentName] = NewAgentMetrics(&agentData, h.Metrics[agentName].Flavor)
 	UpdateAgentBaseMetrics(h.Metrics, agentName, true, false)
 	UpdateAgentProbeMetrics(agentData, h.Metrics[agentName])
+	UpdateClockSkewMetric(&agentData)
+	if restartDetected(&agentData) {
+		h.Metrics[agentName].RestartCount.Inc()
+	}
+}
+
+func (h *Handler) GetAgentHistory(rw http.ResponseWriter, r *http.Request, rp httprouter.Params) {
+	agentName := rp.ByName("name")
+
+	query, err := ParseHistoryQuery(r.URL.Query())
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reports, err := h.Agents.AgentHistory(agentName)
+	if err != nil {
+		message := fmt.Sprintf(
+			"Error occurred while getting history of the agent. Details: %v", err)
+		glog.Error(message)
+		http.Error(rw, message, http.StatusInternalServerError)
+		return
+	}
+
+	if len(reports) == 0 {
+		glog.V(5).Infof("Agent with name %v has no reports in the storage", agentName)
+		http.Error(rw, "There are no reports of such agent in the storage", http.StatusNotFound)
+		return
+	}
+
+	ProcessResponse(rw, query.Filter(reports))
 }
 
 func (h *Handler) ConnectivityCheck(rw http.ResponseWriter, r *http.Request, _ httprouter.Params) {
@@ -92,7 +188,7 @@ func (h *Handler) ConnectivityCheck(rw http.ResponseWriter, r *http.Request, _ h
 	status := http.StatusOK
 	errMsg := "Connectivity check fails. Reason: %v"
 
-	absent, outdated, err := h.Agents.CheckAgents()
+	absent, outdated, excluded, err := h.Agents.CheckAgents()
 	if err != nil {
 		message := fmt.Sprintf(
 			"Error occurred while checking the agents. Details: %v", err)
@@ -101,6 +197,30 @@ func (h *Handler) ConnectivityCheck(rw http.ResponseWriter, r *http.Request, _ h
 		return
 	}
 
+	// the check goes on without silences when they can't be looked up
+	silenced, err := h.silencedAgents(time.Now())
+	if err != nil {
+		glog.Errorf("Error occurred while getting silenced agents. Details: %v", err)
+		silenced = map[string]string{}
+	}
+	muted := map[string]bool{}
+	unmute := func(names []string) []string {
+		rv := []string{}
+		for _, name := range names {
+			if _, exists := silenced[name]; exists {
+				muted[name] = true
+			} else {
+				rv = append(rv, name)
+			}
+		}
+		return rv
+	}
+	absent, outdated = unmute(absent), unmute(outdated)
+	if len(excluded) != 0 {
+		glog.V(5).Infof("Failures of excluded agents are ignored: %v", excluded)
+		res.Excluded = excluded
+	}
+
 	if len(absent) != 0 || len(outdated) != 0 {
 		glog.V(5).Infof(
 			"Absent|outdated agents detected. Absent -> %v; outdated -> %v",
@@ -108,12 +228,193 @@ func (h *Handler) ConnectivityCheck(rw http.ResponseWriter, r *http.Request, _ h
 		)
 		res.Message = fmt.Sprintf(errMsg,
 			"there are absent or outdated pods; look up the payload")
+		if partitions, err := h.networkPartitions(time.Now()); err != nil {
+			glog.Errorf("Failed to find network partitions. Details: %v", err)
+		} else if len(partitions) > 1 {
+			res.Message += fmt.Sprintf(
+				"; network is split into %v partitions", len(partitions))
+		}
 		res.Absent = absent
 		res.Outdated = outdated
 
 		status = http.StatusBadRequest
 	}
 
+	failedProbes, skewed, err := h.checkReports(outdated)
+	if err != nil {
+		message := fmt.Sprintf(
+			"Error occurred while checking reports of the agents. Details: %v", err)
+		glog.Error(message)
+		http.Error(rw, message, http.StatusInternalServerError)
+		return
+	}
+	for name := range failedProbes {
+		if _, exists := silenced[name]; exists {
+			muted[name] = true
+			delete(failedProbes, name)
+		}
+	}
+	skewed = unmute(skewed)
+	for name := range muted {
+		res.Silenced = append(res.Silenced, name)
+	}
+	sort.Strings(res.Silenced)
+	if len(res.Silenced) != 0 {
+		glog.V(5).Infof("Failures of silenced agents are ignored: %v", res.Silenced)
+	}
+
+	if len(failedProbes) != 0 {
+		glog.V(5).Infof("Agents with failed probes detected: %v", failedProbes)
+		if status == http.StatusOK {
+			res.Message = fmt.Sprintf(errMsg,
+				"there are pods with failed probes; look up the payload")
+		}
+		res.FailedProbes = failedProbes
+
+		status = http.StatusBadRequest
+	}
+	if len(skewed) != 0 {
+		glog.V(5).Infof("Agents with skewed clock detected: %v", skewed)
+		res.ClockSkewed = skewed
+
+		if GetOrCreateConfig().ClockSkew.FailCheck {
+			if status == http.StatusOK {
+				res.Message = fmt.Sprintf(errMsg,
+					"there are pods with skewed clock; look up the payload")
+			}
+			status = http.StatusBadRequest
+		}
+	}
+
+	glog.V(10).Infof("Connectivity check result: %v", res)
+	glog.V(10).Infof("Connectivity check HTTP response status code: %v", status)
+
+	rw.WriteHeader(status)
+
+	ProcessResponse(rw, res)
+}
+
+// checkReports finds the agents which report failed probes and the ones
+// with skewed clock, outdated agents are skipped.
+func (h *Handler) checkReports(outdated []string) (map[string][]ProbeFailure, []string, error) {
+	cfg := GetOrCreateConfig()
+	if !cfg.Probes.Enabled && cfg.ClockSkew.MaxSkew <= 0 {
+		return nil, nil, nil
+	}
+
+	agents, err := h.Agents.LatestReports()
+	if err != nil {
+		return nil, nil, err
+	}
+	skip := map[string]bool{}
+	for _, name := range outdated {
+		skip[name] = true
+	}
+
+	failedProbes := map[string][]ProbeFailure{}
+	skewed := []string{}
+	for name := range agents {
+		if skip[name] {
+			continue
+		}
+		agent := agents[name]
+		if failures := cfg.Probes.FailedProbes(&agent); len(failures) != 0 {
+			failedProbes[name] = failures
+		}
+		if cfg.ClockSkew.Skewed(&agent) {
+			skewed = append(skewed, name)
+		}
+	}
+	sort.Strings(skewed)
+	return failedProbes, skewed, nil
+}
+
+// silences returns the stored silences, none are returned when they can't be
+// read, so that failure of the storage doesn't fail the checks.
+func (h *Handler) silences() []Silence {
+	silences, err := h.Agents.Silences()
+	if err != nil {
+		glog.Errorf("Error occurred while getting silences. Details: %v", err)
+		return nil
+	}
+	return silences
+}
+
+// silencedAgents maps the agents muted by active silences to the IDs of
+// the silences.
+func (h *Handler) silencedAgents(now time.Time) (map[string]string, error) {
+	silences := h.silences()
+	if len(activeSilences(silences, now)) == 0 {
+		return map[string]string{}, nil
+	}
+
+	agents, err := h.Agents.LatestReports()
+	if err != nil {
+		return nil, err
+	}
+	pods, err := h.agentPods()
+	if err != nil {
+		return nil, err
+	}
+	return silencedAgents(silences, agents, pods, agentNodes(h.Agents.GetKubeClient()), now), nil
+}
+
+// networkPartitions finds the partitions the cluster network is split into,
+// see FindPartitions.
+func (h *Handler) networkPartitions(now time.Time) ([]NetworkPartition, error) {
+	pods, err := h.agentPods()
+	if err != nil {
+		return nil, err
+	}
+	agents, err := h.Agents.LatestReports()
+	if err != nil {
+		return nil, err
+	}
+	report := BuildConnectivityReport(pods, agents, agentNodes(h.Agents.GetKubeClient()), h.silences(), now)
+	return report.Partitions, nil
+}
+
+// agentPods lists the agent pods, nil list is returned when k8s API is not
+// accessible.
+func (h *Handler) agentPods() (*v1.PodList, error) {
+	kubeClient := h.Agents.GetKubeClient()
+	if kubeClient == nil {
+		return nil, nil
+	}
+	return kubeClient.Pods()
+}
+
+// ConnectivityCheckV2 responds with the connectivity check results grouped
+// by node.
+func (h *Handler) ConnectivityCheckV2(rw http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	pods, err := h.agentPods()
+	if err != nil {
+		message := fmt.Sprintf(
+			"Failed to get pods from k8s cluster. Details: %v", err)
+		glog.Error(message)
+		http.Error(rw, message, http.StatusInternalServerError)
+		return
+	}
+
+	agents, err := h.Agents.LatestReports()
+	if err != nil {
+		message := fmt.Sprintf(
+			"Error occurred while getting reports of the agents. Details: %v", err)
+		glog.Error(message)
+		http.Error(rw, message, http.StatusInternalServerError)
+		return
+	}
+
+	res := BuildConnectivityReport(pods, agents, agentNodes(h.Agents.GetKubeClient()), h.silences(), time.Now())
+	UpdatePartitionMetrics(res)
+	UpdateNodeNetworkMetrics(res)
+	UpdateTopologyMetrics(res)
+	status := http.StatusOK
+	if !res.Healthy {
+		glog.V(5).Infof("Connectivity check fails: %v", res.Counts)
+		status = http.StatusBadRequest
+	}
+
 	glog.V(10).Infof("Connectivity check result: %v", res)
 	glog.V(10).Infof("Connectivity check HTTP response status code: %v", status)
 
@@ -122,6 +423,191 @@ func (h *Handler) ConnectivityCheck(rw http.ResponseWriter, r *http.Request, _ h
 	ProcessResponse(rw, res)
 }
 
+// DNSCheck responds with the comparison of names resolution by the agents.
+func (h *Handler) DNSCheck(rw http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	agents, err := h.Agents.LatestReports()
+	if err != nil {
+		message := fmt.Sprintf(
+			"Error occurred while getting reports of the agents. Details: %v", err)
+		glog.Error(message)
+		http.Error(rw, message, http.StatusInternalServerError)
+		return
+	}
+
+	res := CheckDNS(agents, time.Now())
+	status := http.StatusOK
+	if !res.Consistent {
+		glog.V(5).Infof("Inconsistent DNS answers detected: %v", res.Names)
+		status = http.StatusBadRequest
+	}
+
+	glog.V(10).Infof("DNS check result: %v", res)
+
+	rw.WriteHeader(status)
+
+	ProcessResponse(rw, res)
+}
+
+// IPCheck responds with the inspection of addresses reported by the agents.
+func (h *Handler) IPCheck(rw http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	pods, err := h.agentPods()
+	if err != nil {
+		message := fmt.Sprintf(
+			"Failed to get pods from k8s cluster. Details: %v", err)
+		glog.Error(message)
+		http.Error(rw, message, http.StatusInternalServerError)
+		return
+	}
+
+	agents, err := h.Agents.LatestReports()
+	if err != nil {
+		message := fmt.Sprintf(
+			"Error occurred while getting reports of the agents. Details: %v", err)
+		glog.Error(message)
+		http.Error(rw, message, http.StatusInternalServerError)
+		return
+	}
+
+	res, err := CheckIPs(agents, pods, time.Now())
+	if err != nil {
+		message := fmt.Sprintf(
+			"Error occurred while checking addresses of the agents. Details: %v", err)
+		glog.Error(message)
+		http.Error(rw, message, http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	if !res.Healthy {
+		glog.V(5).Infof("Address issues detected: %v", res)
+		status = http.StatusBadRequest
+	}
+
+	glog.V(10).Infof("IP check result: %v", res)
+
+	rw.WriteHeader(status)
+
+	ProcessResponse(rw, res)
+}
+
+// GetPeers responds with the agents other agents should probe, the agent
+// given by 'agent' parameter is excluded.
+func (h *Handler) GetPeers(rw http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	pods, err := h.agentPods()
+	if err != nil {
+		message := fmt.Sprintf(
+			"Failed to get pods from k8s cluster. Details: %v", err)
+		glog.Error(message)
+		http.Error(rw, message, http.StatusInternalServerError)
+		return
+	}
+
+	agents, err := h.Agents.LatestReports()
+	if err != nil {
+		message := fmt.Sprintf(
+			"Error occurred while getting reports of the agents. Details: %v", err)
+		glog.Error(message)
+		http.Error(rw, message, http.StatusInternalServerError)
+		return
+	}
+
+	ProcessResponse(rw, ListPeers(agents, pods, r.URL.Query().Get("agent"), time.Now()))
+}
+
+// ReachabilityMatrix responds with node to node reachability computed from
+// the peer probes of the agents.
+func (h *Handler) ReachabilityMatrix(rw http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	agents, err := h.Agents.LatestReports()
+	if err != nil {
+		message := fmt.Sprintf(
+			"Error occurred while getting reports of the agents. Details: %v", err)
+		glog.Error(message)
+		http.Error(rw, message, http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	res := BuildReachabilityMatrix(agents, now)
+	nodes := agentNodes(h.Agents.GetKubeClient())
+	if topology := NodesTopology(nodes, GetOrCreateConfig().RackLabel); len(topology) != 0 {
+		res.Zones = BuildZoneReachability(agents, topology, now)
+	}
+	status := http.StatusOK
+	if !res.Healthy {
+		glog.V(5).Infof("Unreachable nodes detected: %v", res.Failures)
+		status = http.StatusBadRequest
+	}
+
+	glog.V(10).Infof("Reachability matrix: %v", res)
+
+	rw.WriteHeader(status)
+
+	ProcessResponse(rw, res)
+}
+
+// CreateSilence stores the silence given in the request body and responds
+// with it, ID and start time are filled in when they are not given.
+func (h *Handler) CreateSilence(rw http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	silence := &Silence{}
+	if err := ProcessRequest(r, silence, rw); err != nil {
+		return
+	}
+
+	if err := silence.Prepare(time.Now()); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.Agents.SaveSilence(silence); err != nil {
+		message := fmt.Sprintf(
+			"Error occurred while saving the silence. Details: %v", err)
+		glog.Error(message)
+		http.Error(rw, message, http.StatusInternalServerError)
+		return
+	}
+	glog.Infof("Silence %v created: %v", silence.ID, silence)
+
+	rw.WriteHeader(http.StatusCreated)
+
+	ProcessResponse(rw, silence)
+}
+
+// GetSilences responds with the silences which haven't ended yet.
+func (h *Handler) GetSilences(rw http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	silences, err := h.Agents.Silences()
+	if err != nil {
+		message := fmt.Sprintf(
+			"Error occurred while getting silences. Details: %v", err)
+		glog.Error(message)
+		http.Error(rw, message, http.StatusInternalServerError)
+		return
+	}
+
+	ProcessResponse(rw, silences)
+}
+
+// DeleteSilence removes the silence given by 'id' parameter.
+func (h *Handler) DeleteSilence(rw http.ResponseWriter, r *http.Request, rp httprouter.Params) {
+	id := rp.ByName("id")
+
+	err := h.Agents.DeleteSilence(id)
+	if err == ErrSilenceNotFound {
+		glog.V(5).Infof("Silence %v is not found", id)
+		http.Error(rw, "There is no such silence", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		message := fmt.Sprintf(
+			"Error occurred while removing the silence. Details: %v", err)
+		glog.Error(message)
+		http.Error(rw, message, http.StatusInternalServerError)
+		return
+	}
+	glog.Infof("Silence %v removed", id)
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
 func (h *Handler) CleanCache(handle httprouter.Handle) httprouter.Handle {
 	return func(rw http.ResponseWriter, r *http.Request, rp httprouter.Params) {
 		h.Agents.CleanCacheOnDemand(rw)
@@ -130,34 +616,166 @@ func (h *Handler) CleanCache(handle httprouter.Handle) httprouter.Handle {
 	}
 }
 
-func (h *Handler) CollectAgentsMetrics(checkInterval time.Duration, useKubeClient bool) {
+// updateClusterMetrics exports the metrics which need the agent pods and
+// returns the connectivity report they are computed from, nil when the pods
+// can't be listed.
+func (h *Handler) updateClusterMetrics(agentsData NcAgentCache, silences []Silence, now time.Time) *ConnectivityReport {
+	pods, err := h.agentPods()
+	if err != nil {
+		glog.Errorf("Metrics update: failed to get pods from k8s cluster: %v", err)
+		return nil
+	}
+
+	report := BuildConnectivityReport(pods, agentsData, agentNodes(h.Agents.GetKubeClient()), silences, now)
+	UpdatePartitionMetrics(report)
+	UpdateNodeNetworkMetrics(report)
+	UpdateTopologyMetrics(report)
+
+	info, err := CheckIPs(agentsData, pods, now)
+	if err != nil {
+		glog.Errorf("Metrics update: error checking addresses of the agents: %v", err)
+		return report
+	}
+	UpdateIPMetrics(info)
+	return report
+}
+
+// warmUpReportInterval is the report interval assumed during the warm-up
+// when none of the agents has reported yet.
+const warmUpReportInterval = time.Minute
+
+// warmedUp tells whether every agent has had at least one report interval
+// since the server started to send its report. Until then the agents which
+// haven't reached the server yet would be taken for absent or outdated, so
+// the changes of their states are not published.
+func (h *Handler) warmedUp(agents NcAgentCache, now time.Time) bool {
+	interval := time.Duration(0)
+	for _, agent := range agents {
+		if agentInterval := time.Duration(agent.ReportInterval) * time.Second; agentInterval > interval {
+			interval = agentInterval
+		}
+	}
+	if interval == 0 {
+		interval = warmUpReportInterval
+	}
+	return now.Sub(h.started) >= interval
+}
+
+// resolveFlavors sets the flavors of the agents which metrics don't have one
+// yet from their pods. Flavor of an agent doesn't change, so it's resolved
+// once.
+func (h *Handler) resolveFlavors(pods *v1.PodList) {
+	if pods == nil {
+		return
+	}
+	h.metricsLock.Lock()
+	defer h.metricsLock.Unlock()
+
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		metrics, exists := h.Metrics[pod.Name]
+		if exists && metrics.Flavor == "" {
+			metrics.Flavor = agentFlavor(pod.Name, pod)
+			h.Metrics[pod.Name] = metrics
+		}
+	}
+}
+
+func (h *Handler) CollectAgentsMetrics(checkInterval time.Duration, storage string) {
+	policy := &GetOrCreateConfig().Staleness
 	for {
 		time.Sleep(checkInterval)
-		if useKubeClient {
-			agentsData := h.Agents.AgentCache()
-			for name := range agentsData {
-				if _, exists := h.Metrics[name]; exists {
-					deltaInIntervals := time.Now().Sub(agentsData[name].LastUpdated).Seconds() /
-							float64(agentsData[name].ReportInterval)
-					if int(deltaInIntervals) > (h.Metrics[name].ErrorsFromLastReport + 1) {
-						UpdateAgentBaseMetrics(h.Metrics, name, false, true)
-					}
-				}
-			}
+		now := time.Now()
+		agentsData := h.Agents.AgentCache()
+		dnsInfo := CheckDNS(agentsData, now)
+		pods, err := h.agentPods()
+		if err != nil {
+			glog.Errorf("Metrics update: failed to get pods from k8s cluster: %v", err)
+		}
+		UpdateDNSMetrics(agentsData, pods, dnsInfo)
+		h.resolveFlavors(pods)
+
+		// errors of the silenced agents are not counted
+		silences := h.silences()
+
+		// the report is built from the reports kept by the storage, the
+		// cache of this replica misses the agents reporting to the others
+		var report *ConnectivityReport
+		reports, err := h.Agents.LatestReports()
+		if err != nil {
+			glog.Errorf("Metrics update: failed to get reports of the agents: %v", err)
 		} else {
-			absent, _, err := h.Agents.CheckAgents()
+			report = h.updateClusterMetrics(reports, silences, now)
+		}
+		warmedUp := h.warmedUp(reports, now)
+		if h.Notifier != nil && report != nil && warmedUp {
+			h.Notifier.Notify(report)
+		}
+		if h.Alerter != nil && report != nil && warmedUp {
+			if err := h.Alerter.Push(BuildAlerts(report, dnsInfo, now), now); err != nil {
+				glog.Errorf("Metrics update: %v", err)
+			}
+		}
+		if h.Events != nil && report != nil && warmedUp {
+			h.Events.Record(report, pods)
+		}
+		if updater, ok := h.Agents.(agentStatusUpdater); ok {
+			if err := updater.UpdateStatuses(now); err != nil {
+				glog.Errorf("Metrics update: %v", err)
+			}
+		}
+		// conditions of the nodes are published from the stored reports too,
+		// so the replicas don't flip them for the agents they don't see
+		if h.Conditions != nil && report != nil && warmedUp {
+			if err := h.Conditions.Publish(report, agentNodes(h.Agents.GetKubeClient()), now); err != nil {
+				glog.Errorf("Metrics update: %v", err)
+			}
+		}
+		silenced := map[string]string{}
+		if len(activeSilences(silences, now)) != 0 {
+			pods, err := h.agentPods()
 			if err != nil {
-				message := fmt.Sprintf(
-					"Metrics update: error checking the agents: %v", err)
-				glog.Error(message)
+				glog.Errorf("Metrics update: failed to get pods from k8s cluster: %v", err)
+			}
+			silenced = silencedAgents(silences, agentsData, pods, agentNodes(h.Agents.GetKubeClient()), now)
+		}
+
+		h.metricsLock.Lock()
+		for name := range agentsData {
+			if _, silent := silenced[name]; silent {
+				continue
+			}
+			if _, exists := h.Metrics[name]; exists {
+				agent := agentsData[name]
+				if policy.Errors(&agent, now) > h.Metrics[name].ErrorsFromLastReport {
+					UpdateAgentBaseMetrics(h.Metrics, name, false, true)
+				}
+			}
+		}
+		h.metricsLock.Unlock()
+		if storage != StorageEtcd && storage != StorageEtcdV3 {
+			continue
+		}
+
+		// Reports of the agents are purged from etcd after TTL, count
+		// an error for those which have disappeared without being flagged
+		absent, _, _, err := h.Agents.CheckAgents()
+		if err != nil {
+			message := fmt.Sprintf(
+				"Metrics update: error checking the agents: %v", err)
+			glog.Error(message)
+		}
+		h.metricsLock.Lock()
+		for _, name := range absent {
+			if _, silent := silenced[name]; silent {
+				continue
 			}
-			for _, name := range absent {
-				if _, exists := h.Metrics[name]; exists {
-					if h.Metrics[name].ErrorsFromLastReport == 0 {
-						UpdateAgentBaseMetrics(h.Metrics, name, false, true)
-					}
+			if _, exists := h.Metrics[name]; exists {
+				if h.Metrics[name].ErrorsFromLastReport == 0 {
+					UpdateAgentBaseMetrics(h.Metrics, name, false, true)
 				}
 			}
 		}
+		h.metricsLock.Unlock()
 	}
 }
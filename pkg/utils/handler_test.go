@@ -40,7 +40,7 @@ func newHandler() *Handler {
 	h := Handler{
 		Metrics: NcAgentMetrics{}, //map[string]AgentMetrics{},
 	}
-	h.Agents, _ = NewK8sStorer()
+	h.Agents, _ = NewMemoryStorer()
 
 	return &h
 }
@@ -92,7 +92,6 @@ func marshalExpectedWithActualDate(expected, actual ext_v1.AgentSpec, t *testing
 }
 
 func TestUpdateAgents(t *testing.T) {
-	t.Skip("Skip agent update")
 	expectedAgent := agentExample()
 	marshalled, err := json.Marshal(expectedAgent)
 	if err != nil {
@@ -190,7 +189,6 @@ func TestUpdateAgentsFailReadBody(t *testing.T) {
 }
 
 func TestGetAgents(t *testing.T) {
-	t.Skip("Skip get agents")
 	handler := newHandler()
 	age := agentExample()
 	handler.Agents.AgentCacheUpdate("test", &age)
@@ -216,7 +214,6 @@ func TestGetAgents(t *testing.T) {
 }
 
 func TestGetSingleAgent(t *testing.T) {
-	t.Skip("Skip get single agent")
 	handler := newHandler()
 	age := agentExample()
 	handler.Agents.AgentCacheUpdate("test", &age)
@@ -244,7 +241,6 @@ func TestGetSingleAgent(t *testing.T) {
 }
 
 func TestGetSingleAgentCleanCache(t *testing.T) {
-	t.Skip("Skip get single agent cache")
 	handler := newHandler()
 	age := agentExample()
 	handler.Agents.AgentCacheUpdate("test", &age)
@@ -274,14 +270,14 @@ func CSwithPods() kubernetes.Interface {
 		&v1.Pod{
 			ObjectMeta: meta_v1.ObjectMeta{
 				Name:      "agent-pod",
-				Labels:    map[string]string{"app": AgentLabelValues[0]},
+				Labels:    map[string]string{"app": "netchecker-agent"},
 				Namespace: v1.NamespaceDefault,
 			},
 		},
 		&v1.Pod{
 			ObjectMeta: meta_v1.ObjectMeta{
 				Name:      "agent-pod-hostnet",
-				Labels:    map[string]string{"app": AgentLabelValues[0]},
+				Labels:    map[string]string{"app": "netchecker-agent"},
 				Namespace: v1.NamespaceDefault,
 			},
 		},
@@ -333,7 +329,6 @@ func decodeCnntyRespOrFail(resp *http.Response, t *testing.T) *CheckConnectivity
 }
 
 func TestConnectivityCheckSuccess(t *testing.T) {
-	t.Skip("Skip get single agent cache")
 	handler := newHandler()
 	handler.Agents.SetKubeClient(&KubeProxy{Client: CSwithPods()})
 
@@ -360,7 +355,6 @@ func TestConnectivityCheckSuccess(t *testing.T) {
 }
 
 func TestMetricsGetSuccess(t *testing.T) {
-	t.Skip("Skip get single agent cache")
 	handler := newHandler()
 	handler.Agents.SetKubeClient(&KubeProxy{Client: CSwithPods()})
 
@@ -375,7 +369,6 @@ func TestMetricsGetSuccess(t *testing.T) {
 }
 
 func TestConnectivityCheckFail(t *testing.T) {
-	t.Skip("Skip get single agent cache")
 	handler := newHandler()
 	handler.Agents.SetKubeClient(&KubeProxy{Client: CSwithPods()})
 
@@ -409,6 +402,195 @@ func TestConnectivityCheckFail(t *testing.T) {
 	}
 }
 
+func TestConnectivityCheckExcluded(t *testing.T) {
+	handler := newHandler()
+	handler.Agents.SetKubeClient(&KubeProxy{Client: fake.NewSimpleClientset(
+		&v1.Pod{
+			ObjectMeta: meta_v1.ObjectMeta{
+				Name:      "agent-pod",
+				Labels:    map[string]string{"app": "netchecker-agent"},
+				Namespace: v1.NamespaceDefault,
+			},
+			Status: v1.PodStatus{Phase: v1.PodPending},
+		},
+	)})
+
+	ts := createCnntyCheckTestServer(handler)
+	defer ts.Close()
+
+	actual := decodeCnntyRespOrFail(cnntyRespOrFail(ts.URL, http.StatusOK, t), t)
+	if len(actual.Absent) != 0 || actual.Excluded["agent-pod"] != ExcludePodPending {
+		t.Errorf("agent-pod must be returned in the payload in the 'excluded' map: %+v", actual)
+	}
+}
+
+func TestConnectivityCheckV2(t *testing.T) {
+	handler := newHandler()
+	handler.Agents.SetKubeClient(&KubeProxy{Client: CSwithPods()})
+
+	agent := agentExample()
+	agent.LastUpdated = time.Now()
+	agent.PodName = "agent-pod"
+	handler.Agents.AgentCacheUpdate(agent.PodName, &agent)
+
+	router := httprouter.New()
+	router.GET("/api/v2/connectivity_check", handler.ConnectivityCheckV2)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/api/v2/connectivity_check")
+	if err != nil {
+		t.Fatalf("Failed to GET connectivity check from server. Details: %v", err)
+	}
+	checkRespStatus(http.StatusBadRequest, res.StatusCode, t)
+
+	actual := &ConnectivityReport{}
+	if err := json.NewDecoder(res.Body).Decode(actual); err != nil {
+		t.Fatalf("Failed to decode connectivity check response body. Details: %v", err)
+	}
+	if actual.Counts.OK != 1 || actual.Counts.Absent != 1 {
+		t.Errorf("Unexpected counts in the payload: %+v", actual.Counts)
+	}
+}
+
+// silencesFailStorage is the memory storage silences of which can't be read.
+type silencesFailStorage struct {
+	*MemoryAgentStorage
+}
+
+func (s *silencesFailStorage) Silences() ([]Silence, error) {
+	return nil, errors.New("test error")
+}
+
+func TestConnectivityCheckSilencesError(t *testing.T) {
+	handler := newHandler()
+	handler.Agents = &silencesFailStorage{handler.Agents.(*MemoryAgentStorage)}
+	handler.Agents.SetKubeClient(&KubeProxy{Client: CSwithPods()})
+
+	agent := agentExample()
+	agent.LastUpdated = time.Now()
+	for _, name := range []string{"agent-pod", "agent-pod-hostnet"} {
+		agent.PodName = name
+		handler.Agents.AgentCacheUpdate(agent.PodName, &agent)
+	}
+
+	router := httprouter.New()
+	router.GET("/api/v1/connectivity_check", handler.ConnectivityCheck)
+	router.GET("/api/v2/connectivity_check", handler.ConnectivityCheckV2)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	// the checks go on as if there were no silences
+	for _, version := range []string{"v1", "v2"} {
+		res, err := http.Get(ts.URL + "/api/" + version + "/connectivity_check")
+		if err != nil {
+			t.Fatalf("Failed to GET connectivity check from server. Details: %v", err)
+		}
+		checkRespStatus(http.StatusOK, res.StatusCode, t)
+	}
+}
+
+func TestNewHandlerNotifier(t *testing.T) {
+	cfg := GetOrCreateConfig()
+	defer func(config NotifierConfig) { cfg.Notifier = config }(cfg.Notifier)
+	cfg.Notifier = NotifierConfig{Webhooks: []string{"http://localhost:0"}}
+
+	h, err := NewHandler("unknown")
+	if err == nil || h.Notifier != nil {
+		t.Errorf("Notifier must not be started without storage, error: %v", err)
+	}
+
+	h, err = NewHandler(StorageMemory)
+	if err != nil || h.Notifier == nil {
+		t.Fatalf("Notifier must be started, error: %v", err)
+	}
+	if err := h.Close(); err != nil {
+		t.Errorf("Failed to close the handler. Details: %v", err)
+	}
+}
+
+func TestWarmedUp(t *testing.T) {
+	now := time.Now()
+	handler := newHandler()
+	handler.started = now.Add(-30 * time.Second)
+
+	agent := agentExample()
+	agent.ReportInterval = 20
+	agents := NcAgentCache{"fast": agent}
+	if !handler.warmedUp(agents, now) {
+		t.Errorf("Server must be warmed up after the report interval")
+	}
+	agent.ReportInterval = 60
+	agents["slow"] = agent
+	if handler.warmedUp(agents, now) {
+		t.Errorf("Server must wait for the longest report interval")
+	}
+	if handler.warmedUp(NcAgentCache{}, now) {
+		t.Errorf("Server must wait for %v when no agents have reported", warmUpReportInterval)
+	}
+}
+
+func TestResolveFlavors(t *testing.T) {
+	handler := newHandler()
+	handler.Metrics["agent-hostnet-1"] = AgentMetrics{}
+	handler.Metrics["no-pod"] = AgentMetrics{}
+
+	handler.resolveFlavors(&v1.PodList{Items: []v1.Pod{agentPod("agent-hostnet-1", "node-1", true)}})
+	if flavor := handler.Metrics["agent-hostnet-1"].Flavor; flavor != AgentFlavorHostnet {
+		t.Errorf("Flavor must be resolved from the pod, got %q", flavor)
+	}
+	if flavor := handler.Metrics["no-pod"].Flavor; flavor != "" {
+		t.Errorf("Flavor of the agent without a pod must be left unresolved, got %q", flavor)
+	}
+}
+
+func TestGetAgentHistory(t *testing.T) {
+	cfg := GetOrCreateConfig()
+	defer func(size int) { cfg.HistorySize = size }(cfg.HistorySize)
+	cfg.HistorySize = 10
+
+	handler := newHandler()
+	agent := agentExample()
+	start := time.Now().Add(-time.Minute)
+	for i := 0; i < 3; i++ {
+		agent.Uptime = uint64(i)
+		agent.LastUpdated = start.Add(time.Duration(i) * time.Second)
+		handler.Agents.AgentCacheUpdate("test", &agent)
+	}
+
+	router := httprouter.New()
+	router.GET("/api/v1/agents/:name/history", handler.GetAgentHistory)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	resp, err := http.Get(fmt.Sprintf("%s/api/v1/agents/test/history?from=%d&limit=2",
+		ts.URL, start.Unix()))
+	if err != nil {
+		t.Fatalf("Failed to GET agent history from server. Details: %v", err)
+	}
+	checkRespStatus(http.StatusOK, resp.StatusCode, t)
+
+	history := []ext_v1.AgentSpec{}
+	if err = json.NewDecoder(resp.Body).Decode(&history); err != nil {
+		t.Fatalf("Failed to decode agent history. Details: %v", err)
+	}
+	if len(history) != 2 || history[0].Uptime != 1 || history[1].Uptime != 2 {
+		t.Errorf("Two latest reports in chronological order are expected, got %v", history)
+	}
+
+	resp, err = http.Get(ts.URL + "/api/v1/agents/test/history?to=yesterday")
+	if err != nil {
+		t.Fatalf("Failed to GET agent history from server. Details: %v", err)
+	}
+	checkRespStatus(http.StatusBadRequest, resp.StatusCode, t)
+
+	resp, err = http.Get(ts.URL + "/api/v1/agents/unknown/history")
+	if err != nil {
+		t.Fatalf("Failed to GET agent history from server. Details: %v", err)
+	}
+	checkRespStatus(http.StatusNotFound, resp.StatusCode, t)
+}
+
 type FakeProxy struct {
 }
 
@@ -416,6 +598,10 @@ func (fp *FakeProxy) Pods() (*v1.PodList, error) {
 	return nil, errors.New("test error")
 }
 
+func (fp *FakeProxy) Nodes() (*v1.NodeList, error) {
+	return nil, errors.New("test error")
+}
+
 func TestConnectivityCheckFailDueError(t *testing.T) {
 	handler := newHandler()
 	handler.Agents.SetKubeClient(&FakeProxy{})
@@ -0,0 +1,92 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	ext_v1 "github.com/Mirantis/k8s-netchecker-server/pkg/extensions/apis/v1"
+)
+
+// HistoryQuery holds the parameters of agent history request.
+type HistoryQuery struct {
+	From  time.Time // zero value means no lower bound
+	To    time.Time // zero value means no upper bound
+	Limit int       // zero value means no limit
+}
+
+// parseHistoryTime accepts either RFC3339 timestamp or unix time in seconds.
+func parseHistoryTime(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// ParseHistoryQuery builds HistoryQuery from 'from', 'to' and 'limit'
+// parameters of the request.
+func ParseHistoryQuery(values url.Values) (*HistoryQuery, error) {
+	var err error
+	q := &HistoryQuery{}
+
+	if v := values.Get("from"); v != "" {
+		if q.From, err = parseHistoryTime(v); err != nil {
+			return nil, fmt.Errorf("Invalid 'from' parameter '%s': %v", v, err)
+		}
+	}
+	if v := values.Get("to"); v != "" {
+		if q.To, err = parseHistoryTime(v); err != nil {
+			return nil, fmt.Errorf("Invalid 'to' parameter '%s': %v", v, err)
+		}
+	}
+	if v := values.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 0 {
+			return nil, fmt.Errorf("Invalid 'limit' parameter '%s'", v)
+		}
+	}
+	return q, nil
+}
+
+// sortReports orders agent reports chronologically by the time of receipt.
+func sortReports(reports []ext_v1.AgentSpec) {
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].LastUpdated.Before(reports[j].LastUpdated)
+	})
+}
+
+// Filter returns chronologically ordered reports received within the query
+// time range. When the limit is set, only the most recent reports are kept.
+func (q *HistoryQuery) Filter(reports []ext_v1.AgentSpec) []ext_v1.AgentSpec {
+	rv := []ext_v1.AgentSpec{}
+	for _, report := range reports {
+		if !q.From.IsZero() && report.LastUpdated.Before(q.From) {
+			continue
+		}
+		if !q.To.IsZero() && report.LastUpdated.After(q.To) {
+			continue
+		}
+		rv = append(rv, report)
+	}
+	sortReports(rv)
+
+	if q.Limit > 0 && len(rv) > q.Limit {
+		rv = rv[len(rv)-q.Limit:]
+	}
+	return rv
+}
@@ -0,0 +1,239 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/client-go/pkg/api/v1"
+
+	ext_v1 "github.com/Mirantis/k8s-netchecker-server/pkg/extensions/apis/v1"
+)
+
+// IPDuplicate is pod network address reported by several agents.
+type IPDuplicate struct {
+	IP     string   `json:"ip"`
+	Agents []string `json:"agents"`
+}
+
+// IPChange is the change of addresses of hostnet agent detected by its
+// latest report.
+type IPChange struct {
+	Agent     string    `json:"agent"`
+	Node      string    `json:"node"`
+	Previous  []string  `json:"previous"`
+	Current   []string  `json:"current"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// IPOutsidePodCIDR is pod network agent which has no address in pod CIDRs.
+type IPOutsidePodCIDR struct {
+	Agent     string   `json:"agent"`
+	Node      string   `json:"node"`
+	Addresses []string `json:"addresses"`
+}
+
+// IPCheckInfo is payload structure for server answer to IP check request.
+type IPCheckInfo struct {
+	Healthy        bool               `json:"healthy"`
+	CheckedAt      time.Time          `json:"checked_at"`
+	Duplicates     []IPDuplicate      `json:"duplicates"`
+	Changes        []IPChange         `json:"changes"`
+	OutsidePodCIDR []IPOutsidePodCIDR `json:"outside_pod_cidr"`
+}
+
+var (
+	ipDuplicates = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ncagent",
+		Name:      "duplicate_ips",
+		Help:      "Number of pod network addresses reported by more than one agent.",
+	})
+	ipHostnetChanges = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ncagent",
+		Name:      "hostnet_ip_changes",
+		Help:      "Number of hostnet agents which addresses have changed with their latest report.",
+	})
+	ipOutsidePodCIDR = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ncagent",
+		Name:      "pod_cidr_mismatches",
+		Help:      "Number of pod network agents which have no address in pod CIDRs.",
+	})
+)
+
+func init() {
+	ipDuplicates, _ = tryRegisterGauge(ipDuplicates)
+	ipHostnetChanges, _ = tryRegisterGauge(ipHostnetChanges)
+	ipOutsidePodCIDR, _ = tryRegisterGauge(ipOutsidePodCIDR)
+}
+
+// ParseCIDRs parses pod CIDRs given in the configuration.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	rv := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pod CIDR '%s': %v", cidr, err)
+		}
+		rv = append(rv, network)
+	}
+	return rv, nil
+}
+
+// agentAddresses returns sorted addresses of all the interfaces of the agent
+// except loopback and link-local ones, which are not unique.
+func agentAddresses(agent *ext_v1.AgentSpec) []string {
+	seen := map[string]bool{}
+	rv := []string{}
+	for _, addresses := range agent.IPs {
+		for _, addr := range addresses {
+			// interfaces may be reported with the prefix length
+			ip := net.ParseIP(strings.SplitN(addr, "/", 2)[0])
+			if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+				continue
+			}
+			if s := ip.String(); !seen[s] {
+				seen[s] = true
+				rv = append(rv, s)
+			}
+		}
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// trackIPChange carries the previous addresses of the agent over from its
+// previous report and records a change when the addresses differ from the
+// ones of that report. The change is timestamped with the receipt time of
+// the report it was detected by.
+func trackIPChange(prev, cur *ext_v1.AgentSpec) {
+	if prev == nil {
+		return
+	}
+
+	cur.PreviousIPs = prev.PreviousIPs
+	cur.LastIPChange = prev.LastIPChange
+	previous, current := agentAddresses(prev), agentAddresses(cur)
+	if strings.Join(previous, ",") == strings.Join(current, ",") {
+		return
+	}
+
+	cur.PreviousIPs = previous
+	changeTime := cur.LastUpdated
+	cur.LastIPChange = &changeTime
+	glog.Infof("Agent '%s' addresses change detected: %v -> %v", cur.PodName, previous, current)
+}
+
+// ipChangeDetected tells whether the change of addresses was detected by the
+// report, so every change is reported once.
+func ipChangeDetected(agent *ext_v1.AgentSpec) bool {
+	return agent.LastIPChange != nil && agent.LastIPChange.Equal(agent.LastUpdated)
+}
+
+// CheckIPs inspects the addresses reported by the agents which report in
+// time: pod network addresses must be unique and belong to pod CIDRs (if
+// configured), addresses of hostnet agents must not change.
+func CheckIPs(agents NcAgentCache, pods *v1.PodList, now time.Time) (*IPCheckInfo, error) {
+	podCIDRs, err := ParseCIDRs(GetOrCreateConfig().PodCIDRs)
+	if err != nil {
+		return nil, err
+	}
+
+	podsByName := map[string]*v1.Pod{}
+	if pods != nil {
+		for i := range pods.Items {
+			podsByName[pods.Items[i].ObjectMeta.Name] = &pods.Items[i]
+		}
+	}
+
+	rv := &IPCheckInfo{
+		Healthy:        true,
+		CheckedAt:      now,
+		Duplicates:     []IPDuplicate{},
+		Changes:        []IPChange{},
+		OutsidePodCIDR: []IPOutsidePodCIDR{},
+	}
+	owners := map[string][]string{}
+
+	for name := range agents {
+		agent := agents[name]
+		if agentOutdated(&agent, now) {
+			continue
+		}
+		addresses := agentAddresses(&agent)
+
+		if agentFlavor(name, podsByName[name]) == AgentFlavorHostnet {
+			if ipChangeDetected(&agent) {
+				rv.Changes = append(rv.Changes, IPChange{
+					Agent:     name,
+					Node:      agent.NodeName,
+					Previous:  agent.PreviousIPs,
+					Current:   addresses,
+					ChangedAt: *agent.LastIPChange,
+				})
+			}
+			continue
+		}
+
+		for _, addr := range addresses {
+			owners[addr] = append(owners[addr], name)
+		}
+		if len(podCIDRs) == 0 {
+			continue
+		}
+		inPodCIDR := false
+		for _, addr := range addresses {
+			for _, network := range podCIDRs {
+				inPodCIDR = inPodCIDR || network.Contains(net.ParseIP(addr))
+			}
+		}
+		if !inPodCIDR {
+			rv.OutsidePodCIDR = append(rv.OutsidePodCIDR, IPOutsidePodCIDR{
+				Agent:     name,
+				Node:      agent.NodeName,
+				Addresses: addresses,
+			})
+		}
+	}
+
+	for addr, names := range owners {
+		if len(names) > 1 {
+			sort.Strings(names)
+			rv.Duplicates = append(rv.Duplicates, IPDuplicate{IP: addr, Agents: names})
+		}
+	}
+
+	sort.Slice(rv.Duplicates, func(i, j int) bool { return rv.Duplicates[i].IP < rv.Duplicates[j].IP })
+	sort.Slice(rv.Changes, func(i, j int) bool { return rv.Changes[i].Agent < rv.Changes[j].Agent })
+	sort.Slice(rv.OutsidePodCIDR, func(i, j int) bool { return rv.OutsidePodCIDR[i].Agent < rv.OutsidePodCIDR[j].Agent })
+
+	rv.Healthy = len(rv.Duplicates) == 0 && len(rv.Changes) == 0 && len(rv.OutsidePodCIDR) == 0
+	return rv, nil
+}
+
+// UpdateIPMetrics exports results of the IP check.
+func UpdateIPMetrics(info *IPCheckInfo) {
+	ipDuplicates.Set(float64(len(info.Duplicates)))
+	ipHostnetChanges.Set(float64(len(info.Changes)))
+	ipOutsidePodCIDR.Set(float64(len(info.OutsidePodCIDR)))
+}
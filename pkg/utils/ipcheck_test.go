@@ -0,0 +1,128 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/pkg/api/v1"
+
+	ext_v1 "github.com/Mirantis/k8s-netchecker-server/pkg/extensions/apis/v1"
+)
+
+func TestCheckIPs(t *testing.T) {
+	cfg := GetOrCreateConfig()
+	defer func(cidrs []string) { cfg.PodCIDRs = cidrs }(cfg.PodCIDRs)
+	cfg.PodCIDRs = []string{"10.233.64.0/18"}
+
+	now := time.Now()
+	ipsAgent := func(node string, ips ...string) ext_v1.AgentSpec {
+		agent := agentExample()
+		agent.NodeName = node
+		agent.LastUpdated = now
+		agent.IPs = map[string][]string{"lo": {"127.0.0.1/8"}, "eth0": ips}
+		return agent
+	}
+
+	agents := NcAgentCache{
+		"agent-1":         ipsAgent("node-1", "10.233.64.5/24"),
+		"agent-2":         ipsAgent("node-2", "10.233.64.5/24", "fe80::1/64"),
+		"agent-3":         ipsAgent("node-3", "192.168.0.3/24"),
+		"agent-hostnet-1": ipsAgent("node-1", "192.168.0.1/24"),
+		"agent-hostnet-2": ipsAgent("node-2", "192.168.0.2/24"),
+	}
+	pods := &v1.PodList{Items: []v1.Pod{
+		agentPod("agent-1", "node-1", false),
+		agentPod("agent-2", "node-2", false),
+		agentPod("agent-3", "node-3", false),
+		agentPod("agent-hostnet-1", "node-1", true),
+		agentPod("agent-hostnet-2", "node-2", true),
+	}}
+
+	previous := ipsAgent("node-2", "192.168.0.20/24")
+	previous.LastUpdated = now.Add(-time.Minute)
+	changed := agents["agent-hostnet-2"]
+	trackIPChange(&previous, &changed)
+	agents["agent-hostnet-2"] = changed
+
+	info, err := CheckIPs(agents, pods, now)
+	if err != nil {
+		t.Fatalf("IP check failed. Details: %v", err)
+	}
+	if info.Healthy {
+		t.Error("IP check with issues must not be healthy")
+	}
+
+	expectedDuplicates := []IPDuplicate{{IP: "10.233.64.5", Agents: []string{"agent-1", "agent-2"}}}
+	if !reflect.DeepEqual(info.Duplicates, expectedDuplicates) {
+		t.Errorf("Duplicates %+v are not as expected %+v", info.Duplicates, expectedDuplicates)
+	}
+	expectedChanges := []IPChange{{
+		Agent:     "agent-hostnet-2",
+		Node:      "node-2",
+		Previous:  []string{"192.168.0.20"},
+		Current:   []string{"192.168.0.2"},
+		ChangedAt: now,
+	}}
+	if !reflect.DeepEqual(info.Changes, expectedChanges) {
+		t.Errorf("Changes %+v are not as expected %+v", info.Changes, expectedChanges)
+	}
+	expectedOutside := []IPOutsidePodCIDR{{Agent: "agent-3", Node: "node-3", Addresses: []string{"192.168.0.3"}}}
+	if !reflect.DeepEqual(info.OutsidePodCIDR, expectedOutside) {
+		t.Errorf("Agents outside pod CIDR %+v are not as expected %+v", info.OutsidePodCIDR, expectedOutside)
+	}
+}
+
+func TestTrackIPChange(t *testing.T) {
+	now := time.Now()
+	report := func(ip string, received time.Time) ext_v1.AgentSpec {
+		agent := agentExample()
+		agent.LastUpdated = received
+		agent.IPs = map[string][]string{"eth0": {ip}}
+		return agent
+	}
+
+	first := report("192.168.0.1/24", now)
+	trackIPChange(nil, &first)
+	second := report("192.168.0.1/24", now.Add(time.Minute))
+	trackIPChange(&first, &second)
+	if second.LastIPChange != nil || ipChangeDetected(&second) {
+		t.Fatalf("Unchanged addresses must not be recorded as a change, got %+v", second.LastIPChange)
+	}
+
+	third := report("192.168.0.2/24", now.Add(2*time.Minute))
+	trackIPChange(&second, &third)
+	if !ipChangeDetected(&third) || !reflect.DeepEqual(third.PreviousIPs, []string{"192.168.0.1"}) {
+		t.Errorf("Change must be detected by the report, got %v at %v", third.PreviousIPs, third.LastIPChange)
+	}
+
+	// the change is kept, but reported by the report which detected it only
+	fourth := report("192.168.0.2/24", now.Add(3*time.Minute))
+	trackIPChange(&third, &fourth)
+	if ipChangeDetected(&fourth) || fourth.LastIPChange == nil || !fourth.LastIPChange.Equal(third.LastUpdated) {
+		t.Errorf("Change must be carried over without being detected again, got %v", fourth.LastIPChange)
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	if cidrs, err := ParseCIDRs([]string{"10.0.0.0/8", " fd00::/8", ""}); err != nil || len(cidrs) != 2 {
+		t.Errorf("Two CIDRs must be parsed, got %v (%v)", cidrs, err)
+	}
+	if _, err := ParseCIDRs([]string{"10.0.0.0"}); err == nil {
+		t.Error("Address without prefix length must be rejected")
+	}
+}
@@ -15,22 +15,19 @@
 package utils
 
 import (
+	"fmt"
+
 	"github.com/golang/glog"
 
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/labels"
-	"k8s.io/apimachinery/pkg/selection"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/pkg/api/v1"
 	"k8s.io/client-go/rest"
 )
 
-const AgentLabelKey = "app"
-
-var AgentLabelValues = []string{"netchecker-agent", "netchecker-agent-hostnet"}
-
 type Proxy interface {
 	Pods() (*v1.PodList, error)
+	Nodes() (*v1.NodeList, error)
 }
 
 type KubeProxy struct {
@@ -54,13 +51,48 @@ func (kp *KubeProxy) buildConfig() (*rest.Config, error) {
 	return rest.InClusterConfig()
 }
 
+// Pods lists the agent pods matching any of the configured selectors in the
+// configured namespaces.
 func (kp *KubeProxy) Pods() (*v1.PodList, error) {
-	requirement, err := labels.NewRequirement(AgentLabelKey, selection.In, AgentLabelValues)
-	if err != nil {
-		return nil, err
+	policy := &GetOrCreateConfig().Agents
+	namespaces := policy.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{meta_v1.NamespaceAll}
 	}
-	glog.V(10).Infof("Selector for kubernetes pods: %v", requirement.String())
 
-	pods, err := kp.Client.Core().Pods("").List(meta_v1.ListOptions{LabelSelector: requirement.String()})
-	return pods, err
+	rv := &v1.PodList{Items: []v1.Pod{}}
+	seen := map[string]bool{}
+	for _, namespace := range namespaces {
+		for _, selector := range policy.Selectors {
+			glog.V(10).Infof("Selector for kubernetes pods in namespace %q: %v", namespace, selector.Selector)
+			pods, err := kp.Client.Core().Pods(namespace).List(meta_v1.ListOptions{LabelSelector: selector.Selector})
+			if err != nil {
+				return nil, err
+			}
+			for _, pod := range pods.Items {
+				// pod can match several selectors
+				key := pod.ObjectMeta.Namespace + "/" + pod.ObjectMeta.Name
+				if !seen[key] {
+					seen[key] = true
+					rv.Items = append(rv.Items, pod)
+				}
+			}
+		}
+	}
+	return rv, nil
+}
+
+func (kp *KubeProxy) Nodes() (*v1.NodeList, error) {
+	return kp.Client.Core().Nodes().List(meta_v1.ListOptions{})
+}
+
+// kubeClientset returns the clientset the k8s proxy is built on.
+func kubeClientset(kubeClient Proxy) (kubernetes.Interface, error) {
+	switch kubeClient := kubeClient.(type) {
+	case *KubeProxy:
+		return kubeClient.Client, nil
+	case *PodCache:
+		return kubeClient.Client, nil
+	}
+	return nil, fmt.Errorf("k8s API is not accessible")
 }
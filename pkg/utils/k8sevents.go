@@ -0,0 +1,201 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// eventsComponent is the source of the k8s events recorded by the server.
+const eventsComponent = "netchecker-server"
+
+// Reasons of the k8s events about the agents
+const (
+	EventReasonAgentAbsent    = "NetcheckerAgentAbsent"
+	EventReasonAgentOutdated  = "NetcheckerAgentOutdated"
+	EventReasonProbeFailed    = "NetcheckerProbeFailed"
+	EventReasonClockSkewed    = "NetcheckerClockSkewed"
+	EventReasonAgentRecovered = "NetcheckerAgentRecovered"
+)
+
+// eventReasons maps the failing verdict reasons to the reasons of k8s events.
+var eventReasons = map[string]string{
+	ReasonAbsent:      EventReasonAgentAbsent,
+	ReasonOutdated:    EventReasonAgentOutdated,
+	ReasonProbeFailed: EventReasonProbeFailed,
+	ReasonClockSkew:   EventReasonClockSkewed,
+}
+
+// EventsConfig defines whether and how often the k8s events are recorded.
+type EventsConfig struct {
+	// Record k8s events attached to the agent pods and their nodes
+	Enabled bool `yaml:"enabled"`
+	// Number of events which can be recorded for an object at once
+	Burst int `yaml:"burst"`
+	// Period in which one more event can be recorded for an object
+	Interval time.Duration `yaml:"interval"`
+}
+
+// DefaultEventsConfig returns the configuration with the events disabled,
+// once enabled five events per object are allowed at once and one more
+// every five minutes.
+func DefaultEventsConfig() EventsConfig {
+	return EventsConfig{
+		Enabled:  false,
+		Burst:    5,
+		Interval: 5 * time.Minute,
+	}
+}
+
+// EventRecorder records the changes of the agents' states as k8s events of
+// the agent pods and their nodes, so they are shown by `kubectl describe`.
+// Events of each object are rate limited, the ones over the limit are only
+// logged.
+type EventRecorder struct {
+	*transitions
+	config   EventsConfig
+	recorder record.EventRecorder
+	lock     sync.Mutex // protects the limiters
+	limiters map[string]flowcontrol.RateLimiter
+}
+
+// NewEventRecorder creates the recorder sending the events to the k8s API
+// with the client.
+func NewEventRecorder(config EventsConfig, client kubernetes.Interface) *EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&v1core.EventSinkImpl{Interface: client.Core().Events("")})
+	recorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: eventsComponent})
+	return newEventRecorder(config, recorder)
+}
+
+func newEventRecorder(config EventsConfig, recorder record.EventRecorder) *EventRecorder {
+	return &EventRecorder{
+		transitions: newTransitions(),
+		config:      config,
+		recorder:    recorder,
+		limiters:    map[string]flowcontrol.RateLimiter{},
+	}
+}
+
+// eventMessage describes the change of the agent's state.
+func eventMessage(event *ConnectivityEvent) (string, string, string) {
+	if event.Type == EventRecovered {
+		return v1.EventTypeNormal, EventReasonAgentRecovered, fmt.Sprintf(
+			"Netchecker agent %s passes connectivity check again (was %s)", event.Agent, event.PreviousState)
+	}
+	message := fmt.Sprintf("Netchecker agent %s fails connectivity check: %s", event.Agent, event.State)
+	if event.Node != "" {
+		message += fmt.Sprintf(" (node %s)", event.Node)
+	}
+	return v1.EventTypeWarning, eventReasons[event.State], message
+}
+
+// allow takes a token of the object's limiter, limiters are created when
+// the object gets its first event. Zero burst or interval disables the rate
+// limiting.
+func (r *EventRecorder) allow(key string) bool {
+	if r.config.Burst <= 0 || r.config.Interval <= 0 {
+		return true
+	}
+	limiter, exists := r.limiters[key]
+	if !exists {
+		limiter = flowcontrol.NewTokenBucketRateLimiter(float32(1/r.config.Interval.Seconds()), r.config.Burst)
+		r.limiters[key] = limiter
+	}
+	return limiter.TryAccept()
+}
+
+// Record detects the changes of the agents' states in the report and records
+// them as the events of the agent pods and their nodes. Pods are looked up
+// in the list by the agent names, agents without pods get the node events
+// only. Removed agents have neither, so nothing is recorded for them.
+func (r *EventRecorder) Record(report *ConnectivityReport, pods *v1.PodList) {
+	events := r.Detect(report)
+	if len(events) == 0 {
+		return
+	}
+
+	agentPods := map[string]*v1.Pod{}
+	if pods != nil {
+		for i := range pods.Items {
+			agentPods[pods.Items[i].Name] = &pods.Items[i]
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i := range events {
+		event := &events[i]
+		if event.Type == EventRemoved {
+			continue
+		}
+		eventType, reason, message := eventMessage(event)
+
+		refs := []*v1.ObjectReference{}
+		if pod, exists := agentPods[event.Agent]; exists {
+			refs = append(refs, &v1.ObjectReference{
+				Kind:      "Pod",
+				Namespace: pod.Namespace,
+				Name:      pod.Name,
+				UID:       pod.UID,
+			})
+		}
+		if event.Node != "" {
+			// nodes are referred by name, the same way kubelet does it
+			refs = append(refs, &v1.ObjectReference{
+				Kind: "Node",
+				Name: event.Node,
+				UID:  types.UID(event.Node),
+			})
+		}
+
+		for _, ref := range refs {
+			key := ref.Kind + "/" + ref.Namespace + "/" + ref.Name
+			if !r.allow(key) {
+				glog.V(4).Infof("Event of %s is rate limited: %s", key, message)
+				continue
+			}
+			r.recorder.Event(ref, eventType, reason, message)
+		}
+	}
+	r.prune(report, agentPods)
+}
+
+// prune drops the limiters of the pods and nodes which are gone.
+func (r *EventRecorder) prune(report *ConnectivityReport, agentPods map[string]*v1.Pod) {
+	present := map[string]bool{}
+	for _, pod := range agentPods {
+		present["Pod/"+pod.Namespace+"/"+pod.Name] = true
+	}
+	for _, node := range report.Nodes {
+		present["Node//"+node.Node] = true
+	}
+	for key := range r.limiters {
+		if !present[key] {
+			delete(r.limiters, key)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// recordedEvents drains the events recorded by the fake recorder.
+func recordedEvents(recorder *record.FakeRecorder) []string {
+	events := []string{}
+	for {
+		select {
+		case event := <-recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestEventRecorder(t *testing.T) {
+	now := time.Now()
+	pods := &v1.PodList{Items: []v1.Pod{
+		{ObjectMeta: meta_v1.ObjectMeta{Name: "agent-node-1", Namespace: "netchecker"}},
+	}}
+	report := func(outdated ...string) *ConnectivityReport {
+		agents := NcAgentCache{}
+		for _, node := range []string{"node-1", "node-2"} {
+			agent := agentExample()
+			agent.NodeName = node
+			agent.LastUpdated = now
+			agents["agent-"+node] = agent
+		}
+		for _, name := range outdated {
+			agent := agents[name]
+			agent.LastUpdated = now.Add(-time.Hour)
+			agents[name] = agent
+		}
+		return BuildConnectivityReport(nil, agents, nil, nil, now)
+	}
+
+	fake := record.NewFakeRecorder(100)
+	recorder := newEventRecorder(EventsConfig{Enabled: true, Burst: 2, Interval: time.Hour}, fake)
+
+	recorder.Record(report(), pods)
+	if events := recordedEvents(fake); len(events) != 0 {
+		t.Errorf("Healthy agents must not be recorded, got %v", events)
+	}
+
+	// agent with pod gets events of both the pod and the node
+	recorder.Record(report("agent-node-1", "agent-node-2"), pods)
+	events := recordedEvents(fake)
+	if len(events) != 3 {
+		t.Fatalf("Events of pod and node of agent-node-1 and node of agent-node-2 are expected, got %v", events)
+	}
+	for _, event := range events {
+		if !strings.HasPrefix(event, v1.EventTypeWarning+" "+EventReasonAgentOutdated+" ") {
+			t.Errorf("Warning about outdated agent is expected, got %q", event)
+		}
+	}
+
+	recorder.Record(report("agent-node-1"), pods)
+	events = recordedEvents(fake)
+	if len(events) != 1 || !strings.HasPrefix(events[0], v1.EventTypeNormal+" "+EventReasonAgentRecovered+" ") {
+		t.Errorf("Recovery of agent-node-2 is expected, got %v", events)
+	}
+
+	// node-2 has used up its burst
+	recorder.Record(report("agent-node-1", "agent-node-2"), pods)
+	if events = recordedEvents(fake); len(events) != 0 {
+		t.Errorf("Events over the limit must not be recorded, got %v", events)
+	}
+}
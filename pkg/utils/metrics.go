@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"reflect"
 	"strings"
+	"sync"
 
 	"github.com/golang/glog"
 	"github.com/prometheus/client_golang/prometheus"
@@ -25,31 +26,52 @@ import (
 	ext_v1 "github.com/Mirantis/k8s-netchecker-server/pkg/extensions/apis/v1"
 )
 
-// NewAgentMetrics setup prometheus metrics
-func NewAgentMetrics(ai *ext_v1.AgentSpec) AgentMetrics {
+// agentMetricsName returns value of 'agent' label of the agent metrics, the
+// flavor given by the selector matching the agent pod is guessed from the
+// name of the agent when it is empty, see agentFlavor.
+func agentMetricsName(ai *ext_v1.AgentSpec, flavor string) string {
+	if flavor == "" {
+		flavor = agentFlavor(ai.PodName, nil)
+	}
+	suffix := flavor
+	switch flavor {
+	case AgentFlavorPodNetwork:
+		suffix = "private_network"
+	case AgentFlavorHostnet:
+		suffix = "host_network"
+	}
+	return fmt.Sprintf("%s-%s", ai.NodeName, suffix)
+}
+
+// NewAgentMetrics setup prometheus metrics, flavor is the one of the agent
+// pod, empty when the pod is not known.
+func NewAgentMetrics(ai *ext_v1.AgentSpec, flavor string) AgentMetrics {
 	am := AgentMetrics{
 		PodName: ai.PodName,
+		Flavor:  flavor,
 	}
 
-	suffix := "private_network"
-	if strings.Contains(ai.PodName, "hostnet") {
-		suffix = "host_network"
-	}
-	name := ai.NodeName
+	name := agentMetricsName(ai, flavor)
 
 	// Basic Counter metrics
 	am.ErrorCount = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace:   "ncagent",
 		Name:        "error_count_total",
-		ConstLabels: prometheus.Labels{"agent": fmt.Sprintf("%s-%s", name, suffix)},
+		ConstLabels: prometheus.Labels{"agent": name},
 		Help:        "Total number of errors (keepalive miss count) for the agent.",
 	})
 	am.ReportCount = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace:   "ncagent",
 		Name:        "report_count_total",
-		ConstLabels: prometheus.Labels{"agent": fmt.Sprintf("%s-%s", name, suffix)},
+		ConstLabels: prometheus.Labels{"agent": name},
 		Help:        "Total number of reports (keepalive messages) from the agent.",
 	})
+	am.RestartCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   "ncagent",
+		Name:        "restarts_total",
+		ConstLabels: prometheus.Labels{"agent": name},
+		Help:        "Total number of the agent restarts detected by its uptime going backwards.",
+	})
 
 	// GaugeVec metrics for HTTP probes
 	am.ProbeConnectionResult = prometheus.NewGaugeVec(
@@ -155,6 +177,68 @@ func tryRegisterCounter(m prometheus.Counter) (prometheus.Counter, bool) {
 	return m, true
 }
 
+// returns true if registering went fine, false if gauge was registered already,
+// panics on other register errors
+func tryRegisterGauge(m prometheus.Gauge) (prometheus.Gauge, bool) {
+	if err := prometheus.Register(m); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			// A gauge for that metric has been registered before.
+			existing := are.ExistingCollector.(prometheus.Gauge)
+			return existing, false
+		}
+		// Something else went wrong!
+		panic(err)
+	}
+	return m, true
+}
+
+// gaugeValues holds values of the series of a gauge vector keyed by their
+// label values.
+type gaugeValues map[string]gaugeValue
+
+type gaugeValue struct {
+	labels []string
+	value  float64
+}
+
+// add sets value of the series with the given label values.
+func (v gaugeValues) add(value float64, labels ...string) {
+	v[strings.Join(labels, "\x00")] = gaugeValue{labels: labels, value: value}
+}
+
+// gaugeSeries keeps track of the series exported by a gauge vector, so the
+// ones which are gone are deleted rather than the vector is reset, which
+// would expose it empty or half filled to the scrapes made in the meantime.
+type gaugeSeries struct {
+	sync.Mutex
+	vec    *prometheus.GaugeVec
+	labels map[string][]string
+}
+
+func newGaugeSeries(vec *prometheus.GaugeVec) *gaugeSeries {
+	return &gaugeSeries{vec: vec, labels: map[string][]string{}}
+}
+
+// Set exports the given values and deletes the series exported before
+// which are not among them.
+func (g *gaugeSeries) Set(values gaugeValues) {
+	g.Lock()
+	defer g.Unlock()
+
+	for _, v := range values {
+		g.vec.WithLabelValues(v.labels...).Set(v.value)
+	}
+	for key, labels := range g.labels {
+		if _, ok := values[key]; !ok {
+			g.vec.DeleteLabelValues(labels...)
+		}
+	}
+	g.labels = make(map[string][]string, len(values))
+	for key, v := range values {
+		g.labels[key] = v.labels
+	}
+}
+
 // returns true if registering went fine, false if GaugeVec was registered already,
 // panics on other register errors
 func tryRegisterGaugeVec(m *prometheus.GaugeVec) (*prometheus.GaugeVec, bool) {
@@ -187,12 +271,7 @@ func UpdateAgentBaseMetrics(am NcAgentMetrics, name string, report, error bool)
 
 // UpdateAgentProbeMetrics function updates HTTP probe metrics.
 func UpdateAgentProbeMetrics(ai ext_v1.AgentSpec, am AgentMetrics) {
-
-	suffix := "private_network"
-	if strings.Contains(ai.PodName, "hostnet") {
-		suffix = "host_network"
-	}
-	name := fmt.Sprintf("%s-%s", ai.NodeName, suffix)
+	name := agentMetricsName(&ai, am.Flavor)
 
 	for _, pr := range ai.NetworkProbes {
 		am.ProbeConnectionResult.WithLabelValues(name, pr.URL).Set(float64(pr.ConnectionResult))
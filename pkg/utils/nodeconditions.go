@@ -0,0 +1,203 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// NodeConditionConnectivity is the type of the node condition published by
+// the server, it's true when the agents of the node pass the connectivity
+// check.
+const NodeConditionConnectivity v1.NodeConditionType = "NetcheckerConnectivity"
+
+// Reasons of the node condition, failing nodes get the reason of the k8s
+// events about their worst agent (e.g. NetcheckerAgentOutdated)
+const (
+	ConditionReasonAgentsHealthy = "NetcheckerAgentsHealthy"
+	ConditionReasonNoAgents      = "NetcheckerNoAgents"
+)
+
+// NodeConditionsConfig defines whether and how often the node condition is
+// published.
+type NodeConditionsConfig struct {
+	// Patch the condition onto the status of the nodes
+	Enabled bool `yaml:"enabled"`
+	// Unchanged condition is patched again after this period to refresh its
+	// heartbeat time
+	Heartbeat time.Duration `yaml:"heartbeat"`
+}
+
+// DefaultNodeConditionsConfig returns the disabled configuration refreshing
+// the condition every five minutes once enabled.
+func DefaultNodeConditionsConfig() NodeConditionsConfig {
+	return NodeConditionsConfig{Heartbeat: 5 * time.Minute}
+}
+
+// nodeCondition makes the condition of the node from the verdicts of its
+// agents, the times are left for the caller. Node without agents, or with
+// excluded and silenced ones only, has unknown connectivity.
+func nodeCondition(node *NodeVerdict) v1.NodeCondition {
+	worst := ReasonNoAgent
+	checked := 0
+	failing := []string{}
+	for _, verdict := range node.Agents {
+		if !reasonChecked(verdict.Reason) {
+			continue
+		}
+		checked++
+		worst = worseReason(worst, verdict.Reason)
+		if reasonFailing(verdict.Reason) {
+			failing = append(failing, fmt.Sprintf("%s (%s)", verdict.Name, verdict.Reason))
+		}
+	}
+
+	condition := v1.NodeCondition{Type: NodeConditionConnectivity}
+	switch {
+	case checked == 0:
+		condition.Status = v1.ConditionUnknown
+		condition.Reason = ConditionReasonNoAgents
+		condition.Message = "No netchecker agents check connectivity of the node"
+	case len(failing) == 0:
+		condition.Status = v1.ConditionTrue
+		condition.Reason = ConditionReasonAgentsHealthy
+		condition.Message = fmt.Sprintf("All %v netchecker agents of the node pass connectivity check", checked)
+	default:
+		condition.Status = v1.ConditionFalse
+		condition.Reason = eventReasons[worst]
+		condition.Message = fmt.Sprintf("Netchecker agents fail connectivity check: %s; diagnosis: %s",
+			strings.Join(failing, ", "), node.Diagnosis)
+	}
+	return condition
+}
+
+// findCondition returns the condition of the type from the node status.
+func findCondition(node *v1.Node, conditionType v1.NodeConditionType) *v1.NodeCondition {
+	for i := range node.Status.Conditions {
+		if node.Status.Conditions[i].Type == conditionType {
+			return &node.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// ConditionPublisher patches the NetcheckerConnectivity condition onto the
+// status of the nodes, the same way node-problem-detector does it with its
+// conditions.
+type ConditionPublisher struct {
+	config NodeConditionsConfig
+	client kubernetes.Interface
+}
+
+// NewConditionPublisher creates the publisher patching the nodes with the
+// client.
+func NewConditionPublisher(config NodeConditionsConfig, client kubernetes.Interface) *ConditionPublisher {
+	return &ConditionPublisher{config: config, client: client}
+}
+
+// Publish patches the condition of the nodes of the report which
+// connectivity has changed or which heartbeat is due. Nodes missing from the
+// report have no agents anymore, the condition is removed from those which
+// still carry it.
+func (p *ConditionPublisher) Publish(report *ConnectivityReport, nodes *v1.NodeList, now time.Time) error {
+	if nodes == nil {
+		return fmt.Errorf("nodes are not known, conditions are not published")
+	}
+	verdicts := map[string]*NodeVerdict{}
+	for i := range report.Nodes {
+		verdicts[report.Nodes[i].Node] = &report.Nodes[i]
+	}
+
+	var errs []string
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		verdict, exists := verdicts[node.Name]
+		if !exists {
+			if findCondition(node, NodeConditionConnectivity) == nil {
+				continue
+			}
+			if err := p.remove(node.Name); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", node.Name, err))
+				continue
+			}
+			glog.V(5).Infof("Condition %s is removed from node %s without agents",
+				NodeConditionConnectivity, node.Name)
+			continue
+		}
+
+		condition := nodeCondition(verdict)
+		condition.LastHeartbeatTime = meta_v1.NewTime(now)
+		condition.LastTransitionTime = condition.LastHeartbeatTime
+		if current := findCondition(node, NodeConditionConnectivity); current != nil {
+			if current.Status == condition.Status {
+				condition.LastTransitionTime = current.LastTransitionTime
+			}
+			if current.Status == condition.Status && current.Reason == condition.Reason &&
+				current.Message == condition.Message &&
+				now.Sub(current.LastHeartbeatTime.Time) < p.config.Heartbeat {
+				continue
+			}
+		}
+
+		if err := p.patch(node.Name, &condition); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", node.Name, err))
+			continue
+		}
+		glog.V(5).Infof("Condition %s of node %s is %s (%s)",
+			condition.Type, node.Name, condition.Status, condition.Reason)
+	}
+	if len(errs) != 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("patching node conditions failed: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// patch replaces the condition in the node status, the conditions are
+// merged by type so the other ones are kept intact.
+func (p *ConditionPublisher) patch(name string, condition *v1.NodeCondition) error {
+	return p.patchConditions(name, []*v1.NodeCondition{condition})
+}
+
+// remove deletes the condition from the node status leaving the other ones
+// intact.
+func (p *ConditionPublisher) remove(name string) error {
+	return p.patchConditions(name, []map[string]interface{}{
+		{"type": NodeConditionConnectivity, "$patch": "delete"},
+	})
+}
+
+func (p *ConditionPublisher) patchConditions(name string, conditions interface{}) error {
+	patch := map[string]interface{}{
+		"status": map[string]interface{}{
+			"conditions": conditions,
+		},
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	_, err = p.client.Core().Nodes().PatchStatus(name, data)
+	return err
+}
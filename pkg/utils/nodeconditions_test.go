@@ -0,0 +1,132 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+	core "k8s.io/client-go/testing"
+)
+
+func TestNodeCondition(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		reasons []string
+		status  v1.ConditionStatus
+		reason  string
+	}{
+		{"no agents", nil, v1.ConditionUnknown, ConditionReasonNoAgents},
+		{"muted agents", []string{ReasonExcluded, ReasonSilenced}, v1.ConditionUnknown, ConditionReasonNoAgents},
+		{"healthy", []string{ReasonOK, ReasonSilenced}, v1.ConditionTrue, ConditionReasonAgentsHealthy},
+		{"outdated", []string{ReasonOK, ReasonOutdated}, v1.ConditionFalse, EventReasonAgentOutdated},
+		{"worst wins", []string{ReasonProbeFailed, ReasonAbsent}, v1.ConditionFalse, EventReasonAgentAbsent},
+	} {
+		node := &NodeVerdict{Node: "node-1"}
+		for _, reason := range tc.reasons {
+			node.Agents = append(node.Agents, AgentVerdict{Name: "agent-" + reason, Reason: reason})
+		}
+		condition := nodeCondition(node)
+		if condition.Type != NodeConditionConnectivity || condition.Status != tc.status || condition.Reason != tc.reason {
+			t.Errorf("%s: condition %s/%s is expected, got %+v", tc.name, tc.status, tc.reason, condition)
+		}
+	}
+}
+
+// patchedConditions decodes the conditions patched onto the nodes.
+func patchedConditions(t *testing.T, client *fake.Clientset) map[string]v1.NodeCondition {
+	rv := map[string]v1.NodeCondition{}
+	for _, action := range client.Actions() {
+		patch, ok := action.(core.PatchActionImpl)
+		if !ok || action.GetSubresource() != "status" {
+			continue
+		}
+		node := &v1.Node{}
+		if err := json.Unmarshal(patch.GetPatch(), node); err != nil {
+			t.Fatalf("Failed to decode patch. Details: %v", err)
+		}
+		if len(node.Status.Conditions) != 1 {
+			t.Fatalf("Patch must hold a single condition, got %s", patch.GetPatch())
+		}
+		rv[patch.GetName()] = node.Status.Conditions[0]
+	}
+	client.ClearActions()
+	return rv
+}
+
+func TestConditionPublisher(t *testing.T) {
+	now := time.Now()
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("patch", "nodes", func(action core.Action) (bool, runtime.Object, error) {
+		return true, &v1.Node{}, nil
+	})
+	publisher := NewConditionPublisher(NodeConditionsConfig{Enabled: true, Heartbeat: 5 * time.Minute}, client)
+
+	agent := agentExample()
+	agent.NodeName = "node-1"
+	agent.LastUpdated = now.Add(-time.Hour)
+	report := BuildConnectivityReport(nil, NcAgentCache{"agent-node-1": agent}, nil, nil, now)
+	nodes := &v1.NodeList{Items: []v1.Node{
+		{ObjectMeta: meta_v1.ObjectMeta{Name: "node-1"}},
+		{ObjectMeta: meta_v1.ObjectMeta{Name: "node-2"}},
+	}}
+
+	if err := publisher.Publish(report, nodes, now); err != nil {
+		t.Fatalf("Failed to publish conditions. Details: %v", err)
+	}
+	conditions := patchedConditions(t, client)
+	if len(conditions) != 1 {
+		t.Fatalf("Only node-1 with agents must be patched, got %+v", conditions)
+	}
+	if conditions["node-1"].Status != v1.ConditionFalse || conditions["node-1"].Reason != EventReasonAgentOutdated {
+		t.Errorf("node-1 must lose connectivity, got %+v", conditions["node-1"])
+	}
+
+	// unchanged conditions are patched once heartbeat is due only
+	nodes.Items[0].Status.Conditions = []v1.NodeCondition{conditions["node-1"]}
+	publisher.Publish(report, nodes, now.Add(time.Minute))
+	if conditions = patchedConditions(t, client); len(conditions) != 0 {
+		t.Errorf("Unchanged conditions must not be patched, got %+v", conditions)
+	}
+	nodes.Items[0].Status.Conditions[0].LastHeartbeatTime = meta_v1.NewTime(now.Add(-time.Hour))
+	publisher.Publish(report, nodes, now.Add(time.Minute))
+	if conditions = patchedConditions(t, client); len(conditions) != 1 || conditions["node-1"].Status != v1.ConditionFalse {
+		t.Errorf("Heartbeat of node-1 must be refreshed, got %+v", conditions)
+	}
+	nodes.Items[0].Status.Conditions[0].LastHeartbeatTime = meta_v1.NewTime(now)
+
+	// condition of the node which agents are gone is removed
+	nodes.Items[1].Status.Conditions = []v1.NodeCondition{{Type: NodeConditionConnectivity, Status: v1.ConditionTrue}}
+	publisher.Publish(report, nodes, now.Add(time.Minute))
+	if conditions = patchedConditions(t, client); len(conditions) != 1 ||
+		conditions["node-2"].Type != NodeConditionConnectivity || conditions["node-2"].Status != "" {
+		t.Errorf("Condition of node-2 must be removed, got %+v", conditions)
+	}
+	nodes.Items[1].Status.Conditions = nil
+
+	// transition time changes along with the status
+	agent.LastUpdated = now.Add(2 * time.Minute)
+	report = BuildConnectivityReport(nil, NcAgentCache{"agent-node-1": agent}, nil, nil, now.Add(2*time.Minute))
+	publisher.Publish(report, nodes, now.Add(2*time.Minute))
+	condition := patchedConditions(t, client)["node-1"]
+	if condition.Status != v1.ConditionTrue || !condition.LastTransitionTime.Time.Equal(now.Add(2*time.Minute).Truncate(time.Second)) {
+		t.Errorf("node-1 must regain connectivity now, got %+v", condition)
+	}
+}
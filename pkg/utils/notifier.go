@@ -0,0 +1,281 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Types of the connectivity events
+const (
+	EventFailing   = "failing"   // agent started failing the check, or fails for another reason now
+	EventRecovered = "recovered" // failing agent passes the check again
+	EventRemoved   = "removed"   // failing agent is gone along with its pod
+)
+
+// notificationQueueSize limits the notifications waiting for delivery, new
+// ones are dropped when webhooks can't keep up.
+const notificationQueueSize = 100
+
+// NotifierConfig defines where and how the connectivity events are sent.
+type NotifierConfig struct {
+	// URLs the events are POSTed to, notifier is disabled when empty
+	Webhooks []string `yaml:"webhooks"`
+	// Number of retries after failed delivery attempt
+	Retries int `yaml:"retries"`
+	// Delay before the first retry, it's doubled for every next one
+	Backoff time.Duration `yaml:"backoff"`
+	// Timeout of a single delivery attempt
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// DefaultNotifierConfig returns the configuration retrying failed deliveries
+// three times, in 1, 2 and 4 seconds.
+func DefaultNotifierConfig() NotifierConfig {
+	return NotifierConfig{
+		Retries: 3,
+		Backoff: time.Second,
+		Timeout: 5 * time.Second,
+	}
+}
+
+// ConnectivityEvent is a change of the agent's state in the connectivity
+// check. State and PreviousState are reason codes of the agent verdicts.
+type ConnectivityEvent struct {
+	Type          string    `json:"type"`
+	Agent         string    `json:"agent"`
+	Flavor        string    `json:"flavor,omitempty"`
+	Node          string    `json:"node,omitempty"`
+	Zone          string    `json:"zone,omitempty"`
+	State         string    `json:"state,omitempty"`
+	PreviousState string    `json:"previous_state,omitempty"`
+	Since         time.Time `json:"since"`
+	// identifies the event, so receivers can drop the repeated deliveries
+	Fingerprint string `json:"fingerprint"`
+}
+
+// Notification is the payload POSTed to the webhooks.
+type Notification struct {
+	Healthy bool                `json:"healthy"`
+	Message string              `json:"message"`
+	Events  []ConnectivityEvent `json:"events"`
+}
+
+// transitions detects the changes of the agents' states between the
+// connectivity checks. Failing agents which are excluded or silenced keep
+// their previous state, so there are no changes about them until the
+// exclusion or silence is over.
+type transitions struct {
+	sync.Mutex                   // protects the states
+	states     map[string]string // reason of the agent's verdict the last change was about
+}
+
+func newTransitions() *transitions {
+	return &transitions{states: map[string]string{}}
+}
+
+// eventFingerprint identifies the event by the change of the agent's state
+// and the time of its last report. Time of the check is left out, so that
+// the server replicas detecting the same change give it the same fingerprint.
+func eventFingerprint(event *ConnectivityEvent, lastSeen *time.Time) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\x00%s\x00%s\x00%s", event.Agent, event.Type, event.State, event.PreviousState)
+	if lastSeen != nil {
+		fmt.Fprintf(hash, "\x00%d", lastSeen.UnixNano())
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// Detect compares the agents in the report with their states from the
+// previous call and returns the events about the changes. Agents seen for
+// the first time produce events only when they fail.
+func (t *transitions) Detect(report *ConnectivityReport) []ConnectivityEvent {
+	t.Lock()
+	defer t.Unlock()
+
+	events := []ConnectivityEvent{}
+	seen := map[string]bool{}
+	for i := range report.Nodes {
+		node := &report.Nodes[i]
+		for _, verdict := range node.Agents {
+			seen[verdict.Name] = true
+			if reasonMuted(verdict.Reason) {
+				continue
+			}
+
+			prev, known := t.states[verdict.Name]
+			if known && prev == verdict.Reason {
+				continue
+			}
+			t.states[verdict.Name] = verdict.Reason
+
+			event := ConnectivityEvent{
+				Type:          EventFailing,
+				Agent:         verdict.Name,
+				Flavor:        verdict.Flavor,
+				Node:          node.Node,
+				Zone:          node.Zone,
+				State:         verdict.Reason,
+				PreviousState: prev,
+				Since:         report.CheckedAt,
+			}
+			if !reasonFailing(verdict.Reason) {
+				if !known || !reasonFailing(prev) {
+					continue
+				}
+				event.Type = EventRecovered
+			}
+			event.Fingerprint = eventFingerprint(&event, verdict.LastSeen)
+			events = append(events, event)
+		}
+	}
+
+	for name, prev := range t.states {
+		if seen[name] {
+			continue
+		}
+		delete(t.states, name)
+		if reasonFailing(prev) {
+			event := ConnectivityEvent{
+				Type:          EventRemoved,
+				Agent:         name,
+				PreviousState: prev,
+				Since:         report.CheckedAt,
+			}
+			event.Fingerprint = eventFingerprint(&event, nil)
+			events = append(events, event)
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Agent < events[j].Agent
+	})
+	return events
+}
+
+// Notifier sends the changes of the agents' states to the webhooks.
+type Notifier struct {
+	*transitions
+	config NotifierConfig
+	client *http.Client
+	queue  chan *Notification
+}
+
+// NewNotifier creates the notifier, notifications are delivered once it
+// is started with Run.
+func NewNotifier(config NotifierConfig) *Notifier {
+	return &Notifier{
+		transitions: newTransitions(),
+		config:      config,
+		client:      &http.Client{Timeout: config.Timeout},
+		queue:       make(chan *Notification, notificationQueueSize),
+	}
+}
+
+// Evaluate compares the agents in the report with their states from the
+// previous call and returns the events about the changes. Agents seen for
+// the first time produce events only when they fail.
+func (n *Notifier) Evaluate(report *ConnectivityReport) []ConnectivityEvent {
+	return n.Detect(report)
+}
+
+// Notify queues the events of the report for delivery, nothing is sent
+// when there are none.
+func (n *Notifier) Notify(report *ConnectivityReport) {
+	events := n.Evaluate(report)
+	if len(events) == 0 {
+		return
+	}
+	glog.V(5).Infof("Connectivity events detected: %v", events)
+
+	notification := &Notification{
+		Healthy: report.Healthy,
+		Message: report.Message,
+		Events:  events,
+	}
+	select {
+	case n.queue <- notification:
+	default:
+		glog.Errorf("Notification queue is full, %v events are dropped", len(events))
+	}
+}
+
+// Run delivers the queued notifications until stop channel is closed.
+func (n *Notifier) Run(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case notification := <-n.queue:
+			n.send(notification)
+		}
+	}
+}
+
+// send delivers the notification to all the webhooks.
+func (n *Notifier) send(notification *Notification) {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		glog.Errorf("Failed to marshal notification. Details: %v", err)
+		return
+	}
+	for _, url := range n.config.Webhooks {
+		if err = n.deliver(url, body); err != nil {
+			glog.Errorf("Failed to deliver notification to '%s'. Details: %v", url, err)
+		}
+	}
+}
+
+// deliver POSTs the payload to the webhook retrying with exponential
+// backoff. Client errors other than 429 are not retried.
+func (n *Notifier) deliver(url string, body []byte) error {
+	backoff := n.config.Backoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		if retry, err = n.post(url, body); err == nil || !retry || attempt >= n.config.Retries {
+			return err
+		}
+		glog.Warningf("Delivery of notification to '%s' failed, retrying in %v: %v", url, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post makes a single delivery attempt and tells whether it's worth
+// retrying when it fails.
+func (n *Notifier) post(url string, body []byte) (bool, error) {
+	resp, err := n.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("webhook responded with status %v", resp.Status)
+}
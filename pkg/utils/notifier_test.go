@@ -0,0 +1,159 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// eventsSummary leaves type, agent and state of the events only.
+func eventsSummary(events []ConnectivityEvent) [][3]string {
+	rv := [][3]string{}
+	for _, event := range events {
+		rv = append(rv, [3]string{event.Type, event.Agent, event.State})
+	}
+	return rv
+}
+
+func checkEvents(t *testing.T, step string, events []ConnectivityEvent, expected ...[3]string) {
+	actual := eventsSummary(events)
+	if len(expected) == 0 {
+		expected = [][3]string{}
+	}
+	if len(actual) != len(expected) {
+		t.Errorf("%s: events %v are not as expected %v", step, actual, expected)
+		return
+	}
+	for i := range actual {
+		if actual[i] != expected[i] {
+			t.Errorf("%s: events %v are not as expected %v", step, actual, expected)
+			return
+		}
+	}
+}
+
+func TestNotifierEvaluate(t *testing.T) {
+	now := time.Now()
+	report := func(silences []Silence, outdated ...string) *ConnectivityReport {
+		agents := NcAgentCache{}
+		for _, node := range []string{"node-1", "node-2"} {
+			agent := agentExample()
+			agent.NodeName = node
+			agent.LastUpdated = now
+			agents["agent-"+node] = agent
+		}
+		for _, name := range outdated {
+			agent := agents[name]
+			agent.LastUpdated = now.Add(-time.Hour)
+			agents[name] = agent
+		}
+		return BuildConnectivityReport(nil, agents, nil, silences, now)
+	}
+	n := NewNotifier(DefaultNotifierConfig())
+
+	events := n.Evaluate(report(nil, "agent-node-2"))
+	checkEvents(t, "first check", events, [3]string{EventFailing, "agent-node-2", ReasonOutdated})
+	if events[0].Node != "node-2" || events[0].Fingerprint == "" {
+		t.Errorf("Event must carry the node and fingerprint: %+v", events[0])
+	}
+	// another replica detects the same change later
+	later := report(nil, "agent-node-2")
+	later.CheckedAt = now.Add(time.Second)
+	if replica := newTransitions().Detect(later); replica[0].Fingerprint != events[0].Fingerprint {
+		t.Errorf("Fingerprint must not depend on the time of the check: %+v, %+v", replica[0], events[0])
+	}
+
+	checkEvents(t, "same state", n.Evaluate(report(nil, "agent-node-2")))
+	checkEvents(t, "recovery", n.Evaluate(report(nil)),
+		[3]string{EventRecovered, "agent-node-2", ReasonOK})
+
+	silences := []Silence{{ID: "upgrade", Nodes: []string{"node-1"}, StartsAt: now.Add(-time.Minute), EndsAt: now.Add(time.Hour)}}
+	checkEvents(t, "silenced failure", n.Evaluate(report(silences, "agent-node-1")))
+	checkEvents(t, "silence is over", n.Evaluate(report(nil, "agent-node-1")),
+		[3]string{EventFailing, "agent-node-1", ReasonOutdated})
+
+	gone := report(nil)
+	gone.Nodes = gone.Nodes[1:]
+	checkEvents(t, "agent is gone", n.Evaluate(gone),
+		[3]string{EventRemoved, "agent-node-1", ""})
+}
+
+func TestNotifierDelivery(t *testing.T) {
+	var attempts int32
+	received := make(chan *Notification, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		// the first two attempts fail
+		if atomic.AddInt32(&attempts, 1) <= 2 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		notification := &Notification{}
+		if err := json.NewDecoder(r.Body).Decode(notification); err != nil {
+			t.Errorf("Failed to decode notification. Details: %v", err)
+		}
+		received <- notification
+	}))
+	defer receiver.Close()
+
+	n := NewNotifier(NotifierConfig{
+		Webhooks: []string{receiver.URL},
+		Retries:  3,
+		Backoff:  time.Millisecond,
+		Timeout:  time.Second,
+	})
+	stop := make(chan struct{})
+	defer close(stop)
+	go n.Run(stop)
+
+	agent := agentExample()
+	agent.LastUpdated = time.Now().Add(-time.Hour)
+	n.Notify(BuildConnectivityReport(nil, NcAgentCache{"agent": agent}, nil, nil, time.Now()))
+
+	select {
+	case notification := <-received:
+		if notification.Healthy || len(notification.Events) != 1 || notification.Events[0].Agent != "agent" {
+			t.Errorf("Notification %+v is not as expected", notification)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatal("Notification has not been delivered")
+	}
+	if attempts != 3 {
+		t.Errorf("Notification must be delivered on the third attempt, got %v", attempts)
+	}
+}
+
+func TestNotifierClientErrorIsNotRetried(t *testing.T) {
+	var attempts int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		rw.WriteHeader(http.StatusBadRequest)
+	}))
+	defer receiver.Close()
+
+	n := NewNotifier(NotifierConfig{Retries: 3, Backoff: time.Millisecond, Timeout: time.Second})
+	if err := n.deliver(receiver.URL, []byte("{}")); err == nil {
+		t.Error("Delivery rejected by the webhook must fail")
+	}
+	if attempts != 1 {
+		t.Errorf("Rejected delivery must not be retried, got %v attempts", attempts)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// NetworkPartition is a group of nodes which are connected with each other
+// but not with the rest of the cluster. Server tells whether the server is
+// in the group.
+type NetworkPartition struct {
+	Server bool     `json:"server"`
+	Nodes  []string `json:"nodes"`
+}
+
+var networkPartitions = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "ncagent",
+	Name:      "network_partitions",
+	Help:      "Number of partitions the cluster network is split into, 1 when it's connected.",
+})
+
+func init() {
+	networkPartitions, _ = tryRegisterGauge(networkPartitions)
+}
+
+// serverVertex represents the server in the connectivity graph, node names
+// can't be empty when nodes are known
+const serverVertex = ""
+
+// reachedServer tells whether the agent's reports get through to the server.
+func reachedServer(verdict *AgentVerdict) bool {
+	return verdict.Reason != ReasonAbsent && verdict.Reason != ReasonOutdated
+}
+
+// nodeExcluded tells whether all the agents of the node are excluded or
+// silenced.
+func nodeExcluded(node *NodeVerdict) bool {
+	for i := range node.Agents {
+		if !reasonMuted(node.Agents[i].Reason) {
+			return false
+		}
+	}
+	return len(node.Agents) != 0
+}
+
+// FindPartitions builds the connectivity graph of the nodes and the server
+// and returns its connected components. Node is connected to the server when
+// any of its agents reports in time, and to another node when any of the
+// peer probes between them succeeds. The partition with the server goes
+// first, the rest are ordered by size. Nodes which are cut off from the
+// server and have no peer probe results can't be told apart from the ones
+// which are down, so they are returned as unreachable from the server
+// instead of making a partition each.
+func FindPartitions(nodes []NodeVerdict, matrix *ReachabilityMatrix) ([]NetworkPartition, []string) {
+	parent := map[string]string{serverVertex: serverVertex}
+	var find func(string) string
+	find = func(v string) string {
+		if parent[v] != v {
+			parent[v] = find(parent[v])
+		}
+		return parent[v]
+	}
+	union := func(a, b string) {
+		if ra, rb := find(a), find(b); ra != rb {
+			parent[ra] = rb
+		}
+	}
+
+	for i := range nodes {
+		node := &nodes[i]
+		if node.Node == serverVertex || nodeExcluded(node) {
+			// the node is unknown or not checked, so it can't be placed
+			// in the graph
+			continue
+		}
+		parent[node.Node] = node.Node
+		for j := range node.Agents {
+			if reachedServer(&node.Agents[j]) {
+				union(node.Node, serverVertex)
+				break
+			}
+		}
+	}
+
+	probed := map[string]bool{}
+	if matrix != nil {
+		for i, from := range matrix.Nodes {
+			for j, to := range matrix.Nodes {
+				state := matrix.Matrix[i][j]
+				if state != ReachabilityUnknown {
+					probed[from], probed[to] = true, true
+				}
+				if state != ReachabilityOK && state != ReachabilityPartial {
+					continue
+				}
+				// nodes known from the probes only are not a part of the check
+				if _, known := parent[from]; !known {
+					continue
+				}
+				if _, known := parent[to]; !known {
+					continue
+				}
+				union(from, to)
+			}
+		}
+	}
+
+	groups := map[string]*NetworkPartition{}
+	for v := range parent {
+		root := find(v)
+		group, exists := groups[root]
+		if !exists {
+			group = &NetworkPartition{Nodes: []string{}}
+			groups[root] = group
+		}
+		if v == serverVertex {
+			group.Server = true
+		} else {
+			group.Nodes = append(group.Nodes, v)
+		}
+	}
+
+	rv := make([]NetworkPartition, 0, len(groups))
+	unreachable := []string{}
+	for _, group := range groups {
+		if !group.Server && len(group.Nodes) == 1 && !probed[group.Nodes[0]] {
+			unreachable = append(unreachable, group.Nodes[0])
+			continue
+		}
+		sort.Strings(group.Nodes)
+		rv = append(rv, *group)
+	}
+	sort.Strings(unreachable)
+	sort.Slice(rv, func(i, j int) bool {
+		if rv[i].Server != rv[j].Server {
+			return rv[i].Server
+		}
+		if len(rv[i].Nodes) != len(rv[j].Nodes) {
+			return len(rv[i].Nodes) > len(rv[j].Nodes)
+		}
+		return rv[i].Nodes[0] < rv[j].Nodes[0]
+	})
+	return rv, unreachable
+}
+
+// UpdatePartitionMetrics exports the number of network partitions.
+func UpdatePartitionMetrics(report *ConnectivityReport) {
+	networkPartitions.Set(float64(len(report.Partitions)))
+}
@@ -0,0 +1,65 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFindPartitions(t *testing.T) {
+	node := func(name, reason string) NodeVerdict {
+		return NodeVerdict{Node: name, Agents: []AgentVerdict{{Name: name + "-agent", Reason: reason}}}
+	}
+	nodes := []NodeVerdict{
+		node("a-1", ReasonOK),
+		node("a-2", ReasonProbeFailed),
+		node("b-1", ReasonOutdated),
+		node("b-2", ReasonAbsent),
+		node("c-1", ReasonAbsent),
+	}
+	matrix := &ReachabilityMatrix{
+		Nodes: []string{"a-1", "b-1", "b-2", "x-1"},
+		Matrix: [][]string{
+			{ReachabilityUnknown, ReachabilityFailed, ReachabilityFailed, ReachabilityOK},
+			{ReachabilityFailed, ReachabilityUnknown, ReachabilityPartial, ReachabilityUnknown},
+			{ReachabilityFailed, ReachabilityUnknown, ReachabilityUnknown, ReachabilityUnknown},
+			{ReachabilityUnknown, ReachabilityUnknown, ReachabilityUnknown, ReachabilityUnknown},
+		},
+	}
+
+	expected := []NetworkPartition{
+		{Server: true, Nodes: []string{"a-1", "a-2"}},
+		{Nodes: []string{"b-1", "b-2"}},
+	}
+	partitions, unreachable := FindPartitions(nodes, matrix)
+	if !reflect.DeepEqual(partitions, expected) {
+		t.Errorf("Partitions %+v are not as expected %+v", partitions, expected)
+	}
+	if !reflect.DeepEqual(unreachable, []string{"c-1"}) {
+		t.Errorf("Node without peer probes must be unreachable from the server, got %v", unreachable)
+	}
+
+	healthy := []NodeVerdict{node("a-1", ReasonOK), node("a-2", ReasonOK)}
+	if partitions, _ := FindPartitions(healthy, nil); len(partitions) != 1 {
+		t.Errorf("Connected cluster must be a single partition, got %+v", partitions)
+	}
+
+	// without peer probes outdated nodes are not partitions of their own
+	partitions, unreachable = FindPartitions(nodes, nil)
+	if len(partitions) != 1 || !reflect.DeepEqual(unreachable, []string{"b-1", "b-2", "c-1"}) {
+		t.Errorf("Nodes cut off from the server must be unreachable, got %+v and %v", partitions, unreachable)
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"sort"
+	"time"
+
+	"k8s.io/client-go/pkg/api/v1"
+
+	ext_v1 "github.com/Mirantis/k8s-netchecker-server/pkg/extensions/apis/v1"
+)
+
+// States of reachability between a pair of nodes
+const (
+	ReachabilityOK      = "ok"      // all the probes succeeded
+	ReachabilityPartial = "partial" // some of the probes failed
+	ReachabilityFailed  = "failed"  // all the probes failed
+	ReachabilityUnknown = "unknown" // there are no probes
+)
+
+// PeerEndpoint is an agent other agents should probe.
+type PeerEndpoint struct {
+	Agent  string `json:"agent"`
+	Node   string `json:"node"`
+	Flavor string `json:"flavor"`
+	IP     string `json:"ip"`
+}
+
+// PeersInfo is payload structure for server answer to peers request.
+type PeersInfo struct {
+	Peers []PeerEndpoint `json:"peers"`
+}
+
+// ReachabilityCell summarizes the probes sent by the agents of one node to
+// the agents of another one.
+type ReachabilityCell struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	State  string `json:"state"`
+	Probes int    `json:"probes"`
+	Failed int    `json:"failed"`
+	// average round trip time of successful probes
+	RTT int `json:"rtt_ms"`
+}
+
+// ReachabilityMatrix is payload structure for server answer to reachability
+// matrix request. Matrix[i][j] is the state of probes sent from Nodes[i] to
+// Nodes[j], cells which are not ok are listed in Failures.
+type ReachabilityMatrix struct {
+	Healthy   bool               `json:"healthy"`
+	CheckedAt time.Time          `json:"checked_at"`
+	Nodes     []string           `json:"nodes"`
+	Matrix    [][]string         `json:"matrix"`
+	Failures  []ReachabilityCell `json:"failures"`
+	// probes aggregated by the zones of the nodes, when they are known
+	Zones []ReachabilityCell `json:"zones,omitempty"`
+}
+
+// nodePair is the key of probes sent from one node (or zone) to another one
+type nodePair struct{ from, to string }
+
+// summarize sets the state and average round trip time of the cell from
+// the counts of its probes and the total round trip time of successful ones.
+func (cell *ReachabilityCell) summarize(rttSum int) {
+	switch {
+	case cell.Failed == 0:
+		cell.State = ReachabilityOK
+	case cell.Failed == cell.Probes:
+		cell.State = ReachabilityFailed
+	default:
+		cell.State = ReachabilityPartial
+	}
+	if succeeded := cell.Probes - cell.Failed; succeeded != 0 {
+		cell.RTT = rttSum / succeeded
+	}
+}
+
+// agentEndpointIP picks the address peers should probe the agent by when its
+// pod is not known: the one of eth0 interface if there is such, the least
+// one of all the interfaces otherwise.
+func agentEndpointIP(agent *ext_v1.AgentSpec) string {
+	if eth0, exists := agent.IPs["eth0"]; exists {
+		if ips := agentAddresses(&ext_v1.AgentSpec{IPs: map[string][]string{"eth0": eth0}}); len(ips) != 0 {
+			return ips[0]
+		}
+	}
+	if ips := agentAddresses(agent); len(ips) != 0 {
+		return ips[0]
+	}
+	return ""
+}
+
+// ListPeers returns the endpoints of the agents which report in time, the
+// agent given by name is excluded. Pod addresses are used when the pods are
+// known, the reported ones otherwise.
+func ListPeers(agents NcAgentCache, pods *v1.PodList, exclude string, now time.Time) *PeersInfo {
+	rv := &PeersInfo{Peers: []PeerEndpoint{}}
+
+	if pods != nil {
+		for i := range pods.Items {
+			pod := &pods.Items[i]
+			name := pod.ObjectMeta.Name
+			agent, exists := agents[name]
+			if name == exclude || !exists || pod.Status.PodIP == "" || agentOutdated(&agent, now) {
+				continue
+			}
+			rv.Peers = append(rv.Peers, PeerEndpoint{
+				Agent:  name,
+				Node:   pod.Spec.NodeName,
+				Flavor: agentFlavor(name, pod),
+				IP:     pod.Status.PodIP,
+			})
+		}
+	} else {
+		for name := range agents {
+			agent := agents[name]
+			ip := agentEndpointIP(&agent)
+			if name == exclude || ip == "" || agentOutdated(&agent, now) {
+				continue
+			}
+			rv.Peers = append(rv.Peers, PeerEndpoint{
+				Agent:  name,
+				Node:   agent.NodeName,
+				Flavor: agentFlavor(name, nil),
+				IP:     ip,
+			})
+		}
+	}
+
+	sort.Slice(rv.Peers, func(i, j int) bool { return rv.Peers[i].Agent < rv.Peers[j].Agent })
+	return rv
+}
+
+// collectPeerProbes counts the peer probes reported by the agents which
+// report in time by pairs of nodes, total round trip time of successful
+// probes is returned separately. Probed peers are looked up by name, and by
+// address if the name is not known.
+func collectPeerProbes(agents NcAgentCache, now time.Time) (map[string]bool, map[nodePair]*ReachabilityCell, map[nodePair]int) {
+	nodeByIP := map[string]string{}
+	nodes := map[string]bool{}
+	for name := range agents {
+		agent := agents[name]
+		if agentOutdated(&agent, now) {
+			continue
+		}
+		nodes[agent.NodeName] = true
+		for _, ip := range agentAddresses(&agent) {
+			nodeByIP[ip] = agent.NodeName
+		}
+	}
+
+	cells := map[nodePair]*ReachabilityCell{}
+	rtts := map[nodePair]int{}
+
+	for name := range agents {
+		agent := agents[name]
+		if agentOutdated(&agent, now) {
+			continue
+		}
+		for _, probe := range agent.PeerProbes {
+			to := ""
+			if peer, exists := agents[probe.Peer]; exists {
+				to = peer.NodeName
+			} else if node, exists := nodeByIP[probe.IP]; exists {
+				to = node
+			} else {
+				continue
+			}
+			nodes[to] = true
+
+			key := nodePair{agent.NodeName, to}
+			cell, exists := cells[key]
+			if !exists {
+				cell = &ReachabilityCell{From: key.from, To: key.to}
+				cells[key] = cell
+			}
+			cell.Probes++
+			if probe.Reachable {
+				rtts[key] += probe.RTT
+			} else {
+				cell.Failed++
+			}
+		}
+	}
+
+	return nodes, cells, rtts
+}
+
+// BuildReachabilityMatrix aggregates the peer probes reported by the agents
+// which report in time into node to node reachability.
+func BuildReachabilityMatrix(agents NcAgentCache, now time.Time) *ReachabilityMatrix {
+	nodes, cells, rtts := collectPeerProbes(agents, now)
+
+	rv := &ReachabilityMatrix{
+		Healthy:   true,
+		CheckedAt: now,
+		Nodes:     []string{},
+		Matrix:    [][]string{},
+		Failures:  []ReachabilityCell{},
+	}
+	for node := range nodes {
+		rv.Nodes = append(rv.Nodes, node)
+	}
+	sort.Strings(rv.Nodes)
+
+	for _, from := range rv.Nodes {
+		row := make([]string, 0, len(rv.Nodes))
+		for _, to := range rv.Nodes {
+			key := nodePair{from, to}
+			cell, exists := cells[key]
+			if !exists {
+				row = append(row, ReachabilityUnknown)
+				continue
+			}
+
+			cell.summarize(rtts[key])
+			if cell.State != ReachabilityOK {
+				rv.Healthy = false
+				rv.Failures = append(rv.Failures, *cell)
+			}
+			row = append(row, cell.State)
+		}
+		rv.Matrix = append(rv.Matrix, row)
+	}
+
+	return rv
+}
@@ -0,0 +1,96 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/pkg/api/v1"
+
+	ext_v1 "github.com/Mirantis/k8s-netchecker-server/pkg/extensions/apis/v1"
+)
+
+func peerAgent(node, ip string, now time.Time, probes ...ext_v1.PeerProbeResult) ext_v1.AgentSpec {
+	agent := agentExample()
+	agent.NodeName = node
+	agent.LastUpdated = now
+	agent.IPs = map[string][]string{"eth0": {ip}}
+	agent.PeerProbes = probes
+	return agent
+}
+
+func TestListPeers(t *testing.T) {
+	now := time.Now()
+	agents := NcAgentCache{
+		"agent-1": peerAgent("node-1", "10.0.0.1", now),
+		"agent-2": peerAgent("node-2", "10.0.0.2", now),
+		"agent-3": peerAgent("node-3", "10.0.0.3", now.Add(-time.Hour)),
+	}
+
+	peers := ListPeers(agents, nil, "agent-1", now)
+	expected := []PeerEndpoint{{Agent: "agent-2", Node: "node-2", Flavor: AgentFlavorPodNetwork, IP: "10.0.0.2"}}
+	if !reflect.DeepEqual(peers.Peers, expected) {
+		t.Errorf("Peers %+v are not as expected %+v", peers.Peers, expected)
+	}
+
+	pod := agentPod("agent-1", "node-1", false)
+	pod.Status.PodIP = "10.0.1.1"
+	peers = ListPeers(agents, &v1.PodList{Items: []v1.Pod{pod}}, "", now)
+	if len(peers.Peers) != 1 || peers.Peers[0].IP != "10.0.1.1" {
+		t.Errorf("Pod address must be used for the peer, got %+v", peers.Peers)
+	}
+}
+
+func TestBuildReachabilityMatrix(t *testing.T) {
+	now := time.Now()
+	agents := NcAgentCache{
+		"agent-1": peerAgent("node-1", "10.0.0.1", now,
+			ext_v1.PeerProbeResult{Peer: "agent-2", Reachable: true, RTT: 2},
+			ext_v1.PeerProbeResult{Peer: "agent-3", Reachable: false},
+		),
+		"agent-2": peerAgent("node-2", "10.0.0.2", now,
+			ext_v1.PeerProbeResult{IP: "10.0.0.1", Reachable: true, RTT: 4},
+			ext_v1.PeerProbeResult{IP: "10.0.0.3", Reachable: true, RTT: 1},
+			ext_v1.PeerProbeResult{Peer: "agent-3", Reachable: false},
+		),
+		"agent-3": peerAgent("node-3", "10.0.0.3", now),
+	}
+
+	matrix := BuildReachabilityMatrix(agents, now)
+
+	if matrix.Healthy {
+		t.Error("Matrix with failed probes must not be healthy")
+	}
+	if !reflect.DeepEqual(matrix.Nodes, []string{"node-1", "node-2", "node-3"}) {
+		t.Errorf("Nodes %v are not as expected", matrix.Nodes)
+	}
+	expected := [][]string{
+		{ReachabilityUnknown, ReachabilityOK, ReachabilityFailed},
+		{ReachabilityOK, ReachabilityUnknown, ReachabilityPartial},
+		{ReachabilityUnknown, ReachabilityUnknown, ReachabilityUnknown},
+	}
+	if !reflect.DeepEqual(matrix.Matrix, expected) {
+		t.Errorf("Matrix %v is not as expected %v", matrix.Matrix, expected)
+	}
+	expectedFailures := []ReachabilityCell{
+		{From: "node-1", To: "node-3", State: ReachabilityFailed, Probes: 1, Failed: 1},
+		{From: "node-2", To: "node-3", State: ReachabilityPartial, Probes: 2, Failed: 1, RTT: 1},
+	}
+	if !reflect.DeepEqual(matrix.Failures, expectedFailures) {
+		t.Errorf("Failures %+v are not as expected %+v", matrix.Failures, expectedFailures)
+	}
+}
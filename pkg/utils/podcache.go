@@ -0,0 +1,187 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// PodCache is a Proxy serving the agent pods from the local stores of
+// informers which watch them, one per namespace and selector. The nodes the
+// exclusion rules and topology are read from are watched as well. Until the
+// stores are synced, the objects are listed with the wrapped KubeProxy.
+type PodCache struct {
+	*KubeProxy
+	informers []cache.SharedIndexInformer
+	nodes     cache.SharedIndexInformer
+}
+
+// NewPodCache creates informers for the nodes and for the configured
+// namespaces and selectors of the agent pods, they are started with Run.
+func NewPodCache(kp *KubeProxy) *PodCache {
+	policy := &GetOrCreateConfig().Agents
+	namespaces := policy.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{meta_v1.NamespaceAll}
+	}
+
+	rv := &PodCache{KubeProxy: kp}
+	rv.nodes = cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options meta_v1.ListOptions) (runtime.Object, error) {
+				return kp.Client.Core().Nodes().List(options)
+			},
+			WatchFunc: func(options meta_v1.ListOptions) (watch.Interface, error) {
+				return kp.Client.Core().Nodes().Watch(options)
+			},
+		},
+		&v1.Node{}, 0, cache.Indexers{},
+	)
+	for _, namespace := range namespaces {
+		for _, selector := range policy.Selectors {
+			namespace, labelSelector := namespace, selector.Selector
+			lw := &cache.ListWatch{
+				ListFunc: func(options meta_v1.ListOptions) (runtime.Object, error) {
+					options.LabelSelector = labelSelector
+					return kp.Client.Core().Pods(namespace).List(options)
+				},
+				WatchFunc: func(options meta_v1.ListOptions) (watch.Interface, error) {
+					options.LabelSelector = labelSelector
+					return kp.Client.Core().Pods(namespace).Watch(options)
+				},
+			}
+			rv.informers = append(rv.informers, cache.NewSharedIndexInformer(
+				lw, &v1.Pod{}, 0,
+				cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+			))
+		}
+	}
+	return rv
+}
+
+// Run starts the informers, they are stopped when stop channel is closed.
+func (pc *PodCache) Run(stop <-chan struct{}) {
+	go pc.nodes.Run(stop)
+	for _, informer := range pc.informers {
+		go informer.Run(stop)
+	}
+}
+
+// WaitForSync waits for the informers to get the initial list of the
+// objects, false is returned when they haven't got it within the timeout.
+func (pc *PodCache) WaitForSync(timeout time.Duration) bool {
+	err := wait.PollImmediate(100*time.Millisecond, timeout, func() (bool, error) {
+		return pc.HasSynced(), nil
+	})
+	return err == nil
+}
+
+// podCacheSyncTimeout bounds the wait for the pod cache to sync on startup,
+// the objects are listed with k8s API until it does.
+const podCacheSyncTimeout = 30 * time.Second
+
+// startPodCache wraps the proxy with the pod cache when it is enabled and
+// waits for the cache to sync. The informers are stopped when stop channel
+// is closed.
+func startPodCache(kp *KubeProxy, stop <-chan struct{}) Proxy {
+	if !GetOrCreateConfig().PodCache {
+		return kp
+	}
+	podCache := NewPodCache(kp)
+	podCache.Run(stop)
+	if !podCache.WaitForSync(podCacheSyncTimeout) {
+		glog.Warningf("Pod cache has not synced in %v, pods are listed with k8s API until it does", podCacheSyncTimeout)
+	}
+	return podCache
+}
+
+// HasSynced tells whether all the informers have got the initial list of
+// the objects.
+func (pc *PodCache) HasSynced() bool {
+	if !pc.nodes.HasSynced() {
+		return false
+	}
+	for _, informer := range pc.informers {
+		if !informer.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+// Nodes returns the nodes from the local store, or lists them with k8s API
+// when the store is not synced yet. Returned nodes are shared with the store
+// and must not be modified.
+func (pc *PodCache) Nodes() (*v1.NodeList, error) {
+	if !pc.nodes.HasSynced() {
+		return pc.KubeProxy.Nodes()
+	}
+
+	rv := &v1.NodeList{Items: []v1.Node{}}
+	for _, obj := range pc.nodes.GetStore().List() {
+		if node, ok := obj.(*v1.Node); ok {
+			rv.Items = append(rv.Items, *node)
+		}
+	}
+	sort.Slice(rv.Items, func(i, j int) bool {
+		return rv.Items[i].ObjectMeta.Name < rv.Items[j].ObjectMeta.Name
+	})
+	return rv, nil
+}
+
+// Pods returns the agent pods from the local stores, or lists them with
+// k8s API when the stores are not synced yet. Returned pods are shared with
+// the stores and must not be modified.
+func (pc *PodCache) Pods() (*v1.PodList, error) {
+	if !pc.HasSynced() {
+		glog.V(5).Info("Pod cache is not synced yet, listing pods with k8s API")
+		return pc.KubeProxy.Pods()
+	}
+
+	rv := &v1.PodList{Items: []v1.Pod{}}
+	seen := map[string]bool{}
+	for _, informer := range pc.informers {
+		for _, obj := range informer.GetStore().List() {
+			pod, ok := obj.(*v1.Pod)
+			if !ok {
+				continue
+			}
+			// pod can match several selectors
+			key := pod.ObjectMeta.Namespace + "/" + pod.ObjectMeta.Name
+			if !seen[key] {
+				seen[key] = true
+				rv.Items = append(rv.Items, *pod)
+			}
+		}
+	}
+	sort.Slice(rv.Items, func(i, j int) bool {
+		a, b := &rv.Items[i].ObjectMeta, &rv.Items[j].ObjectMeta
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+	return rv, nil
+}
@@ -0,0 +1,47 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func TestPodCache(t *testing.T) {
+	podCache := NewPodCache(&KubeProxy{Client: CSwithPods()})
+
+	// pods are listed directly until the cache is synced
+	pods, err := podCache.Pods()
+	if err != nil || len(pods.Items) != 2 {
+		t.Fatalf("Two agent pods must be listed, got %v (%v)", pods, err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	podCache.Run(stop)
+
+	if !podCache.WaitForSync(wait.ForeverTestTimeout) {
+		t.Fatal("Pod cache has not synced")
+	}
+
+	pods, err = podCache.Pods()
+	if err != nil {
+		t.Fatalf("Pods must be served from the cache. Details: %v", err)
+	}
+	if len(pods.Items) != 2 || pods.Items[0].Name != "agent-pod" || pods.Items[1].Name != "agent-pod-hostnet" {
+		t.Errorf("Cached pods %v are not as expected", pods.Items)
+	}
+}
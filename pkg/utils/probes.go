@@ -0,0 +1,103 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	ext_v1 "github.com/Mirantis/k8s-netchecker-server/pkg/extensions/apis/v1"
+)
+
+// Reasons of probe failures
+const (
+	ProbeConnectionFailed = "connection_failed"
+	ProbeUnexpectedCode   = "unexpected_code"
+)
+
+// ProbeExpectation overrides the expected outcome of the probes of an URL.
+type ProbeExpectation struct {
+	URL string `yaml:"url"`
+	// HTTP codes the probe may return, any 2xx one when empty
+	Codes []int `yaml:"codes"`
+	// Results of the probe don't affect the check
+	Ignore bool `yaml:"ignore"`
+}
+
+// ProbePolicy defines whether HTTP probes sent by the agents affect the
+// connectivity check. Probe fails when the agent couldn't connect to the URL
+// or got an unexpected HTTP code.
+type ProbePolicy struct {
+	Enabled      bool               `yaml:"enabled"`
+	Expectations []ProbeExpectation `yaml:"expectations"`
+}
+
+// ProbeFailure describes a failed probe of the agent.
+type ProbeFailure struct {
+	URL              string `json:"url"`
+	Reason           string `json:"reason"`
+	ConnectionResult int    `json:"connection_result"`
+	HTTPCode         int    `json:"http_code"`
+}
+
+func (p *ProbePolicy) expectation(url string) *ProbeExpectation {
+	for i := range p.Expectations {
+		if p.Expectations[i].URL == url {
+			return &p.Expectations[i]
+		}
+	}
+	return nil
+}
+
+func (e *ProbeExpectation) codeExpected(code int) bool {
+	if e == nil || len(e.Codes) == 0 {
+		return code >= 200 && code < 300
+	}
+	for _, expected := range e.Codes {
+		if code == expected {
+			return true
+		}
+	}
+	return false
+}
+
+// FailedProbes returns the probes of the agent which don't meet the
+// expectations. Nothing fails when the policy is disabled.
+func (p *ProbePolicy) FailedProbes(agent *ext_v1.AgentSpec) []ProbeFailure {
+	if !p.Enabled {
+		return nil
+	}
+
+	var rv []ProbeFailure
+	for _, probe := range agent.NetworkProbes {
+		expectation := p.expectation(probe.URL)
+		if expectation != nil && expectation.Ignore {
+			continue
+		}
+
+		failure := ProbeFailure{
+			URL:              probe.URL,
+			ConnectionResult: probe.ConnectionResult,
+			HTTPCode:         probe.HTTPCode,
+		}
+		switch {
+		case probe.ConnectionResult != 1:
+			failure.Reason = ProbeConnectionFailed
+		case !expectation.codeExpected(probe.HTTPCode):
+			failure.Reason = ProbeUnexpectedCode
+		default:
+			continue
+		}
+		rv = append(rv, failure)
+	}
+	return rv
+}
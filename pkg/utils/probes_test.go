@@ -0,0 +1,85 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	ext_v1 "github.com/Mirantis/k8s-netchecker-server/pkg/extensions/apis/v1"
+)
+
+func TestFailedProbes(t *testing.T) {
+	agent := agentExample()
+	agent.NetworkProbes = []ext_v1.ProbeResult{
+		{URL: "http://ok", ConnectionResult: 1, HTTPCode: 200},
+		{URL: "http://refused", ConnectionResult: 0},
+		{URL: "http://not-found", ConnectionResult: 1, HTTPCode: 404},
+		{URL: "http://redirect", ConnectionResult: 1, HTTPCode: 302},
+		{URL: "http://flaky", ConnectionResult: 0},
+	}
+	policy := ProbePolicy{
+		Enabled: true,
+		Expectations: []ProbeExpectation{
+			{URL: "http://redirect", Codes: []int{301, 302}},
+			{URL: "http://flaky", Ignore: true},
+		},
+	}
+
+	failures := policy.FailedProbes(&agent)
+	expected := []ProbeFailure{
+		{URL: "http://refused", Reason: ProbeConnectionFailed},
+		{URL: "http://not-found", Reason: ProbeUnexpectedCode, ConnectionResult: 1, HTTPCode: 404},
+	}
+	if len(failures) != len(expected) {
+		t.Fatalf("Failed probes %v are not as expected %v", failures, expected)
+	}
+	for i := range expected {
+		if failures[i] != expected[i] {
+			t.Errorf("Failed probe %v is not as expected %v", failures[i], expected[i])
+		}
+	}
+
+	policy.Enabled = false
+	if failures := policy.FailedProbes(&agent); len(failures) != 0 {
+		t.Errorf("Disabled policy must not fail probes, got %v", failures)
+	}
+}
+
+func TestConnectivityCheckFailedProbes(t *testing.T) {
+	cfg := GetOrCreateConfig()
+	defer func(enabled bool) { cfg.Probes.Enabled = enabled }(cfg.Probes.Enabled)
+	cfg.Probes.Enabled = true
+
+	handler := newHandler()
+	agent := agentExample()
+	agent.LastUpdated = time.Now()
+	agent.NetworkProbes[0].HTTPCode = http.StatusServiceUnavailable
+	handler.Agents.AgentCacheUpdate("agent-pod", &agent)
+
+	ts := createCnntyCheckTestServer(handler)
+	defer ts.Close()
+
+	actual := decodeCnntyRespOrFail(cnntyRespOrFail(ts.URL, http.StatusBadRequest, t), t)
+	if failures := actual.FailedProbes["agent-pod"]; len(failures) != 1 || failures[0].Reason != ProbeUnexpectedCode {
+		t.Errorf("Failed probe of agent-pod must be returned in the payload, got %v", actual.FailedProbes)
+	}
+
+	report := BuildConnectivityReport(nil, handler.Agents.AgentCache(), nil, nil, time.Now())
+	if report.Healthy || report.Counts.ProbeFailed != 1 {
+		t.Errorf("Agent with failed probes must fail the check, got %+v", report.Counts)
+	}
+}
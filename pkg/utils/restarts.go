@@ -0,0 +1,57 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"github.com/golang/glog"
+
+	ext_v1 "github.com/Mirantis/k8s-netchecker-server/pkg/extensions/apis/v1"
+)
+
+// latestReport returns the last of chronologically ordered reports, nil if
+// there are none.
+func latestReport(reports []ext_v1.AgentSpec) *ext_v1.AgentSpec {
+	if len(reports) == 0 {
+		return nil
+	}
+	return &reports[len(reports)-1]
+}
+
+// trackRestarts carries restart statistics of the agent over from its
+// previous report and counts a restart when uptime of the agent has gone
+// backwards. The restart is timestamped with the receipt time of the report
+// it was detected by.
+func trackRestarts(prev, cur *ext_v1.AgentSpec) {
+	if prev == nil {
+		return
+	}
+
+	cur.Restarts = prev.Restarts
+	cur.LastRestart = prev.LastRestart
+	if cur.Uptime >= prev.Uptime {
+		return
+	}
+
+	cur.Restarts++
+	restartTime := cur.LastUpdated
+	cur.LastRestart = &restartTime
+	glog.Infof("Agent '%s' restart detected: uptime %d -> %d, %d restarts so far",
+		cur.PodName, prev.Uptime, cur.Uptime, cur.Restarts)
+}
+
+// restartDetected tells whether the restart was detected by the report.
+func restartDetected(agent *ext_v1.AgentSpec) bool {
+	return agent.LastRestart != nil && agent.LastRestart.Equal(agent.LastUpdated)
+}
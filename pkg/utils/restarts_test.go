@@ -0,0 +1,74 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestAgentRestartsDetected(t *testing.T) {
+	handler := newHandler()
+	router := httprouter.New()
+	router.POST("/api/v1/agents/:name", handler.UpdateAgents)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	agent := agentExample()
+	for _, uptime := range []uint64{100, 200, 10, 20, 5} {
+		agent.Uptime = uptime
+		marshalled, err := json.Marshal(agent)
+		if err != nil {
+			t.Fatalf("Failed to marshal agent. Details: %v", err)
+		}
+		res, err := http.Post(ts.URL+"/api/v1/agents/test", "application/json", bytes.NewReader(marshalled))
+		if err != nil {
+			t.Fatalf("Failed to post agent to server. Details: %v", err)
+		}
+		res.Body.Close()
+	}
+
+	stored := handler.Agents.AgentCache()["test"]
+	if stored.Restarts != 2 {
+		t.Errorf("Two restarts must be detected, got %v", stored.Restarts)
+	}
+	if !restartDetected(&stored) {
+		t.Errorf("Restart must be timestamped with the latest report, got %v", stored.LastRestart)
+	}
+}
+
+func TestTrackRestartsKeepsStatistics(t *testing.T) {
+	prev := agentExample()
+	trackRestarts(nil, &prev)
+	if prev.Restarts != 0 || prev.LastRestart != nil {
+		t.Fatalf("The first report must not be counted as restart, got %+v", prev)
+	}
+
+	prev.Restarts = 3
+	lastRestart := prev.HostDate
+	prev.LastRestart = &lastRestart
+
+	cur := agentExample()
+	cur.Uptime = prev.Uptime + 1
+	trackRestarts(&prev, &cur)
+	if cur.Restarts != 3 || cur.LastRestart != &lastRestart {
+		t.Errorf("Restart statistics must be carried over, got %+v", cur)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// ErrSilenceNotFound is returned by the storages when there is no silence
+// with the given ID.
+var ErrSilenceNotFound = errors.New("there is no such silence")
+
+// Silence mutes failures of the agents matching any of its nodes, zones or
+// agents for the time window from StartsAt till EndsAt.
+type Silence struct {
+	ID        string    `json:"id"`
+	Nodes     []string  `json:"nodes,omitempty"`
+	Zones     []string  `json:"zones,omitempty"`
+	Agents    []string  `json:"agents,omitempty"`
+	StartsAt  time.Time `json:"starts_at"`
+	EndsAt    time.Time `json:"ends_at"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	Comment   string    `json:"comment,omitempty"`
+}
+
+// newSilenceID generates random ID for a new silence.
+func newSilenceID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// Prepare fills in the ID and the start of the silence when they are not
+// set, and validates the result.
+func (s *Silence) Prepare(now time.Time) error {
+	if len(s.Nodes) == 0 && len(s.Zones) == 0 && len(s.Agents) == 0 {
+		return fmt.Errorf("silence must match at least one node, zone or agent")
+	}
+	if s.StartsAt.IsZero() {
+		s.StartsAt = now
+	}
+	if !s.EndsAt.After(s.StartsAt) {
+		return fmt.Errorf("silence must end after it starts")
+	}
+	if !s.EndsAt.After(now) {
+		return fmt.Errorf("silence must end in the future")
+	}
+	if s.ID == "" {
+		id, err := newSilenceID()
+		if err != nil {
+			return err
+		}
+		s.ID = id
+	}
+	return nil
+}
+
+// Ended tells whether the time window of the silence has passed.
+func (s *Silence) Ended(now time.Time) bool {
+	return !now.Before(s.EndsAt)
+}
+
+// Active tells whether the silence is in effect.
+func (s *Silence) Active(now time.Time) bool {
+	return !now.Before(s.StartsAt) && !s.Ended(now)
+}
+
+func containsString(items []string, item string) bool {
+	for _, existing := range items {
+		if existing == item {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches tells whether the silence mutes the agent, running on the node
+// in the zone. Empty node and zone never match.
+func (s *Silence) Matches(agent, node, zone string) bool {
+	return containsString(s.Agents, agent) ||
+		(node != "" && containsString(s.Nodes, node)) ||
+		(zone != "" && containsString(s.Zones, zone))
+}
+
+// silenceFor returns the first active silence muting the agent, nil when
+// there is none.
+func silenceFor(silences []Silence, agent, node, zone string, now time.Time) *Silence {
+	for i := range silences {
+		if silences[i].Active(now) && silences[i].Matches(agent, node, zone) {
+			return &silences[i]
+		}
+	}
+	return nil
+}
+
+// liveSilences drops the silences which have ended and orders the rest by
+// start time, it's used by the storages to return the silences.
+func liveSilences(silences []Silence, now time.Time) []Silence {
+	rv := []Silence{}
+	for _, silence := range silences {
+		if !silence.Ended(now) {
+			rv = append(rv, silence)
+		}
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		if !rv[i].StartsAt.Equal(rv[j].StartsAt) {
+			return rv[i].StartsAt.Before(rv[j].StartsAt)
+		}
+		return rv[i].ID < rv[j].ID
+	})
+	return rv
+}
+
+// activeSilences returns the silences which are in effect.
+func activeSilences(silences []Silence, now time.Time) []Silence {
+	rv := []Silence{}
+	for _, silence := range silences {
+		if silence.Active(now) {
+			rv = append(rv, silence)
+		}
+	}
+	return rv
+}
+
+// silencedAgents maps the agents muted by the silences to the IDs of the
+// silences. Agents are located on the nodes with their pods, or with their
+// reports when the pods are unknown.
+func silencedAgents(silences []Silence, agents NcAgentCache, pods *v1.PodList, nodes *v1.NodeList, now time.Time) map[string]string {
+	rv := map[string]string{}
+	silences = activeSilences(silences, now)
+	if len(silences) == 0 {
+		return rv
+	}
+
+	located := map[string]string{}
+	for name, agent := range agents {
+		located[name] = agent.NodeName
+	}
+	if pods != nil {
+		for _, pod := range pods.Items {
+			if _, exists := located[pod.ObjectMeta.Name]; !exists || pod.Spec.NodeName != "" {
+				located[pod.ObjectMeta.Name] = pod.Spec.NodeName
+			}
+		}
+	}
+
+	topology := NodesTopology(nodes, GetOrCreateConfig().RackLabel)
+	for name, node := range located {
+		if silence := silenceFor(silences, name, node, topology[node].Zone, now); silence != nil {
+			rv[name] = silence.ID
+		}
+	}
+	return rv
+}
@@ -0,0 +1,229 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSilencePrepare(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		name    string
+		silence Silence
+		valid   bool
+	}{
+		{"no matchers", Silence{EndsAt: now.Add(time.Hour)}, false},
+		{"ends before start", Silence{Nodes: []string{"node-1"}, StartsAt: now, EndsAt: now.Add(-time.Minute)}, false},
+		{"already ended", Silence{Nodes: []string{"node-1"}, StartsAt: now.Add(-time.Hour), EndsAt: now.Add(-time.Minute)}, false},
+		{"starts now", Silence{Zones: []string{"zone-a"}, EndsAt: now.Add(time.Hour)}, true},
+		{"starts later", Silence{Agents: []string{"agent"}, StartsAt: now.Add(time.Hour), EndsAt: now.Add(2 * time.Hour)}, true},
+	} {
+		silence := tc.silence
+		err := silence.Prepare(now)
+		if (err == nil) != tc.valid {
+			t.Errorf("%s: validity must be %v, got error %v", tc.name, tc.valid, err)
+			continue
+		}
+		if err == nil && (silence.ID == "" || silence.StartsAt.IsZero()) {
+			t.Errorf("%s: ID and start must be filled in: %+v", tc.name, silence)
+		}
+	}
+}
+
+func TestSilenceFor(t *testing.T) {
+	now := time.Now()
+	silences := []Silence{
+		{ID: "future", Nodes: []string{"node-1"}, StartsAt: now.Add(time.Hour), EndsAt: now.Add(2 * time.Hour)},
+		{ID: "node", Nodes: []string{"node-1"}, StartsAt: now.Add(-time.Hour), EndsAt: now.Add(time.Hour)},
+		{ID: "zone", Zones: []string{"zone-a"}, StartsAt: now.Add(-time.Hour), EndsAt: now.Add(time.Hour)},
+		{ID: "agent", Agents: []string{"agent-3"}, StartsAt: now.Add(-time.Hour), EndsAt: now.Add(time.Hour)},
+	}
+
+	for _, tc := range []struct {
+		agent, node, zone string
+		expected          string
+	}{
+		{"agent-1", "node-1", "", "node"},
+		{"agent-2", "node-2", "zone-a", "zone"},
+		{"agent-3", "", "", "agent"},
+		{"agent-4", "node-4", "zone-b", ""},
+		{"agent-5", "", "", ""},
+	} {
+		silence := silenceFor(silences, tc.agent, tc.node, tc.zone, now)
+		actual := ""
+		if silence != nil {
+			actual = silence.ID
+		}
+		if actual != tc.expected {
+			t.Errorf("Agent %s on %q in %q must be muted by %q, got %q",
+				tc.agent, tc.node, tc.zone, tc.expected, actual)
+		}
+	}
+}
+
+// checkSilencesStorage runs the silences through the storage.
+func checkSilencesStorage(s AgentStorer, t *testing.T) {
+	now := time.Now()
+	first := Silence{ID: "first", Nodes: []string{"node-1"}, StartsAt: now.Add(-time.Minute), EndsAt: now.Add(time.Hour)}
+	second := Silence{ID: "second", Zones: []string{"zone-a"}, StartsAt: now, EndsAt: now.Add(time.Hour)}
+	for _, silence := range []Silence{second, first} {
+		if err := s.SaveSilence(&silence); err != nil {
+			t.Fatalf("Failed to save silence. Details: %v", err)
+		}
+	}
+
+	silences, err := s.Silences()
+	if err != nil {
+		t.Fatalf("Failed to get silences. Details: %v", err)
+	}
+	if len(silences) != 2 || silences[0].ID != "first" || silences[1].ID != "second" {
+		t.Fatalf("Silences %+v are not as expected", silences)
+	}
+	if !silences[0].EndsAt.Equal(first.EndsAt) || !reflect.DeepEqual(silences[0].Nodes, first.Nodes) {
+		t.Errorf("Stored silence %+v is not as expected %+v", silences[0], first)
+	}
+
+	if err = s.DeleteSilence("first"); err != nil {
+		t.Fatalf("Failed to delete silence. Details: %v", err)
+	}
+	if err = s.DeleteSilence("first"); err != ErrSilenceNotFound {
+		t.Errorf("Deleting missing silence must fail with ErrSilenceNotFound, got %v", err)
+	}
+	if silences, _ = s.Silences(); len(silences) != 1 || silences[0].ID != "second" {
+		t.Errorf("Only the second silence must be left, got %+v", silences)
+	}
+}
+
+func TestMemorySilences(t *testing.T) {
+	s, _ := NewMemoryStorer()
+	checkSilencesStorage(s, t)
+}
+
+func TestK8sSilences(t *testing.T) {
+	s := &k8sAgentStorage{
+		NcAgentCache: NcAgentCache{},
+		KubeClient:   &KubeProxy{Client: fake.NewSimpleClientset()},
+	}
+	checkSilencesStorage(s, t)
+}
+
+func TestConnectivityReportSilences(t *testing.T) {
+	now := time.Now()
+	agents := NcAgentCache{}
+	for i, node := range []string{"node-1", "node-2", "node-3"} {
+		agent := agentExample()
+		agent.NodeName = node
+		agent.LastUpdated = now
+		if i != 0 {
+			agent.LastUpdated = now.Add(-time.Hour)
+		}
+		agents["agent-"+node] = agent
+	}
+	silences := []Silence{
+		{ID: "upgrade", Nodes: []string{"node-2"}, StartsAt: now.Add(-time.Minute), EndsAt: now.Add(time.Hour)},
+		{ID: "ended", Nodes: []string{"node-3"}, StartsAt: now.Add(-time.Hour), EndsAt: now.Add(-time.Minute)},
+	}
+
+	report := BuildConnectivityReport(nil, agents, nil, silences, now)
+
+	if report.Counts.Silenced != 1 || report.Counts.Outdated != 1 {
+		t.Errorf("Counts %+v are not as expected", report.Counts)
+	}
+	verdict := report.Nodes[1].Agents[0]
+	if verdict.Reason != ReasonSilenced || verdict.Silence != "upgrade" {
+		t.Errorf("Agent on node-2 must be silenced by 'upgrade': %+v", verdict)
+	}
+	if !report.Nodes[1].Healthy || report.Nodes[2].Healthy {
+		t.Errorf("Only node-3 must fail: %+v", report.Nodes)
+	}
+	if len(report.Silences) != 1 || report.Silences[0].ID != "upgrade" {
+		t.Errorf("Only active silences must be listed: %+v", report.Silences)
+	}
+
+	// silenced agents don't fail the check
+	delete(agents, "agent-node-3")
+	report = BuildConnectivityReport(nil, agents, nil, silences, now)
+	expected := "All 1 agents on 2 nodes successfully reported back to the server, 1 agents are silenced"
+	if !report.Healthy || report.Message != expected {
+		t.Errorf("Report must be healthy with message %q, got %v %q", expected, report.Healthy, report.Message)
+	}
+}
+
+func TestSilencesAPI(t *testing.T) {
+	handler := newHandler()
+	handler.Agents.SetKubeClient(&KubeProxy{Client: CSwithPods()})
+	handler.SetupRouter()
+	ts := httptest.NewServer(handler.HTTPHandler)
+	defer ts.Close()
+
+	agent := agentExample()
+	agent.LastUpdated = time.Now()
+	agent.PodName = "agent-pod-hostnet"
+	handler.Agents.AgentCacheUpdate(agent.PodName, &agent)
+
+	// agent-pod is absent
+	res := cnntyRespOrFail(ts.URL, http.StatusBadRequest, t)
+	res.Body.Close()
+
+	body, _ := json.Marshal(Silence{Agents: []string{"agent-pod"}, EndsAt: time.Now().Add(time.Hour)})
+	res, err := http.Post(ts.URL+"/api/v1/silences", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to POST silence. Details: %v", err)
+	}
+	checkRespStatus(http.StatusCreated, res.StatusCode, t)
+	created := &Silence{}
+	if err = json.NewDecoder(res.Body).Decode(created); err != nil || created.ID == "" {
+		t.Fatalf("Created silence with ID is expected, got %+v (%v)", created, err)
+	}
+	res.Body.Close()
+
+	actual := decodeCnntyRespOrFail(cnntyRespOrFail(ts.URL, http.StatusOK, t), t)
+	if len(actual.Absent) != 0 || !reflect.DeepEqual(actual.Silenced, []string{"agent-pod"}) {
+		t.Errorf("agent-pod must be listed as silenced instead of absent: %+v", actual)
+	}
+
+	body, _ = json.Marshal(Silence{EndsAt: time.Now().Add(time.Hour)})
+	res, err = http.Post(ts.URL+"/api/v1/silences", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to POST silence. Details: %v", err)
+	}
+	checkRespStatus(http.StatusBadRequest, res.StatusCode, t)
+	res.Body.Close()
+
+	request, _ := http.NewRequest("DELETE", ts.URL+"/api/v1/silences/"+created.ID, nil)
+	if res, err = http.DefaultClient.Do(request); err != nil {
+		t.Fatalf("Failed to DELETE silence. Details: %v", err)
+	}
+	checkRespStatus(http.StatusNoContent, res.StatusCode, t)
+	res.Body.Close()
+
+	if res, err = http.DefaultClient.Do(request); err != nil {
+		t.Fatalf("Failed to DELETE silence. Details: %v", err)
+	}
+	checkRespStatus(http.StatusNotFound, res.StatusCode, t)
+	res.Body.Close()
+
+	res = cnntyRespOrFail(ts.URL, http.StatusBadRequest, t)
+	res.Body.Close()
+}
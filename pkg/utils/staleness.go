@@ -0,0 +1,101 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"time"
+
+	ext_v1 "github.com/Mirantis/k8s-netchecker-server/pkg/extensions/apis/v1"
+)
+
+// StalenessPolicy defines when an agent which stopped reporting is
+// considered outdated.
+type StalenessPolicy struct {
+	// Report is late when more than report_interval multiplied by
+	// GraceMultiplier has passed since it was received
+	GraceMultiplier float64 `yaml:"grace_multiplier"`
+	// Bounds of the staleness period computed from the report interval,
+	// zero means no bound
+	MinStaleness time.Duration `yaml:"min_staleness"`
+	MaxStaleness time.Duration `yaml:"max_staleness"`
+	// Number of consecutive missed reports before the agent is outdated
+	MissThreshold int `yaml:"miss_threshold"`
+}
+
+// DefaultStalenessPolicy returns the policy flagging agents which have
+// missed reporting for two report intervals.
+func DefaultStalenessPolicy() StalenessPolicy {
+	return StalenessPolicy{
+		GraceMultiplier: 2,
+		MissThreshold:   1,
+	}
+}
+
+// Threshold returns the period after which the report of the agent is late.
+func (p *StalenessPolicy) Threshold(agent *ext_v1.AgentSpec) time.Duration {
+	grace := p.GraceMultiplier
+	if grace <= 0 {
+		grace = DefaultStalenessPolicy().GraceMultiplier
+	}
+
+	threshold := time.Duration(float64(agent.ReportInterval) * grace * float64(time.Second))
+	if p.MinStaleness > 0 && threshold < p.MinStaleness {
+		threshold = p.MinStaleness
+	}
+	if p.MaxStaleness > 0 && threshold > p.MaxStaleness {
+		threshold = p.MaxStaleness
+	}
+	return threshold
+}
+
+// Misses returns the number of consecutive reports the agent has missed:
+// the first one is missed once the threshold is passed, and one more for
+// every report interval after that.
+func (p *StalenessPolicy) Misses(agent *ext_v1.AgentSpec, now time.Time) int {
+	threshold := p.Threshold(agent)
+	late := now.Sub(agent.LastUpdated) - threshold
+	if late <= 0 {
+		return 0
+	}
+
+	interval := time.Duration(agent.ReportInterval) * time.Second
+	if interval <= 0 {
+		return 1
+	}
+	return 1 + int(late/interval)
+}
+
+func (p *StalenessPolicy) missThreshold() int {
+	if p.MissThreshold < 1 {
+		return 1
+	}
+	return p.MissThreshold
+}
+
+// Outdated tells whether the agent has missed enough reports to be flagged.
+func (p *StalenessPolicy) Outdated(agent *ext_v1.AgentSpec, now time.Time) bool {
+	return p.Misses(agent, now) >= p.missThreshold()
+}
+
+// Errors returns the number of keepalive errors the agent should have
+// accumulated since its last report: one for the miss which got it flagged
+// and one for every miss after that.
+func (p *StalenessPolicy) Errors(agent *ext_v1.AgentSpec, now time.Time) int {
+	errors := p.Misses(agent, now) - p.missThreshold() + 1
+	if errors < 0 {
+		return 0
+	}
+	return errors
+}
@@ -0,0 +1,69 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"testing"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestStalenessPolicy(t *testing.T) {
+	now := time.Now()
+	agent := agentExample() // reports every 5 seconds
+
+	for _, tc := range []struct {
+		name     string
+		policy   StalenessPolicy
+		age      time.Duration
+		outdated bool
+		errors   int
+	}{
+		{"default in time", DefaultStalenessPolicy(), 9 * time.Second, false, 0},
+		{"default late", DefaultStalenessPolicy(), 11 * time.Second, true, 1},
+		{"default late twice", DefaultStalenessPolicy(), 16 * time.Second, true, 2},
+		{"grace", StalenessPolicy{GraceMultiplier: 4}, 16 * time.Second, false, 0},
+		{"min bound", StalenessPolicy{GraceMultiplier: 2, MinStaleness: 30 * time.Second}, 20 * time.Second, false, 0},
+		{"max bound", StalenessPolicy{GraceMultiplier: 10, MaxStaleness: 8 * time.Second}, 9 * time.Second, true, 1},
+		{"first miss tolerated", StalenessPolicy{GraceMultiplier: 2, MissThreshold: 2}, 11 * time.Second, false, 0},
+		{"second miss flagged", StalenessPolicy{GraceMultiplier: 2, MissThreshold: 2}, 16 * time.Second, true, 1},
+	} {
+		agent.LastUpdated = now.Add(-tc.age)
+		if outdated := tc.policy.Outdated(&agent, now); outdated != tc.outdated {
+			t.Errorf("%s: outdated must be %v, got %v", tc.name, tc.outdated, outdated)
+		}
+		if errors := tc.policy.Errors(&agent, now); errors != tc.errors {
+			t.Errorf("%s: number of errors must be %v, got %v", tc.name, tc.errors, errors)
+		}
+	}
+}
+
+func TestStalenessPolicyFromYaml(t *testing.T) {
+	cfg := AppConfig{Staleness: DefaultStalenessPolicy()}
+	data := []byte("staleness:\n  min_staleness: 30s\n  miss_threshold: 3\n")
+
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		t.Fatalf("Failed to parse the configuration. Details: %v", err)
+	}
+	expected := StalenessPolicy{GraceMultiplier: 2, MinStaleness: 30 * time.Second, MissThreshold: 3}
+	if cfg.Staleness != expected {
+		t.Errorf("Staleness policy %v is not as expected %v", cfg.Staleness, expected)
+	}
+
+	if err := yaml.Unmarshal([]byte("staleness:\n  max_staleness: soon\n"), &cfg); err == nil {
+		t.Error("Invalid duration must be rejected")
+	}
+}
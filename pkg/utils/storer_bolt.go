@@ -0,0 +1,442 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/golang/glog"
+	"github.com/julienschmidt/httprouter"
+
+	ext_v1 "github.com/Mirantis/k8s-netchecker-server/pkg/extensions/apis/v1"
+)
+
+var (
+	// latest report of every agent, keyed by agent name
+	boltAgentsBucket = []byte("agents")
+	// sub-bucket per agent with its reports keyed by receipt time
+	boltHistoryBucket = []byte("history")
+	// silences keyed by ID
+	boltSilencesBucket = []byte("silences")
+)
+
+// BoltAgentStorage keeps agents' reports in an embedded BoltDB file, so they
+// survive restarts of the server without any external storage. Reports which
+// are older than ReportTTL are removed by a background sweeper.
+type BoltAgentStorage struct {
+	config *AppConfig
+	db     *bolt.DB
+	k8s    K8sConnection
+	stop   chan struct{}
+}
+
+func NewBoltStorer() (*BoltAgentStorage, error) {
+	cfg := GetOrCreateConfig()
+	glog.Infof("File '%s' will be used to store agents data.", cfg.BoltPath)
+
+	rv, err := newBoltStorer(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Connection to k8s API is optional for this storage: without it
+	// absent agents can't be detected, but reports are still served.
+	if err = rv.k8s.connect(); err != nil {
+		glog.Warningf("K8s API is not accessible, absent agents won't be detected: %v", err)
+	}
+
+	return rv, nil
+}
+
+func newBoltStorer(cfg *AppConfig) (*BoltAgentStorage, error) {
+	db, err := bolt.Open(cfg.BoltPath, 0600, &bolt.Options{Timeout: cfg.PingTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("Can't open BoltDB file '%s': %v", cfg.BoltPath, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltAgentsBucket, boltHistoryBucket, boltSilencesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	rv := &BoltAgentStorage{
+		config: cfg,
+		db:     db,
+		stop:   make(chan struct{}),
+	}
+	go rv.sweep()
+
+	return rv, nil
+}
+
+// Close stops the sweeper and the pod cache and releases the database file.
+func (s *BoltAgentStorage) Close() error {
+	close(s.stop)
+	s.k8s.Close()
+	return s.db.Close()
+}
+
+func (s *BoltAgentStorage) expired(agent *ext_v1.AgentSpec) bool {
+	return s.config.ReportTTL > 0 && time.Now().Sub(agent.LastUpdated) > s.config.ReportTTL
+}
+
+// sweep periodically removes agents which haven't reported for ReportTTL
+// along with their history.
+func (s *BoltAgentStorage) sweep() {
+	interval := s.config.CheckInterval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if err := s.removeExpired(); err != nil {
+				glog.Errorf("Removing expired agents from BoltDB failed: %v", err)
+			}
+		}
+	}
+}
+
+func (s *BoltAgentStorage) removeExpired() error {
+	if s.config.ReportTTL <= 0 {
+		return nil
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		agents := tx.Bucket(boltAgentsBucket)
+		history := tx.Bucket(boltHistoryBucket)
+
+		toRemove := [][]byte{}
+		err := agents.ForEach(func(k, v []byte) error {
+			agent := ext_v1.AgentSpec{}
+			if err := json.Unmarshal(v, &agent); err != nil {
+				glog.Error(err)
+			} else if !s.expired(&agent) {
+				return nil
+			}
+			toRemove = append(toRemove, append([]byte{}, k...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range toRemove {
+			glog.V(5).Infof("Report of agent '%s' expired", k)
+			if err = agents.Delete(k); err != nil {
+				return err
+			}
+			if err = history.DeleteBucket(k); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltAgentStorage) putReport(agentName string, agentData *ext_v1.AgentSpec) error {
+	value, err := json.Marshal(agentData)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(boltAgentsBucket).Put([]byte(agentName), value); err != nil {
+			return err
+		}
+
+		history, err := tx.Bucket(boltHistoryBucket).CreateBucketIfNotExists([]byte(agentName))
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(agentData.LastUpdated.UnixNano()))
+		if err = history.Put(key, value); err != nil {
+			return err
+		}
+
+		// keys are ordered by time, so the oldest reports go first
+		limit := s.config.HistorySize
+		if limit < 1 {
+			limit = 1
+		}
+		keys := [][]byte{}
+		c := history.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			keys = append(keys, k)
+		}
+		if len(keys) <= limit {
+			return nil
+		}
+		for _, k := range keys[:len(keys)-limit] {
+			if err = history.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltAgentStorage) UpdateAgents(rw http.ResponseWriter, r *http.Request, rp httprouter.Params) (ext_v1.AgentSpec, error) {
+	agentData := ext_v1.AgentSpec{}
+
+	if err := ProcessRequest(r, &agentData, rw); err != nil {
+		return ext_v1.AgentSpec{}, err
+	}
+
+	agentData.LastUpdated = time.Now()
+	if prev, exists := s.AgentCache()[rp.ByName("name")]; exists {
+		trackRestarts(&prev, &agentData)
+		trackIPChange(&prev, &agentData)
+	}
+	glog.V(10).Infof("Updating the agents resource with value: %v", agentData)
+
+	if err := s.putReport(rp.ByName("name"), &agentData); err != nil {
+		glog.Errorf("Storing report of agent '%s' failed: %v", rp.ByName("name"), err)
+	}
+
+	return agentData, nil
+}
+
+func (s *BoltAgentStorage) GetAgents(rw http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ProcessResponse(rw, s.AgentCache())
+}
+
+func (s *BoltAgentStorage) GetSingleAgent(rw http.ResponseWriter, r *http.Request, rp httprouter.Params) {
+	agentName := rp.ByName("name")
+	agentData, exists := s.AgentCache()[agentName]
+
+	if !exists {
+		glog.V(5).Infof("Agent with name %v is not found in the cache", agentName)
+		http.Error(rw, "There is no such entry in the agent cache", http.StatusNotFound)
+		return
+	}
+
+	ProcessResponse(rw, agentData)
+}
+
+func (s *BoltAgentStorage) CheckAgents() ([]string, []string, map[string]string, error) {
+	return checkCachedAgents(s.k8s.KubeClient, s.AgentCache())
+}
+
+func (s *BoltAgentStorage) AgentCache() NcAgentCache {
+	rv := NcAgentCache{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAgentsBucket).ForEach(func(k, v []byte) error {
+			agent := ext_v1.AgentSpec{}
+			if err := json.Unmarshal(v, &agent); err != nil {
+				glog.Error(err)
+				return nil
+			}
+			// the sweeper may not have removed it yet
+			if !s.expired(&agent) {
+				rv[string(k)] = agent
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		glog.Errorf("Can't read agents from BoltDB: %v", err)
+	}
+
+	return rv
+}
+
+func (s *BoltAgentStorage) AgentCacheUpdate(key string, ag *ext_v1.AgentSpec) {
+	if err := s.putReport(key, ag); err != nil {
+		glog.Errorf("Storing report of agent '%s' failed: %v", key, err)
+	}
+}
+
+func (s *BoltAgentStorage) AgentHistory(name string) ([]ext_v1.AgentSpec, error) {
+	rv := []ext_v1.AgentSpec{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		history := tx.Bucket(boltHistoryBucket).Bucket([]byte(name))
+		if history == nil {
+			return nil
+		}
+		// keys are receipt times, so the reports are in chronological order
+		return history.ForEach(func(_, v []byte) error {
+			agent := ext_v1.AgentSpec{}
+			if err := json.Unmarshal(v, &agent); err != nil {
+				glog.Error(err)
+				return nil
+			}
+			if !s.expired(&agent) {
+				rv = append(rv, agent)
+			}
+			return nil
+		})
+	})
+
+	return rv, err
+}
+
+func (s *BoltAgentStorage) LatestReports() (NcAgentCache, error) {
+	return s.AgentCache(), nil
+}
+
+func (s *BoltAgentStorage) SaveSilence(silence *Silence) error {
+	value, err := json.Marshal(silence)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		silences := tx.Bucket(boltSilencesBucket)
+
+		// ended silences are dropped when a new one comes
+		now := time.Now()
+		toRemove := [][]byte{}
+		err := silences.ForEach(func(k, v []byte) error {
+			existing := Silence{}
+			if err := json.Unmarshal(v, &existing); err != nil {
+				glog.Error(err)
+			} else if !existing.Ended(now) {
+				return nil
+			}
+			toRemove = append(toRemove, append([]byte{}, k...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range toRemove {
+			if err = silences.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		return silences.Put([]byte(silence.ID), value)
+	})
+}
+
+func (s *BoltAgentStorage) DeleteSilence(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		silences := tx.Bucket(boltSilencesBucket)
+		if silences.Get([]byte(id)) == nil {
+			return ErrSilenceNotFound
+		}
+		return silences.Delete([]byte(id))
+	})
+}
+
+func (s *BoltAgentStorage) Silences() ([]Silence, error) {
+	silences := []Silence{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSilencesBucket).ForEach(func(_, v []byte) error {
+			silence := Silence{}
+			if err := json.Unmarshal(v, &silence); err != nil {
+				glog.Error(err)
+				return nil
+			}
+			silences = append(silences, silence)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return liveSilences(silences, time.Now()), nil
+}
+
+func (s *BoltAgentStorage) GetKubeClient() Proxy {
+	return s.k8s.KubeClient
+}
+
+func (s *BoltAgentStorage) SetKubeClient(cl Proxy) {
+	// Required for tests
+	s.k8s.KubeClient = cl
+}
+
+func (s *BoltAgentStorage) CleanCacheOnDemand(rw http.ResponseWriter) {
+	if s.k8s.KubeClient == nil {
+		return
+	}
+
+	pods, err := s.k8s.KubeClient.Pods()
+	if err != nil {
+		msg := fmt.Sprintf("Failed to get pods from k8s cluster. Details: %v", err)
+		glog.Error(msg)
+		if rw != nil {
+			http.Error(rw, msg, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	podMap := make(map[string]struct{})
+	for _, pod := range pods.Items {
+		podMap[pod.ObjectMeta.Name] = struct{}{}
+	}
+
+	// read-write transaction is committed with fsync even when nothing is
+	// changed, so it's opened only when there are agents to remove
+	toRemove := []string{}
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAgentsBucket).ForEach(func(k, _ []byte) error {
+			if _, exists := podMap[string(k)]; !exists {
+				toRemove = append(toRemove, string(k))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		glog.Errorf("Can't read agents from BoltDB: %v", err)
+		return
+	}
+	if len(toRemove) == 0 {
+		return
+	}
+
+	glog.V(5).Infof("Data cache for agents %v is to be cleaned up.", toRemove)
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		agents := tx.Bucket(boltAgentsBucket)
+		history := tx.Bucket(boltHistoryBucket)
+		for _, agentName := range toRemove {
+			if err := agents.Delete([]byte(agentName)); err != nil {
+				return err
+			}
+			if err := history.DeleteBucket([]byte(agentName)); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		glog.Errorf("Cleaning up agents in BoltDB failed: %v", err)
+	}
+}
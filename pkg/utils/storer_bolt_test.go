@@ -0,0 +1,179 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+func newBoltTestConfig(t *testing.T) (*AppConfig, func()) {
+	dir, err := ioutil.TempDir("", "netchecker-bolt")
+	if err != nil {
+		t.Fatalf("Failed to create BoltDB directory. Details: %v", err)
+	}
+	cfg := &AppConfig{
+		BoltPath:      filepath.Join(dir, "agents.db"),
+		HistorySize:   3,
+		PingTimeout:   time.Second,
+		ReportTTL:     time.Minute,
+		CheckInterval: 50 * time.Millisecond,
+	}
+	return cfg, func() { os.RemoveAll(dir) }
+}
+
+func TestBoltReportsSurviveRestart(t *testing.T) {
+	cfg, cleanup := newBoltTestConfig(t)
+	defer cleanup()
+
+	s, err := newBoltStorer(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create bolt storer. Details: %v", err)
+	}
+	agent := agentExample()
+	agent.LastUpdated = time.Now()
+	s.AgentCacheUpdate("test", &agent)
+	s.Close()
+
+	s, err = newBoltStorer(cfg)
+	if err != nil {
+		t.Fatalf("Failed to reopen bolt storer. Details: %v", err)
+	}
+	defer s.Close()
+
+	stored, exists := s.AgentCache()["test"]
+	if !exists {
+		t.Fatal("Agent report must survive the storer restart")
+	}
+	if stored.Uptime != agent.Uptime || stored.NodeName != agent.NodeName {
+		t.Errorf("Restored report %v is not as expected %v", stored, agent)
+	}
+}
+
+func TestBoltHistoryIsBounded(t *testing.T) {
+	cfg, cleanup := newBoltTestConfig(t)
+	defer cleanup()
+
+	s, err := newBoltStorer(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create bolt storer. Details: %v", err)
+	}
+	defer s.Close()
+
+	agent := agentExample()
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		agent.Uptime = uint64(i)
+		agent.LastUpdated = start.Add(time.Duration(i) * time.Second)
+		s.AgentCacheUpdate("test", &agent)
+	}
+
+	keys := 0
+	s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltHistoryBucket).Bucket([]byte("test")).ForEach(func(_, _ []byte) error {
+			keys++
+			return nil
+		})
+	})
+	if keys != cfg.HistorySize {
+		t.Errorf("History must be limited to %v reports, got %v", cfg.HistorySize, keys)
+	}
+	if s.AgentCache()["test"].Uptime != 4 {
+		t.Errorf("The latest report must be kept, got %v", s.AgentCache()["test"])
+	}
+}
+
+func TestBoltSweeperRemovesExpired(t *testing.T) {
+	cfg, cleanup := newBoltTestConfig(t)
+	defer cleanup()
+
+	s, err := newBoltStorer(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create bolt storer. Details: %v", err)
+	}
+	defer s.Close()
+
+	agent := agentExample()
+	agent.LastUpdated = time.Now().Add(-2 * cfg.ReportTTL)
+	s.AgentCacheUpdate("test", &agent)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		removed := false
+		s.db.View(func(tx *bolt.Tx) error {
+			removed = tx.Bucket(boltAgentsBucket).Get([]byte("test")) == nil &&
+				tx.Bucket(boltHistoryBucket).Bucket([]byte("test")) == nil
+			return nil
+		})
+		if removed {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Error("Expired agent must be removed by the sweeper along with its history")
+}
+
+func TestBoltCleanCacheOnDemand(t *testing.T) {
+	cfg, cleanup := newBoltTestConfig(t)
+	defer cleanup()
+	// no sweeper writes
+	cfg.ReportTTL = 0
+
+	s, err := newBoltStorer(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create bolt storer. Details: %v", err)
+	}
+	defer s.Close()
+	s.SetKubeClient(&KubeProxy{Client: CSwithPods()})
+
+	agent := agentExample()
+	agent.LastUpdated = time.Now()
+	s.AgentCacheUpdate("agent-pod", &agent)
+
+	// nothing to clean up, nothing is written
+	writes := s.db.Stats().TxStats.Write
+	s.CleanCacheOnDemand(nil)
+	if s.db.Stats().TxStats.Write != writes {
+		t.Errorf("Database must not be written when there are no agents to remove")
+	}
+
+	s.AgentCacheUpdate("gone", &agent)
+	s.CleanCacheOnDemand(nil)
+	agents := s.AgentCache()
+	if _, exists := agents["gone"]; exists || len(agents) != 1 {
+		t.Errorf("Only the agent with a pod must be kept, got %v", agents)
+	}
+	if history, _ := s.AgentHistory("gone"); len(history) != 0 {
+		t.Errorf("History of the removed agent must be gone, got %v", history)
+	}
+}
+
+func TestBoltSilences(t *testing.T) {
+	cfg, cleanup := newBoltTestConfig(t)
+	defer cleanup()
+
+	s, err := newBoltStorer(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create bolt storer. Details: %v", err)
+	}
+	defer s.Close()
+
+	checkSilencesStorage(s, t)
+}
@@ -37,7 +37,23 @@ type EtcdConfig struct {
 }
 
 type K8sConnection struct {
-	KubeClient          Proxy
+	KubeClient Proxy
+	stop       chan struct{} // stops the informers of the pod cache
+}
+
+// connect sets up the k8s client, see connect2k8s.
+func (c *K8sConnection) connect() error {
+	c.stop = make(chan struct{})
+	var err error
+	c.KubeClient, _, _, err = connect2k8s(false, c.stop)
+	return err
+}
+
+// Close stops the informers of the pod cache.
+func (c *K8sConnection) Close() {
+	if c.stop != nil {
+		close(c.stop)
+	}
 }
 
 type EtcdAgentStorage struct {
@@ -59,24 +75,9 @@ func NewEtcdStorer() (*EtcdAgentStorage, error) {
 		config:       cfg,
 	}
 
-	// setup http/https transport compatible with self-signed certs
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: true,
-	}
-	if (cfg.EtcdKeyFile != "") && (cfg.EtcdCertFile != "") {
-		cert, err := tls.LoadX509KeyPair(cfg.EtcdCertFile, cfg.EtcdKeyFile)
-		if err != nil {
-			glog.Fatalf("Error loading X509 key pair: %s", err)
-		}
-		tlsConfig = &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			InsecureSkipVerify: true,
-		}
-	}
-
 	httpsTransport := &http.Transport{
 		TLSHandshakeTimeout: 10 * time.Second,
-		TLSClientConfig:     tlsConfig,
+		TLSClientConfig:     etcdTLSConfig(cfg),
 	}
 
 	etcdConfig := etcd.Config{
@@ -96,11 +97,36 @@ func NewEtcdStorer() (*EtcdAgentStorage, error) {
 	}
 
 	// Configure connection to k8s API
-	rv.k8s.KubeClient, _, err = connect2k8s(false)
+	err = rv.k8s.connect()
 
 	return rv, err
 }
 
+// Close stops the pod cache.
+func (s *EtcdAgentStorage) Close() error {
+	s.k8s.Close()
+	return nil
+}
+
+// etcdTLSConfig returns TLS settings compatible with self-signed certs
+// which are used for connections to https etcd endpoints
+func etcdTLSConfig(cfg *AppConfig) *tls.Config {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true,
+	}
+	if (cfg.EtcdKeyFile != "") && (cfg.EtcdCertFile != "") {
+		cert, err := tls.LoadX509KeyPair(cfg.EtcdCertFile, cfg.EtcdKeyFile)
+		if err != nil {
+			glog.Fatalf("Error loading X509 key pair: %s", err)
+		}
+		tlsConfig = &tls.Config{
+			Certificates:       []tls.Certificate{cert},
+			InsecureSkipVerify: true,
+		}
+	}
+	return tlsConfig
+}
+
 func (s *EtcdAgentStorage) PingETCD() error {
 	var rv error
 	ctx, cancel := context.WithTimeout(context.Background(), s.config.PingTimeout)
@@ -182,6 +208,12 @@ func (s *EtcdAgentStorage) UpdateAgents(rw http.ResponseWriter, r *http.Request,
 	}
 
 	agentData.LastUpdated = time.Now()
+	if reports, err := s.AgentHistory(agentData.PodName); err != nil {
+		glog.Errorf("Can't get previous reports of agent '%s': %v", agentData.PodName, err)
+	} else {
+		trackRestarts(latestReport(reports), &agentData)
+		trackIPChange(latestReport(reports), &agentData)
+	}
 	glog.V(10).Infof("Updating the agents resource with value: %v", agentData)
 
 	dirName := s.agentTreeRoot(agentData.PodName)
@@ -232,18 +264,19 @@ func (s *EtcdAgentStorage) getAgents() NcAgentCache {
 	for _, node := range resp.Node.Nodes {
 		npath := strings.Split(node.Key, "/")
 		nname := npath[len(npath)-1]
-		max_AgentSpec.Uptime = 0
-		// Iterate to uptime records
+		max_AgentSpec = ext_v1.AgentSpec{}
+		// Iterate to uptime records, the most recently received one wins:
+		// uptime goes back when the agent is restarted
 		for _, n := range node.Nodes {
 			if err = json.Unmarshal([]byte(n.Value), &last_AgentSpec); err != nil {
 				glog.Error(err)
 				continue
 			}
-			if last_AgentSpec.Uptime > max_AgentSpec.Uptime {
+			if last_AgentSpec.LastUpdated.After(max_AgentSpec.LastUpdated) {
 				max_AgentSpec = last_AgentSpec
 			}
 		}
-		if max_AgentSpec.Uptime > 0 {
+		if !max_AgentSpec.LastUpdated.IsZero() {
 			agentsData[nname] = max_AgentSpec
 			glog.V(10).Infof("%s: %#v", nname, last_AgentSpec)
 		}
@@ -269,24 +302,36 @@ func (s *EtcdAgentStorage) GetSingleAgent(rw http.ResponseWriter, r *http.Reques
 	ProcessResponse(rw, agentData)
 }
 
-func (s *EtcdAgentStorage) CheckAgents() ([]string, []string, error) {
-
-	absent := []string{}
-	agents := s.getAgents()
+func (s *EtcdAgentStorage) AgentHistory(name string) ([]ext_v1.AgentSpec, error) {
+	reports := []ext_v1.AgentSpec{}
+	dirName := s.agentTreeRoot(name)
 
-	pods, err := s.k8s.KubeClient.Pods()
+	ctx := context.Background()
+	resp, err := s.etcd.kAPI.Get(ctx, dirName, &etcd.GetOptions{Quorum: true, Recursive: true})
 	if err != nil {
-		return nil, nil, err
+		if etcd.IsKeyNotFound(err) {
+			return reports, nil
+		}
+		return nil, err
 	}
 
-	for _, pod := range pods.Items {
-		agentName := pod.ObjectMeta.Name
-		if _, ok := agents[agentName]; !ok {
-			absent = append(absent, agentName)
+	for _, n := range resp.Node.Nodes {
+		report := ext_v1.AgentSpec{}
+		if err = json.Unmarshal([]byte(n.Value), &report); err != nil {
+			glog.Error(err)
+			continue
 		}
+		reports = append(reports, report)
 	}
+	sortReports(reports)
+
+	return reports, nil
+}
 
-	return absent, nil, nil
+func (s *EtcdAgentStorage) CheckAgents() ([]string, []string, map[string]string, error) {
+	// Reports are purged by TTL, but the agent may stop reporting long
+	// before that, so it's checked for being outdated as well
+	return checkCachedAgents(s.k8s.KubeClient, s.getAgents())
 }
 
 func (s *EtcdAgentStorage) AgentCache() NcAgentCache {
@@ -298,6 +343,70 @@ func (h *EtcdAgentStorage) AgentCacheUpdate(key string, ag *ext_v1.AgentSpec) {
 	//todo: Whether should I implement this, or not???
 }
 
+func (h *EtcdAgentStorage) LatestReports() (NcAgentCache, error) {
+	return h.getAgents(), nil
+}
+
+func (s *EtcdAgentStorage) silencesTreeRoot() string {
+	return fmt.Sprintf("%s/silences", s.config.EtcdTree)
+}
+
+// SaveSilence stores the silence with TTL, so etcd removes it when it ends.
+func (s *EtcdAgentStorage) SaveSilence(silence *Silence) error {
+	value, err := json.Marshal(silence)
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("%s/%s", s.silencesTreeRoot(), silence.ID)
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.PingTimeout)
+	defer cancel()
+	_, err = s.etcd.kAPI.Set(ctx, key, string(value), &etcd.SetOptions{
+		TTL: time.Until(silence.EndsAt),
+	})
+	return err
+}
+
+func (s *EtcdAgentStorage) DeleteSilence(id string) error {
+	key := fmt.Sprintf("%s/%s", s.silencesTreeRoot(), id)
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.PingTimeout)
+	defer cancel()
+	_, err := s.etcd.kAPI.Delete(ctx, key, nil)
+	if etcd.IsKeyNotFound(err) {
+		return ErrSilenceNotFound
+	}
+	return err
+}
+
+func (s *EtcdAgentStorage) Silences() ([]Silence, error) {
+	silences := []Silence{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.PingTimeout)
+	defer cancel()
+	resp, err := s.etcd.kAPI.Get(ctx, s.silencesTreeRoot(), &etcd.GetOptions{Quorum: true, Recursive: true})
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return silences, nil
+		}
+		return nil, err
+	}
+
+	for _, n := range resp.Node.Nodes {
+		silence := Silence{}
+		if err = json.Unmarshal([]byte(n.Value), &silence); err != nil {
+			glog.Error(err)
+			continue
+		}
+		silences = append(silences, silence)
+	}
+
+	return liveSilences(silences, time.Now()), nil
+}
+
+func (h *EtcdAgentStorage) GetKubeClient() Proxy {
+	return h.k8s.KubeClient
+}
+
 func (h *EtcdAgentStorage) SetKubeClient(cl Proxy) {
 	// Required for tests
 	h.k8s.KubeClient = cl
@@ -0,0 +1,420 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	ext_v1 "github.com/Mirantis/k8s-netchecker-server/pkg/extensions/apis/v1"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golang/glog"
+	"github.com/julienschmidt/httprouter"
+)
+
+// EtcdV3AgentStorage stores agents' reports using etcd v3 API. Every agent
+// has its own lease which is refreshed on each report, so all the reports of
+// an agent are removed by etcd once the agent stops reporting for ReportTTL.
+type EtcdV3AgentStorage struct {
+	sync.Mutex // ensures atomic writes; protects the following fields
+	config     *AppConfig
+	client     *clientv3.Client
+	leases     map[string]clientv3.LeaseID
+	k8s        K8sConnection
+}
+
+func NewEtcdV3Storer() (*EtcdV3AgentStorage, error) {
+	cfg := GetOrCreateConfig()
+	glog.Infof("Endpoints '%s' will be used to connect to etcd (v3 API).", cfg.EtcdEndpoints)
+
+	endpoints := strings.Split(cfg.EtcdEndpoints, ",")
+	etcdConfig := clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: cfg.PingTimeout,
+	}
+	for _, ep := range endpoints {
+		if strings.HasPrefix(ep, "https://") {
+			etcdConfig.TLS = etcdTLSConfig(cfg)
+			break
+		}
+	}
+
+	client, err := clientv3.New(etcdConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := newEtcdV3Storer(cfg, client)
+
+	// Check etcd is accessible
+	if err = rv.PingETCD(); err != nil {
+		return nil, err
+	}
+
+	// Configure connection to k8s API
+	err = rv.k8s.connect()
+
+	return rv, err
+}
+
+func newEtcdV3Storer(cfg *AppConfig, client *clientv3.Client) *EtcdV3AgentStorage {
+	return &EtcdV3AgentStorage{
+		config: cfg,
+		client: client,
+		leases: map[string]clientv3.LeaseID{},
+	}
+}
+
+// Close stops the pod cache and closes the connection to etcd.
+func (s *EtcdV3AgentStorage) Close() error {
+	s.k8s.Close()
+	return s.client.Close()
+}
+
+func (s *EtcdV3AgentStorage) PingETCD() error {
+	var rv error
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.PingTimeout)
+	defer cancel()
+	_, err := s.client.Put(ctx, fmt.Sprintf("%s/ping", s.config.EtcdTree), "pong")
+	if err != nil {
+		if err == context.DeadlineExceeded {
+			rv = fmt.Errorf("Etcd ping timeout (no answer for %v)", s.config.PingTimeout)
+		} else {
+			rv = fmt.Errorf("Etcd ping failed: %v", err.Error())
+		}
+	}
+	return rv
+}
+
+func (s *EtcdV3AgentStorage) agentsTreeRoot() string {
+	return fmt.Sprintf("%s/agents/", s.config.EtcdTree)
+}
+
+func (s *EtcdV3AgentStorage) agentTreeRoot(agentName string) string {
+	return fmt.Sprintf("%s%s/", s.agentsTreeRoot(), agentName)
+}
+
+func (s *EtcdV3AgentStorage) agentReportKey(agentName string, agentData *ext_v1.AgentSpec) string {
+	return fmt.Sprintf("%s%d", s.agentTreeRoot(agentName), agentData.Uptime)
+}
+
+// agentLease returns the lease of the agent refreshing its TTL. New lease is
+// granted when the agent has none yet or its previous lease has expired.
+// Zero ReportTTL disables expiration, reports are stored without a lease.
+// The lock is held for the access to the leases only, not for the calls to
+// etcd.
+func (s *EtcdV3AgentStorage) agentLease(ctx context.Context, agentName string) (clientv3.LeaseID, error) {
+	ttl := int64(s.config.ReportTTL.Seconds())
+	if ttl <= 0 {
+		return clientv3.NoLease, nil
+	}
+
+	s.Lock()
+	id, exists := s.leases[agentName]
+	s.Unlock()
+
+	if exists {
+		_, err := s.client.KeepAliveOnce(ctx, id)
+		if err == nil {
+			return id, nil
+		}
+		glog.V(5).Infof("Lease %x of agent '%s' can't be refreshed: %v", id, agentName, err)
+	}
+
+	lease, err := s.client.Grant(ctx, ttl)
+
+	s.Lock()
+	defer s.Unlock()
+	if err != nil {
+		delete(s.leases, agentName)
+		return 0, err
+	}
+	glog.Infof("Lease %x granted for agent '%s'", lease.ID, agentName)
+	s.leases[agentName] = lease.ID
+	return lease.ID, nil
+}
+
+// forgetLeases drops the leases of the agents which reports are gone.
+func (s *EtcdV3AgentStorage) forgetLeases(agents NcAgentCache) {
+	s.Lock()
+	defer s.Unlock()
+
+	for name := range s.leases {
+		if _, exists := agents[name]; !exists {
+			delete(s.leases, name)
+		}
+	}
+}
+
+// agentReports fetches the reports of the agent mapped by their keys.
+func (s *EtcdV3AgentStorage) agentReports(ctx context.Context, agentName string) (map[string]ext_v1.AgentSpec, error) {
+	resp, err := s.client.Get(ctx, s.agentTreeRoot(agentName), clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	reports := map[string]ext_v1.AgentSpec{}
+	for _, kv := range resp.Kvs {
+		report := ext_v1.AgentSpec{}
+		if err = json.Unmarshal(kv.Value, &report); err != nil {
+			glog.Error(err)
+			continue
+		}
+		reports[string(kv.Key)] = report
+	}
+	return reports, nil
+}
+
+// sortedReports returns the reports in chronological order.
+func sortedReports(reports map[string]ext_v1.AgentSpec) []ext_v1.AgentSpec {
+	rv := make([]ext_v1.AgentSpec, 0, len(reports))
+	for _, report := range reports {
+		rv = append(rv, report)
+	}
+	sortReports(rv)
+	return rv
+}
+
+// pruneReports removes the reports which are older than ReportTTL. Lease of
+// an active agent never expires, so this is what keeps its tree from infinite
+// growth.
+func (s *EtcdV3AgentStorage) pruneReports(ctx context.Context, reports map[string]ext_v1.AgentSpec) {
+	if s.config.ReportTTL <= 0 {
+		return
+	}
+
+	for key, report := range reports {
+		if time.Now().Sub(report.LastUpdated) > s.config.ReportTTL {
+			if _, err := s.client.Delete(ctx, key); err != nil {
+				glog.Errorf("Removing record '%s' failed: %v", key, err)
+			}
+		}
+	}
+}
+
+// putReport stores the report of the agent, reports are the ones stored
+// before, outdated of them are pruned.
+func (s *EtcdV3AgentStorage) putReport(ctx context.Context, agentName string, agentData *ext_v1.AgentSpec, reports map[string]ext_v1.AgentSpec) error {
+	lease, err := s.agentLease(ctx, agentName)
+	if err != nil {
+		return fmt.Errorf("Granting lease for agent '%s' failed: %v", agentName, err)
+	}
+
+	key := s.agentReportKey(agentName, agentData)
+	value, err := json.Marshal(agentData)
+	if err != nil {
+		return err
+	}
+	if _, err = s.client.Put(ctx, key, string(value), clientv3.WithLease(lease)); err != nil {
+		return fmt.Errorf("Creating record '%s' failed: %v", key, err)
+	}
+	glog.Infof("Record '%s' created successfully", key)
+
+	delete(reports, key)
+	s.pruneReports(ctx, reports)
+	return nil
+}
+
+// updateReport fetches the reports of the agent once, the latest of them is
+// the previous one the report is compared with, and stores the report.
+func (s *EtcdV3AgentStorage) updateReport(agentName string, agentData *ext_v1.AgentSpec, track bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.PingTimeout)
+	defer cancel()
+
+	reports, err := s.agentReports(ctx, agentName)
+	if err != nil {
+		glog.Errorf("Can't get previous reports of agent '%s': %v", agentName, err)
+	} else if track {
+		prev := latestReport(sortedReports(reports))
+		trackRestarts(prev, agentData)
+		trackIPChange(prev, agentData)
+	}
+	return s.putReport(ctx, agentName, agentData, reports)
+}
+
+func (s *EtcdV3AgentStorage) UpdateAgents(rw http.ResponseWriter, r *http.Request, rp httprouter.Params) (ext_v1.AgentSpec, error) {
+	agentData := ext_v1.AgentSpec{}
+
+	if err := ProcessRequest(r, &agentData, rw); err != nil {
+		return ext_v1.AgentSpec{}, err
+	}
+
+	agentData.LastUpdated = time.Now()
+	glog.V(10).Infof("Updating the agents resource with value: %v", agentData)
+
+	if err := s.updateReport(agentData.PodName, &agentData, true); err != nil {
+		glog.Error(err)
+	}
+
+	return agentData, nil
+}
+
+func (s *EtcdV3AgentStorage) getAgents() NcAgentCache {
+	agentsData := NcAgentCache{}
+	dirName := s.agentsTreeRoot()
+	glog.V(5).Infof("Get agents data from etcd prefix '%s'", dirName)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.PingTimeout)
+	defer cancel()
+	resp, err := s.client.Get(ctx, dirName, clientv3.WithPrefix())
+	if err != nil {
+		glog.Errorf("Can't fetch prefix '%s' from etcd: %v", dirName, err)
+		return agentsData
+	}
+
+	for _, kv := range resp.Kvs {
+		npath := strings.Split(strings.TrimPrefix(string(kv.Key), dirName), "/")
+		if len(npath) != 2 {
+			glog.Warningf("Unexpected key '%s' in agents tree", kv.Key)
+			continue
+		}
+		nname := npath[0]
+
+		report := ext_v1.AgentSpec{}
+		if err = json.Unmarshal(kv.Value, &report); err != nil {
+			glog.Error(err)
+			continue
+		}
+		// the most recently received report wins: uptime goes back
+		// when the agent is restarted
+		if report.LastUpdated.After(agentsData[nname].LastUpdated) {
+			agentsData[nname] = report
+		}
+	}
+	s.forgetLeases(agentsData)
+	return agentsData
+}
+
+func (s *EtcdV3AgentStorage) GetAgents(rw http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ProcessResponse(rw, s.getAgents())
+}
+
+func (s *EtcdV3AgentStorage) GetSingleAgent(rw http.ResponseWriter, r *http.Request, rp httprouter.Params) {
+	agentData := s.getAgents()[rp.ByName("name")]
+
+	ProcessResponse(rw, &agentData)
+}
+
+func (s *EtcdV3AgentStorage) AgentHistory(name string) ([]ext_v1.AgentSpec, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.PingTimeout)
+	defer cancel()
+	reports, err := s.agentReports(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return sortedReports(reports), nil
+}
+
+func (s *EtcdV3AgentStorage) CheckAgents() ([]string, []string, map[string]string, error) {
+	// Reports are purged with the lease, but the agent may stop reporting
+	// long before that, so it's checked for being outdated as well
+	return checkCachedAgents(s.k8s.KubeClient, s.getAgents())
+}
+
+func (s *EtcdV3AgentStorage) AgentCache() NcAgentCache {
+	return s.getAgents()
+}
+
+func (s *EtcdV3AgentStorage) AgentCacheUpdate(key string, ag *ext_v1.AgentSpec) {
+	if err := s.updateReport(key, ag, false); err != nil {
+		glog.Error(err)
+	}
+}
+
+func (s *EtcdV3AgentStorage) LatestReports() (NcAgentCache, error) {
+	return s.getAgents(), nil
+}
+
+func (s *EtcdV3AgentStorage) silencesTreeRoot() string {
+	return fmt.Sprintf("%s/silences/", s.config.EtcdTree)
+}
+
+// SaveSilence stores the silence with a lease which expires when the silence
+// ends, so etcd removes it.
+func (s *EtcdV3AgentStorage) SaveSilence(silence *Silence) error {
+	value, err := json.Marshal(silence)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.PingTimeout)
+	defer cancel()
+
+	// lease TTL is in seconds, round it up to not cut the silence short
+	ttl := int64((time.Until(silence.EndsAt) + time.Second - 1) / time.Second)
+	lease, err := s.client.Grant(ctx, ttl)
+	if err != nil {
+		return fmt.Errorf("Granting lease for silence '%s' failed: %v", silence.ID, err)
+	}
+
+	key := s.silencesTreeRoot() + silence.ID
+	_, err = s.client.Put(ctx, key, string(value), clientv3.WithLease(lease.ID))
+	return err
+}
+
+func (s *EtcdV3AgentStorage) DeleteSilence(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.PingTimeout)
+	defer cancel()
+	resp, err := s.client.Delete(ctx, s.silencesTreeRoot()+id)
+	if err != nil {
+		return err
+	}
+	if resp.Deleted == 0 {
+		return ErrSilenceNotFound
+	}
+	return nil
+}
+
+func (s *EtcdV3AgentStorage) Silences() ([]Silence, error) {
+	silences := []Silence{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.PingTimeout)
+	defer cancel()
+	resp, err := s.client.Get(ctx, s.silencesTreeRoot(), clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, kv := range resp.Kvs {
+		silence := Silence{}
+		if err = json.Unmarshal(kv.Value, &silence); err != nil {
+			glog.Error(err)
+			continue
+		}
+		silences = append(silences, silence)
+	}
+
+	return liveSilences(silences, time.Now()), nil
+}
+
+func (s *EtcdV3AgentStorage) GetKubeClient() Proxy {
+	return s.k8s.KubeClient
+}
+
+func (s *EtcdV3AgentStorage) SetKubeClient(cl Proxy) {
+	// Required for tests
+	s.k8s.KubeClient = cl
+}
+
+func (s *EtcdV3AgentStorage) CleanCacheOnDemand(rw http.ResponseWriter) {
+	// Do nothing, because no cache.
+	// All data auto-purged by ETCD leases
+}
@@ -0,0 +1,179 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/embed"
+	"github.com/julienschmidt/httprouter"
+)
+
+func startEmbeddedEtcd(t *testing.T) (*clientv3.Client, func()) {
+	dir, err := ioutil.TempDir("", "netchecker-etcd")
+	if err != nil {
+		t.Fatalf("Failed to create etcd data directory. Details: %v", err)
+	}
+
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	clientURL, _ := url.Parse("http://127.0.0.1:0")
+	peerURL, _ := url.Parse("http://127.0.0.1:0")
+	cfg.LCUrls = []url.URL{*clientURL}
+	cfg.LPUrls = []url.URL{*peerURL}
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Failed to start embedded etcd. Details: %v", err)
+	}
+
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		e.Close()
+		os.RemoveAll(dir)
+		t.Fatal("Embedded etcd took too long to start")
+	}
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{e.Clients[0].Addr().String()},
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		e.Close()
+		os.RemoveAll(dir)
+		t.Fatalf("Failed to connect to embedded etcd. Details: %v", err)
+	}
+
+	return client, func() {
+		client.Close()
+		e.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func newEtcdV3TestStorer(t *testing.T, ttl time.Duration) (*EtcdV3AgentStorage, func()) {
+	client, stop := startEmbeddedEtcd(t)
+	cfg := &AppConfig{
+		EtcdTree:    "netchecker",
+		PingTimeout: 5 * time.Second,
+		ReportTTL:   ttl,
+	}
+	s := newEtcdV3Storer(cfg, client)
+	if err := s.PingETCD(); err != nil {
+		stop()
+		t.Fatalf("Embedded etcd ping failed. Details: %v", err)
+	}
+	return s, stop
+}
+
+func TestEtcdV3UpdateAgents(t *testing.T) {
+	s, stop := newEtcdV3TestStorer(t, time.Minute)
+	defer stop()
+
+	agent := agentExample()
+	marshalled, err := json.Marshal(agent)
+	if err != nil {
+		t.Fatalf("Failed to marshal agent. Details: %v", err)
+	}
+
+	r := httptest.NewRequest("POST", "/api/v1/agents/test", bytes.NewReader(marshalled))
+	rw := httptest.NewRecorder()
+	_, err = s.UpdateAgents(rw, r, httprouter.Params{httprouter.Param{Key: "name", Value: "test"}})
+	if err != nil {
+		t.Fatalf("Failed to update agent. Details: %v", err)
+	}
+
+	// newer report of the same agent under the same lease
+	agent.Uptime++
+	agent.LastUpdated = time.Now()
+	s.AgentCacheUpdate(agent.PodName, &agent)
+
+	agents := s.AgentCache()
+	if len(agents) != 1 {
+		t.Fatalf("Exactly one agent is expected in the storage, got %v", agents)
+	}
+	if agents["test"].Uptime != agent.Uptime {
+		t.Errorf("The latest report with uptime %v is expected, got %v",
+			agent.Uptime, agents["test"].Uptime)
+	}
+	if len(s.leases) != 1 {
+		t.Errorf("One lease per agent is expected, got %v", s.leases)
+	}
+}
+
+func TestEtcdV3ReportsExpire(t *testing.T) {
+	s, stop := newEtcdV3TestStorer(t, time.Second)
+	defer stop()
+
+	agent := agentExample()
+	agent.LastUpdated = time.Now()
+	s.AgentCacheUpdate(agent.PodName, &agent)
+
+	if _, exists := s.AgentCache()["test"]; !exists {
+		t.Fatal("Agent must be present in the storage right after the report")
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, exists := s.AgentCache()["test"]; !exists {
+			if len(s.leases) != 0 {
+				t.Errorf("Lease of the gone agent must be dropped, got %v", s.leases)
+			}
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	t.Error("Agent report must be removed once its lease expires")
+}
+
+func TestEtcdV3CheckAgents(t *testing.T) {
+	s, stop := newEtcdV3TestStorer(t, time.Minute)
+	defer stop()
+	s.SetKubeClient(&KubeProxy{Client: CSwithPods()})
+
+	agent := agentExample()
+	agent.PodName = "agent-pod"
+	agent.LastUpdated = time.Now().Add(
+		-time.Second * time.Duration(agent.ReportInterval*2+1))
+	s.AgentCacheUpdate(agent.PodName, &agent)
+
+	absent, outdated, _, err := s.CheckAgents()
+	if err != nil {
+		t.Fatalf("Failed to check agents. Details: %v", err)
+	}
+	if len(absent) != 1 || absent[0] != "agent-pod-hostnet" {
+		t.Errorf("agent-pod-hostnet must be the only absent agent, got %v", absent)
+	}
+	if len(outdated) != 1 || outdated[0] != "agent-pod" {
+		t.Errorf("agent-pod must be the only outdated agent, got %v", outdated)
+	}
+}
+
+func TestEtcdV3Silences(t *testing.T) {
+	s, stop := newEtcdV3TestStorer(t, time.Minute)
+	defer stop()
+
+	checkSilencesStorage(s, t)
+}
@@ -15,8 +15,10 @@
 package utils
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/golang/glog"
@@ -28,15 +30,33 @@ import (
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	apiextensionsclient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// Silences are kept in the config map, keyed by ID, in the namespace of the
+// agent custom resources
+const (
+	silencesNamespace = "default"
+	silencesConfigMap = "netchecker-silences"
 )
 
 type k8sAgentStorage struct {
 	NcAgentCache        NcAgentCache
 	KubeClient          Proxy
 	ExtensionsClientset ext_client.Clientset
+	statusSubresource   bool // CRD has status subresource, states of the agents are kept there
+	stop                chan struct{}
 }
 
-func connect2k8s(createCRD bool) (Proxy, ext_client.Clientset, error) {
+// statusRefreshInterval is the period after which unchanged status of the
+// agent is written again to refresh its last check time.
+const statusRefreshInterval = time.Minute
+
+// connect2k8s sets up the k8s clients, the agents CRD is created along with
+// the extensions clientset when asked. Version of apiextensions API the CRD
+// is served through is returned as well. Once all of it succeeds the pod
+// cache is started, its informers are stopped when stop channel is closed.
+func connect2k8s(createCRD bool, stop <-chan struct{}) (Proxy, ext_client.Clientset, string, error) {
 	var err error
 	var clientset *kubernetes.Clientset
 
@@ -45,37 +65,38 @@ func connect2k8s(createCRD bool) (Proxy, ext_client.Clientset, error) {
 	config, err := proxy.buildConfig()
 	if err != nil {
 		glog.Error(err)
-		return nil, nil, err
+		return nil, nil, "", err
 	}
 
 	clientset, err = proxy.SetupClientSet(config)
 	if err != nil {
 		glog.Error(err)
-		return nil, nil, err
+		return nil, nil, "", err
 	}
+
 	apiextensionsclientset, err := apiextensionsclient.NewForConfig(config)
 	if err != nil {
 		glog.Error(err)
-		return nil, nil, err
+		return nil, nil, "", err
 	}
 
 	if !createCRD {
-		return proxy, nil, err
+		return startPodCache(proxy, stop), nil, "", err
 	}
 
-	err = ext_client.CreateAgentCustomResourceDefinition(apiextensionsclientset)
-	if err != nil && !api_errors.IsAlreadyExists(err) {
+	crdVersion, err := ext_client.CreateAgentCustomResourceDefinition(apiextensionsclientset)
+	if err != nil {
 		glog.Error(err)
-		return nil, nil, err
+		return nil, nil, "", err
 	}
 
 	ext, err := ext_client.WrapClientsetWithExtensions(clientset, config)
 	if err != nil {
 		glog.Error(err)
-		return nil, nil, err
+		return nil, nil, "", err
 	}
 
-	return proxy, ext, err
+	return startPodCache(proxy, stop), ext, crdVersion, err
 }
 
 func NewK8sStorer() (*k8sAgentStorage, error) {
@@ -83,13 +104,22 @@ func NewK8sStorer() (*k8sAgentStorage, error) {
 
 	rv := &k8sAgentStorage{
 		NcAgentCache: map[string]ext_v1.AgentSpec{},
+		stop:         make(chan struct{}),
 	}
 
-	rv.KubeClient, rv.ExtensionsClientset, err = connect2k8s(true)
+	var crdVersion string
+	rv.KubeClient, rv.ExtensionsClientset, crdVersion, err = connect2k8s(true, rv.stop)
+	rv.statusSubresource = crdVersion == ext_client.CRDVersionV1
 
 	return rv, err
 }
 
+// Close stops the informers of the pod cache.
+func (h *k8sAgentStorage) Close() error {
+	close(h.stop)
+	return nil
+}
+
 func (h *k8sAgentStorage) UpdateAgents(rw http.ResponseWriter, r *http.Request, rp httprouter.Params) (ext_v1.AgentSpec, error) {
 	var err error
 	agentData := ext_v1.AgentSpec{}
@@ -108,6 +138,9 @@ func (h *k8sAgentStorage) UpdateAgents(rw http.ResponseWriter, r *http.Request,
 
 	if err != nil {
 		glog.Error(err)
+	} else {
+		trackRestarts(&curAgent.Spec, &agentData)
+		trackIPChange(&curAgent.Spec, &agentData)
 	}
 
 	agent := &ext_v1.Agent{
@@ -171,38 +204,92 @@ func (h *k8sAgentStorage) GetSingleAgent(rw http.ResponseWriter, r *http.Request
 	ProcessResponse(rw, agent)
 }
 
-func (h *k8sAgentStorage) CheckAgents() ([]string, []string, error) {
+func (h *k8sAgentStorage) CheckAgents() ([]string, []string, map[string]string, error) {
 	if h.KubeClient == nil {
-		return nil, nil, nil
+		return nil, nil, nil, nil
 	}
 
 	absent := []string{}
 	outdated := []string{}
+	excluded := map[string]string{}
 
 	pods, err := h.KubeClient.Pods()
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
-	for _, pod := range pods.Items {
+	nodes := nodesByName(agentNodes(h.KubeClient))
+	exclusions := GetOrCreateConfig().Exclusions
+
+	for i := range pods.Items {
+		pod := &pods.Items[i]
 		agentName := pod.ObjectMeta.Name
 		agent, err := h.ExtensionsClientset.Agents().Get(agentName)
 
-		if api_errors.IsNotFound(err) {
-			absent = append(absent, agentName)
+		if err != nil && !api_errors.IsNotFound(err) {
+			return nil, nil, nil, err
+		}
+		if err == nil && !agentOutdated(&agent.Spec, time.Now()) {
 			continue
 		}
 
-		if err != nil {
-			return nil, nil, err
+		if rule := exclusions.Exclusion(pod, nodes[pod.Spec.NodeName]); rule != "" {
+			excluded[agentName] = rule
+		} else if err != nil {
+			absent = append(absent, agentName)
+		} else {
+			outdated = append(outdated, agentName)
 		}
+	}
 
-		delta := time.Now().Sub(agent.Spec.LastUpdated).Seconds()
-		if delta > float64(agent.Spec.ReportInterval*2) {
-			outdated = append(outdated, agentName)
+	return absent, outdated, excluded, nil
+}
+
+// UpdateStatuses writes the states of the agents to their status
+// subresource when they change or their last check time is due.
+func (h *k8sAgentStorage) UpdateStatuses(now time.Time) error {
+	if h.ExtensionsClientset == nil || !h.statusSubresource {
+		return nil
+	}
+
+	agents, err := h.ExtensionsClientset.Agents().List()
+	if err != nil {
+		return err
+	}
+
+	var errs []string
+	for i := range agents.Items {
+		agent := &agents.Items[i]
+		state := ext_v1.AgentStateFresh
+		if agentOutdated(&agent.Spec, now) {
+			state = ext_v1.AgentStateOutdated
+		}
+		if agent.Status.State == state && agent.Status.LastCheck != nil &&
+			now.Sub(*agent.Status.LastCheck) < statusRefreshInterval {
+			continue
+		}
+
+		lastCheck := now
+		agent.Status = ext_v1.AgentStatus{State: state, LastCheck: &lastCheck}
+		if _, err = h.ExtensionsClientset.Agents().UpdateStatus(agent); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", agent.Name, err))
 		}
 	}
+	if len(errs) != 0 {
+		return fmt.Errorf("updating status of the agents failed: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
 
-	return absent, outdated, nil
+func (h *k8sAgentStorage) AgentHistory(name string) ([]ext_v1.AgentSpec, error) {
+	// Custom resource keeps the latest report only
+	agent, err := h.ExtensionsClientset.Agents().Get(name)
+	if api_errors.IsNotFound(err) {
+		return []ext_v1.AgentSpec{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []ext_v1.AgentSpec{agent.Spec}, nil
 }
 
 func (h *k8sAgentStorage) AgentCache() NcAgentCache {
@@ -214,6 +301,121 @@ func (h *k8sAgentStorage) AgentCacheUpdate(key string, ag *ext_v1.AgentSpec) {
 	h.NcAgentCache[key] = *ag
 }
 
+func (h *k8sAgentStorage) LatestReports() (NcAgentCache, error) {
+	if h.ExtensionsClientset == nil {
+		// Required for tests
+		return h.NcAgentCache, nil
+	}
+
+	agents, err := h.ExtensionsClientset.Agents().List()
+	if err != nil {
+		return nil, err
+	}
+
+	rv := NcAgentCache{}
+	for _, agent := range agents.Items {
+		rv[agent.ObjectMeta.Name] = agent.Spec
+	}
+	return rv, nil
+}
+
+// coreClient returns the clientset the silences are stored with.
+func (h *k8sAgentStorage) coreClient() (kubernetes.Interface, error) {
+	return kubeClientset(h.KubeClient)
+}
+
+func (h *k8sAgentStorage) SaveSilence(silence *Silence) error {
+	client, err := h.coreClient()
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(silence)
+	if err != nil {
+		return err
+	}
+
+	configMaps := client.Core().ConfigMaps(silencesNamespace)
+	configMap, err := configMaps.Get(silencesConfigMap, meta_v1.GetOptions{})
+	if api_errors.IsNotFound(err) {
+		configMap = &v1.ConfigMap{
+			ObjectMeta: meta_v1.ObjectMeta{Name: silencesConfigMap},
+			Data:       map[string]string{silence.ID: string(value)},
+		}
+		_, err = configMaps.Create(configMap)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if configMap.Data == nil {
+		configMap.Data = map[string]string{}
+	}
+	// ended silences are dropped when a new one comes
+	now := time.Now()
+	for id, data := range configMap.Data {
+		existing := Silence{}
+		if err = json.Unmarshal([]byte(data), &existing); err != nil || existing.Ended(now) {
+			delete(configMap.Data, id)
+		}
+	}
+	configMap.Data[silence.ID] = string(value)
+	_, err = configMaps.Update(configMap)
+	return err
+}
+
+func (h *k8sAgentStorage) DeleteSilence(id string) error {
+	client, err := h.coreClient()
+	if err != nil {
+		return err
+	}
+
+	configMaps := client.Core().ConfigMaps(silencesNamespace)
+	configMap, err := configMaps.Get(silencesConfigMap, meta_v1.GetOptions{})
+	if api_errors.IsNotFound(err) {
+		return ErrSilenceNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if _, exists := configMap.Data[id]; !exists {
+		return ErrSilenceNotFound
+	}
+	delete(configMap.Data, id)
+	_, err = configMaps.Update(configMap)
+	return err
+}
+
+func (h *k8sAgentStorage) Silences() ([]Silence, error) {
+	client, err := h.coreClient()
+	if err != nil {
+		return nil, err
+	}
+
+	silences := []Silence{}
+	configMap, err := client.Core().ConfigMaps(silencesNamespace).Get(silencesConfigMap, meta_v1.GetOptions{})
+	if api_errors.IsNotFound(err) {
+		return silences, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, data := range configMap.Data {
+		silence := Silence{}
+		if err = json.Unmarshal([]byte(data), &silence); err != nil {
+			glog.Error(err)
+			continue
+		}
+		silences = append(silences, silence)
+	}
+	return liveSilences(silences, time.Now()), nil
+}
+
+func (h *k8sAgentStorage) GetKubeClient() Proxy {
+	return h.KubeClient
+}
+
 func (h *k8sAgentStorage) SetKubeClient(cl Proxy) {
 	// Required for tests
 	h.KubeClient = cl
@@ -0,0 +1,111 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ext_v1 "github.com/Mirantis/k8s-netchecker-server/pkg/extensions/apis/v1"
+	ext_client "github.com/Mirantis/k8s-netchecker-server/pkg/extensions/client"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+// fakeAgentsServer serves the agent custom resources.
+type fakeAgentsServer struct {
+	sync.Mutex
+	agents map[string]*ext_v1.Agent
+}
+
+func (s *fakeAgentsServer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/apis/network-checker.ext/v1/namespaces/default/agents")
+	switch {
+	case r.Method == "GET" && path == "":
+		list := &ext_v1.AgentList{}
+		for _, agent := range s.agents {
+			list.Items = append(list.Items, *agent)
+		}
+		json.NewEncoder(rw).Encode(list)
+	case r.Method == "PUT" && strings.HasSuffix(path, "/status"):
+		update := &ext_v1.Agent{}
+		json.NewDecoder(r.Body).Decode(update)
+		agent := s.agents[update.Name]
+		agent.Status = update.Status
+		json.NewEncoder(rw).Encode(agent)
+	default:
+		rw.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *fakeAgentsServer) state(name string) ext_v1.AgentStatus {
+	s.Lock()
+	defer s.Unlock()
+	return s.agents[name].Status
+}
+
+func TestK8sUpdateStatuses(t *testing.T) {
+	now := time.Now()
+	fresh := agentExample()
+	fresh.LastUpdated = now
+	outdated := agentExample()
+	outdated.LastUpdated = now.Add(-time.Hour)
+	server := &fakeAgentsServer{agents: map[string]*ext_v1.Agent{
+		"fresh":    {ObjectMeta: meta_v1.ObjectMeta{Name: "fresh"}, Spec: fresh},
+		"outdated": {ObjectMeta: meta_v1.ObjectMeta{Name: "outdated"}, Spec: outdated},
+	}}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	clientset, err := ext_client.WrapClientsetWithExtensions(nil, &rest.Config{Host: ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &k8sAgentStorage{NcAgentCache: NcAgentCache{}, ExtensionsClientset: clientset}
+
+	// CRD without status subresource keeps no states
+	if err = s.UpdateStatuses(now); err != nil || server.state("fresh").State != "" {
+		t.Fatalf("Status must not be written without subresource, got %+v (%v)", server.state("fresh"), err)
+	}
+
+	s.statusSubresource = true
+	if err = s.UpdateStatuses(now); err != nil {
+		t.Fatalf("Failed to update statuses. Details: %v", err)
+	}
+	if server.state("fresh").State != ext_v1.AgentStateFresh || server.state("outdated").State != ext_v1.AgentStateOutdated {
+		t.Errorf("States are not as expected: %+v, %+v", server.state("fresh"), server.state("outdated"))
+	}
+	if lastCheck := server.state("fresh").LastCheck; lastCheck == nil || !lastCheck.Equal(now) {
+		t.Errorf("Last check must be the time of the check, got %v", lastCheck)
+	}
+
+	// unchanged state is written once refresh is due only
+	s.UpdateStatuses(now.Add(time.Second))
+	if !server.state("outdated").LastCheck.Equal(now) {
+		t.Errorf("Unchanged state must not be written, got %+v", server.state("outdated"))
+	}
+	s.UpdateStatuses(now.Add(2 * statusRefreshInterval))
+	if !server.state("outdated").LastCheck.Equal(now.Add(2 * statusRefreshInterval)) {
+		t.Errorf("Last check must be refreshed, got %+v", server.state("outdated"))
+	}
+}
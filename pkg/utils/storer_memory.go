@@ -0,0 +1,244 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/julienschmidt/httprouter"
+
+	ext_v1 "github.com/Mirantis/k8s-netchecker-server/pkg/extensions/apis/v1"
+)
+
+// MemoryAgentStorage keeps agents' reports in the server process memory.
+// Reports expire after ReportTTL the same way etcd records do, but nothing
+// survives a restart, so it's meant for single-replica and test deployments.
+type MemoryAgentStorage struct {
+	sync.Mutex   // ensures atomic writes; protects the following fields
+	config       *AppConfig
+	k8s          K8sConnection
+	NcAgentCache NcAgentCache
+	history      map[string][]ext_v1.AgentSpec
+	silences     map[string]Silence
+}
+
+func NewMemoryStorer() (*MemoryAgentStorage, error) {
+	var err error
+
+	rv := &MemoryAgentStorage{
+		NcAgentCache: NcAgentCache{},
+		config:       GetOrCreateConfig(),
+		history:      map[string][]ext_v1.AgentSpec{},
+		silences:     map[string]Silence{},
+	}
+
+	// Connection to k8s API is optional for this storage: without it
+	// absent agents can't be detected, but reports are still served.
+	if err = rv.k8s.connect(); err != nil {
+		glog.Warningf("K8s API is not accessible, absent agents won't be detected: %v", err)
+	}
+
+	return rv, nil
+}
+
+// Close stops the pod cache.
+func (s *MemoryAgentStorage) Close() error {
+	s.k8s.Close()
+	return nil
+}
+
+// expire drops reports which are older than ReportTTL. Zero TTL disables
+// expiration. Must be called with the lock held.
+func (s *MemoryAgentStorage) expire() {
+	if s.config.ReportTTL <= 0 {
+		return
+	}
+	for name, agent := range s.NcAgentCache {
+		if time.Now().Sub(agent.LastUpdated) > s.config.ReportTTL {
+			glog.V(5).Infof("Report of agent '%s' expired", name)
+			delete(s.NcAgentCache, name)
+			delete(s.history, name)
+		}
+	}
+}
+
+func (s *MemoryAgentStorage) UpdateAgents(rw http.ResponseWriter, r *http.Request, rp httprouter.Params) (ext_v1.AgentSpec, error) {
+	agentData := ext_v1.AgentSpec{}
+
+	if err := ProcessRequest(r, &agentData, rw); err != nil {
+		return ext_v1.AgentSpec{}, err
+	}
+
+	agentData.LastUpdated = time.Now()
+	if prev, exists := s.AgentCache()[rp.ByName("name")]; exists {
+		trackRestarts(&prev, &agentData)
+		trackIPChange(&prev, &agentData)
+	}
+	glog.V(10).Infof("Updating the agents resource with value: %v", agentData)
+
+	s.AgentCacheUpdate(rp.ByName("name"), &agentData)
+
+	return agentData, nil
+}
+
+func (s *MemoryAgentStorage) GetAgents(rw http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ProcessResponse(rw, s.AgentCache())
+}
+
+func (s *MemoryAgentStorage) GetSingleAgent(rw http.ResponseWriter, r *http.Request, rp httprouter.Params) {
+	agentName := rp.ByName("name")
+	agentData, exists := s.AgentCache()[agentName]
+
+	if !exists {
+		glog.V(5).Infof("Agent with name %v is not found in the cache", agentName)
+		http.Error(rw, "There is no such entry in the agent cache", http.StatusNotFound)
+		return
+	}
+
+	ProcessResponse(rw, agentData)
+}
+
+func (s *MemoryAgentStorage) CheckAgents() ([]string, []string, map[string]string, error) {
+	return checkCachedAgents(s.k8s.KubeClient, s.AgentCache())
+}
+
+func (s *MemoryAgentStorage) AgentCache() NcAgentCache {
+	s.Lock()
+	defer s.Unlock()
+
+	s.expire()
+	rv := make(NcAgentCache, len(s.NcAgentCache))
+	for name, agent := range s.NcAgentCache {
+		rv[name] = agent
+	}
+	return rv
+}
+
+func (s *MemoryAgentStorage) AgentCacheUpdate(key string, ag *ext_v1.AgentSpec) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.NcAgentCache[key] = *ag
+
+	limit := s.config.HistorySize
+	if limit < 1 {
+		limit = 1
+	}
+	history := append(s.history[key], *ag)
+	if len(history) > limit {
+		history = history[len(history)-limit:]
+	}
+	s.history[key] = history
+}
+
+func (s *MemoryAgentStorage) AgentHistory(name string) ([]ext_v1.AgentSpec, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.expire()
+	rv := make([]ext_v1.AgentSpec, len(s.history[name]))
+	copy(rv, s.history[name])
+	sortReports(rv)
+	return rv, nil
+}
+
+func (s *MemoryAgentStorage) LatestReports() (NcAgentCache, error) {
+	return s.AgentCache(), nil
+}
+
+func (s *MemoryAgentStorage) SaveSilence(silence *Silence) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.silences[silence.ID] = *silence
+	return nil
+}
+
+func (s *MemoryAgentStorage) DeleteSilence(id string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, exists := s.silences[id]; !exists {
+		return ErrSilenceNotFound
+	}
+	delete(s.silences, id)
+	return nil
+}
+
+func (s *MemoryAgentStorage) Silences() ([]Silence, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	silences := []Silence{}
+	for id, silence := range s.silences {
+		if silence.Ended(now) {
+			delete(s.silences, id)
+			continue
+		}
+		silences = append(silences, silence)
+	}
+	return liveSilences(silences, now), nil
+}
+
+func (s *MemoryAgentStorage) GetKubeClient() Proxy {
+	return s.k8s.KubeClient
+}
+
+func (s *MemoryAgentStorage) SetKubeClient(cl Proxy) {
+	// Required for tests
+	s.k8s.KubeClient = cl
+}
+
+func (s *MemoryAgentStorage) CleanCacheOnDemand(rw http.ResponseWriter) {
+	if s.k8s.KubeClient == nil {
+		return
+	}
+
+	pods, err := s.k8s.KubeClient.Pods()
+	if err != nil {
+		msg := fmt.Sprintf("Failed to get pods from k8s cluster. Details: %v", err)
+		glog.Error(msg)
+		if rw != nil {
+			http.Error(rw, msg, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	podMap := make(map[string]struct{})
+	for _, pod := range pods.Items {
+		podMap[pod.ObjectMeta.Name] = struct{}{}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	toRemove := []string{}
+	for agentName := range s.NcAgentCache {
+		if _, exists := podMap[agentName]; !exists {
+			toRemove = append(toRemove, agentName)
+		}
+	}
+
+	glog.V(5).Infof("Data cache for agents %v is to be cleaned up.", toRemove)
+	for _, agentName := range toRemove {
+		delete(s.NcAgentCache, agentName)
+		delete(s.history, agentName)
+	}
+}
@@ -18,6 +18,8 @@ import (
 	ext_v1 "github.com/Mirantis/k8s-netchecker-server/pkg/extensions/apis/v1"
 	"github.com/julienschmidt/httprouter"
 	"net/http"
+	"sync"
+	"time"
 )
 
 type NcAgentCache map[string]ext_v1.AgentSpec
@@ -28,16 +30,89 @@ type AgentStorer interface {
 	GetSingleAgent(http.ResponseWriter, *http.Request, httprouter.Params)
 	GetAgents(http.ResponseWriter, *http.Request, httprouter.Params)
 	CleanCacheOnDemand(http.ResponseWriter)
-	CheckAgents() ([]string, []string, error)
+	CheckAgents() ([]string, []string, map[string]string, error) // absent, outdated and excluded failing agents mapped to the rules
+	AgentHistory(string) ([]ext_v1.AgentSpec, error)             // reports of the agent kept by the storage, in chronological order
+	LatestReports() (NcAgentCache, error)                        // latest report of every agent kept by the storage
+	SaveSilence(*Silence) error                                  // creates the silence or replaces the one with the same ID
+	DeleteSilence(string) error                                  // ErrSilenceNotFound when there is no silence with the ID
+	Silences() ([]Silence, error)                                // silences which haven't ended yet, ordered by start time
 	//
 	AgentCache() NcAgentCache                   // Returns Agent Cache map (RO)
 	AgentCacheUpdate(string, *ext_v1.AgentSpec) // (agentName, agent.Spec) may be interface{} should be used, because format is storage-specific
+	GetKubeClient() Proxy                       // nil when k8s API is not accessible
 	// required for tests
 	SetKubeClient(cl Proxy)
 }
 
+// agentStatusUpdater is implemented by the storages which keep the states
+// of the agents computed by the server along with their reports.
+type agentStatusUpdater interface {
+	UpdateStatuses(now time.Time) error
+}
+
 type Handler struct {
 	Agents      AgentStorer
 	Metrics     NcAgentMetrics
+	metricsLock sync.Mutex // protects Metrics, they are updated by the reports and the metrics loop
 	HTTPHandler http.Handler
+	Notifier    *Notifier           // nil when no webhooks are configured
+	Alerter     *Alerter            // nil when no Alertmanagers are configured
+	Events      *EventRecorder      // nil when k8s events are disabled or k8s API is not accessible
+	Conditions  *ConditionPublisher // nil when node conditions are disabled or k8s API is not accessible
+	started     time.Time           // start of the server, see warmedUp
+	stop        chan struct{}       // stops the background work of the handler, see Close
+}
+
+// agentOutdated tells whether the agent has missed its reports according
+// to the configured staleness policy.
+func agentOutdated(agent *ext_v1.AgentSpec, now time.Time) bool {
+	return GetOrCreateConfig().Staleness.Outdated(agent, now)
+}
+
+// checkCachedAgents finds absent and outdated agents for storages which keep
+// the latest reports at hand, failing agents matching the exclusion rules are
+// mapped to the rule which excluded them instead. Without k8s API only
+// outdated ones are found.
+func checkCachedAgents(kubeClient Proxy, agents NcAgentCache) ([]string, []string, map[string]string, error) {
+	absent := []string{}
+	outdated := []string{}
+	excluded := map[string]string{}
+	now := time.Now()
+
+	if kubeClient == nil {
+		for agentName, agent := range agents {
+			if agentOutdated(&agent, now) {
+				outdated = append(outdated, agentName)
+			}
+		}
+		return absent, outdated, excluded, nil
+	}
+
+	pods, err := kubeClient.Pods()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	nodes := nodesByName(agentNodes(kubeClient))
+	exclusions := GetOrCreateConfig().Exclusions
+
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		agentName := pod.ObjectMeta.Name
+		agent, exists := agents[agentName]
+		if exists && !agentOutdated(&agent, now) {
+			continue
+		}
+		if rule := exclusions.Exclusion(pod, nodes[pod.Spec.NodeName]); rule != "" {
+			excluded[agentName] = rule
+			continue
+		}
+
+		if !exists {
+			absent = append(absent, agentName)
+		} else {
+			outdated = append(outdated, agentName)
+		}
+	}
+
+	return absent, outdated, excluded, nil
 }
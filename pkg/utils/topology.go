@@ -0,0 +1,314 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/client-go/pkg/api/v1"
+
+	ext_v1 "github.com/Mirantis/k8s-netchecker-server/pkg/extensions/apis/v1"
+)
+
+// Node labels the topology of the nodes is read from, the deprecated ones
+// are used when the current ones are not set
+const (
+	ZoneLabel             = "topology.kubernetes.io/zone"
+	RegionLabel           = "topology.kubernetes.io/region"
+	DeprecatedZoneLabel   = "failure-domain.beta.kubernetes.io/zone"
+	DeprecatedRegionLabel = "failure-domain.beta.kubernetes.io/region"
+)
+
+// States of the zones
+const (
+	ZoneOK       = "ok"       // all the nodes of the zone are healthy
+	ZoneDegraded = "degraded" // some of the nodes of the zone fail the check
+	ZoneDown     = "down"     // all the nodes of the zone fail the check
+)
+
+// NodeTopology is the location of the node in the cluster.
+type NodeTopology struct {
+	Zone   string `json:"zone,omitempty"`
+	Region string `json:"region,omitempty"`
+	Rack   string `json:"rack,omitempty"`
+}
+
+// Topology maps node names to their locations.
+type Topology map[string]NodeTopology
+
+// ZoneVerdict summarizes the connectivity check of the nodes of the zone.
+type ZoneVerdict struct {
+	Zone         string `json:"zone"`
+	Region       string `json:"region,omitempty"`
+	State        string `json:"state"`
+	Nodes        int    `json:"nodes"`
+	HealthyNodes int    `json:"healthy_nodes"`
+}
+
+// ProbeLatency summarizes HTTP probes of the same URL made by the agents of
+// a zone, or of a rack when Rack is set. Timings are averaged over the
+// successful probes.
+type ProbeLatency struct {
+	Zone       string `json:"zone"`
+	Rack       string `json:"rack,omitempty"`
+	URL        string `json:"url"`
+	Probes     int    `json:"probes"`
+	Failed     int    `json:"failed"`
+	AvgTotalMs int    `json:"avg_total_ms"`
+	MaxTotalMs int    `json:"max_total_ms"`
+}
+
+var (
+	zoneProbeTotal = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "ncagent",
+			Name:      "zone_http_probe_total_time_ms",
+			Help:      "Average total duration of successful http probes of the agents of the zone.",
+		},
+		[]string{"zone", "url"},
+	)
+	zoneProbeFailures = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "ncagent",
+			Name:      "zone_http_probe_failures",
+			Help:      "Number of agents of the zone which latest http probe has failed.",
+		},
+		[]string{"zone", "url"},
+	)
+	rackProbeTotal = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "ncagent",
+			Name:      "rack_http_probe_total_time_ms",
+			Help:      "Average total duration of successful http probes of the agents of the rack.",
+		},
+		[]string{"zone", "rack", "url"},
+	)
+	rackProbeFailures = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "ncagent",
+			Name:      "rack_http_probe_failures",
+			Help:      "Number of agents of the rack which latest http probe has failed.",
+		},
+		[]string{"zone", "rack", "url"},
+	)
+	zoneProbeTotalSeries, zoneProbeFailuresSeries *gaugeSeries
+	rackProbeTotalSeries, rackProbeFailuresSeries *gaugeSeries
+)
+
+func init() {
+	zoneProbeTotal, _ = tryRegisterGaugeVec(zoneProbeTotal)
+	zoneProbeFailures, _ = tryRegisterGaugeVec(zoneProbeFailures)
+	rackProbeTotal, _ = tryRegisterGaugeVec(rackProbeTotal)
+	rackProbeFailures, _ = tryRegisterGaugeVec(rackProbeFailures)
+	zoneProbeTotalSeries = newGaugeSeries(zoneProbeTotal)
+	zoneProbeFailuresSeries = newGaugeSeries(zoneProbeFailures)
+	rackProbeTotalSeries = newGaugeSeries(rackProbeTotal)
+	rackProbeFailuresSeries = newGaugeSeries(rackProbeFailures)
+}
+
+func labelValue(labels map[string]string, keys ...string) string {
+	for _, key := range keys {
+		if value := labels[key]; value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// NodesTopology reads the topology labels of the nodes, rack is read from
+// rackLabel if it is not empty.
+func NodesTopology(nodes *v1.NodeList, rackLabel string) Topology {
+	rv := Topology{}
+	if nodes == nil {
+		return rv
+	}
+	for i := range nodes.Items {
+		labels := nodes.Items[i].ObjectMeta.Labels
+		topology := NodeTopology{
+			Zone:   labelValue(labels, ZoneLabel, DeprecatedZoneLabel),
+			Region: labelValue(labels, RegionLabel, DeprecatedRegionLabel),
+		}
+		if rackLabel != "" {
+			topology.Rack = labels[rackLabel]
+		}
+		rv[nodes.Items[i].ObjectMeta.Name] = topology
+	}
+	return rv
+}
+
+// aggregateZones groups the node verdicts by zone, nodes which zone is not
+// known are left out.
+func aggregateZones(nodes []NodeVerdict) []ZoneVerdict {
+	zones := map[string]*ZoneVerdict{}
+	for i := range nodes {
+		node := &nodes[i]
+		if node.Zone == "" {
+			continue
+		}
+		zone, exists := zones[node.Zone]
+		if !exists {
+			zone = &ZoneVerdict{Zone: node.Zone, Region: node.Region}
+			zones[node.Zone] = zone
+		}
+		zone.Nodes++
+		if node.Healthy {
+			zone.HealthyNodes++
+		}
+	}
+
+	rv := make([]ZoneVerdict, 0, len(zones))
+	for _, zone := range zones {
+		switch zone.HealthyNodes {
+		case zone.Nodes:
+			zone.State = ZoneOK
+		case 0:
+			zone.State = ZoneDown
+		default:
+			zone.State = ZoneDegraded
+		}
+		rv = append(rv, *zone)
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Zone < rv[j].Zone })
+	return rv
+}
+
+// BuildZoneReachability aggregates the peer probes of the agents which
+// report in time by the zones of their nodes. Probes of the nodes which zone
+// is not known are left out.
+func BuildZoneReachability(agents NcAgentCache, topology Topology, now time.Time) []ReachabilityCell {
+	_, cells, rtts := collectPeerProbes(agents, now)
+
+	zoneCells := map[nodePair]*ReachabilityCell{}
+	zoneRTTs := map[nodePair]int{}
+	for key, cell := range cells {
+		from, to := topology[key.from].Zone, topology[key.to].Zone
+		if from == "" || to == "" {
+			continue
+		}
+		zoneKey := nodePair{from, to}
+		zoneCell, exists := zoneCells[zoneKey]
+		if !exists {
+			zoneCell = &ReachabilityCell{From: from, To: to}
+			zoneCells[zoneKey] = zoneCell
+		}
+		zoneCell.Probes += cell.Probes
+		zoneCell.Failed += cell.Failed
+		zoneRTTs[zoneKey] += rtts[key]
+	}
+
+	rv := make([]ReachabilityCell, 0, len(zoneCells))
+	for key, cell := range zoneCells {
+		cell.summarize(zoneRTTs[key])
+		rv = append(rv, *cell)
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		if rv[i].From != rv[j].From {
+			return rv[i].From < rv[j].From
+		}
+		return rv[i].To < rv[j].To
+	})
+	return rv
+}
+
+// aggregateProbes summarizes the latest HTTP probes of the agents which
+// report in time by the zones and by the racks of their nodes. Probes of the
+// nodes which zone (or rack) is not known are left out of the zones (or
+// racks).
+func aggregateProbes(agents NcAgentCache, topology Topology, now time.Time) ([]ProbeLatency, []ProbeLatency) {
+	type probeKey struct {
+		zone, rack, url string
+	}
+	sums := map[probeKey]int{}
+	latencies := map[probeKey]*ProbeLatency{}
+	add := func(key probeKey, probe *ext_v1.ProbeResult) {
+		latency, exists := latencies[key]
+		if !exists {
+			latency = &ProbeLatency{Zone: key.zone, Rack: key.rack, URL: key.url}
+			latencies[key] = latency
+		}
+		latency.Probes++
+		if probe.ConnectionResult != 1 {
+			latency.Failed++
+			return
+		}
+		sums[key] += probe.Total
+		if probe.Total > latency.MaxTotalMs {
+			latency.MaxTotalMs = probe.Total
+		}
+	}
+
+	for name := range agents {
+		agent := agents[name]
+		if agentOutdated(&agent, now) {
+			continue
+		}
+		location := topology[agent.NodeName]
+		for i := range agent.NetworkProbes {
+			probe := &agent.NetworkProbes[i]
+			if location.Zone != "" {
+				add(probeKey{location.Zone, "", probe.URL}, probe)
+			}
+			if location.Rack != "" {
+				add(probeKey{location.Zone, location.Rack, probe.URL}, probe)
+			}
+		}
+	}
+
+	zones, racks := []ProbeLatency{}, []ProbeLatency{}
+	for key, latency := range latencies {
+		if succeeded := latency.Probes - latency.Failed; succeeded != 0 {
+			latency.AvgTotalMs = sums[key] / succeeded
+		}
+		if key.rack == "" {
+			zones = append(zones, *latency)
+		} else {
+			racks = append(racks, *latency)
+		}
+	}
+	for _, latencies := range [][]ProbeLatency{zones, racks} {
+		sort.Slice(latencies, func(i, j int) bool {
+			a, b := latencies[i], latencies[j]
+			if a.Zone != b.Zone {
+				return a.Zone < b.Zone
+			}
+			if a.Rack != b.Rack {
+				return a.Rack < b.Rack
+			}
+			return a.URL < b.URL
+		})
+	}
+	return zones, racks
+}
+
+// UpdateTopologyMetrics exports the probe latencies of the zones and the
+// racks, series of the ones which are gone are dropped.
+func UpdateTopologyMetrics(report *ConnectivityReport) {
+	zoneTotal, zoneFailures := gaugeValues{}, gaugeValues{}
+	for _, latency := range report.ZoneProbes {
+		zoneTotal.add(float64(latency.AvgTotalMs), latency.Zone, latency.URL)
+		zoneFailures.add(float64(latency.Failed), latency.Zone, latency.URL)
+	}
+	rackTotal, rackFailures := gaugeValues{}, gaugeValues{}
+	for _, latency := range report.RackProbes {
+		rackTotal.add(float64(latency.AvgTotalMs), latency.Zone, latency.Rack, latency.URL)
+		rackFailures.add(float64(latency.Failed), latency.Zone, latency.Rack, latency.URL)
+	}
+	zoneProbeTotalSeries.Set(zoneTotal)
+	zoneProbeFailuresSeries.Set(zoneFailures)
+	rackProbeTotalSeries.Set(rackTotal)
+	rackProbeFailuresSeries.Set(rackFailures)
+}
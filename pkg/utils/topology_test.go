@@ -0,0 +1,168 @@
+// Copyright 2017 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+
+	ext_v1 "github.com/Mirantis/k8s-netchecker-server/pkg/extensions/apis/v1"
+)
+
+func TestNodesTopology(t *testing.T) {
+	node := func(name string, labels map[string]string) v1.Node {
+		return v1.Node{ObjectMeta: meta_v1.ObjectMeta{Name: name, Labels: labels}}
+	}
+	nodes := &v1.NodeList{Items: []v1.Node{
+		node("node-1", map[string]string{ZoneLabel: "zone-a", RegionLabel: "region", "rack": "r1"}),
+		node("node-2", map[string]string{DeprecatedZoneLabel: "zone-b", DeprecatedRegionLabel: "region"}),
+		node("node-3", nil),
+	}}
+
+	expected := Topology{
+		"node-1": {Zone: "zone-a", Region: "region", Rack: "r1"},
+		"node-2": {Zone: "zone-b", Region: "region"},
+		"node-3": {},
+	}
+	if topology := NodesTopology(nodes, "rack"); !reflect.DeepEqual(topology, expected) {
+		t.Errorf("Topology %+v is not as expected %+v", topology, expected)
+	}
+	if topology := NodesTopology(nodes, ""); topology["node-1"].Rack != "" {
+		t.Error("Rack must not be read when rack label is not set")
+	}
+}
+
+func TestConnectivityReportZones(t *testing.T) {
+	now := time.Now()
+	agents := NcAgentCache{}
+	for i, node := range []string{"node-1", "node-2", "node-3", "node-4"} {
+		agent := agentExample()
+		agent.NodeName = node
+		agent.LastUpdated = now
+		if i >= 2 {
+			agent.LastUpdated = now.Add(-time.Hour)
+		}
+		agents["agent-"+node] = agent
+	}
+	nodes := &v1.NodeList{}
+	for node, zone := range map[string]string{
+		"node-1": "zone-a",
+		"node-2": "zone-b",
+		"node-3": "zone-b",
+		"node-4": "zone-c",
+	} {
+		nodes.Items = append(nodes.Items, v1.Node{ObjectMeta: meta_v1.ObjectMeta{
+			Name:   node,
+			Labels: map[string]string{ZoneLabel: zone},
+		}})
+	}
+
+	report := BuildConnectivityReport(nil, agents, nodes, nil, now)
+
+	expected := []ZoneVerdict{
+		{Zone: "zone-a", State: ZoneOK, Nodes: 1, HealthyNodes: 1},
+		{Zone: "zone-b", State: ZoneDegraded, Nodes: 2, HealthyNodes: 1},
+		{Zone: "zone-c", State: ZoneDown, Nodes: 1},
+	}
+	if !reflect.DeepEqual(report.Zones, expected) {
+		t.Errorf("Zones %+v are not as expected %+v", report.Zones, expected)
+	}
+	if report.Nodes[0].Zone != "zone-a" {
+		t.Errorf("Zone of the node is not reported: %+v", report.Nodes[0])
+	}
+	expectedMessage := "Connectivity check fails on 2 out of 4 nodes, zones down: zone-c, " +
+		"2 nodes can't reach the server"
+	if report.Message != expectedMessage {
+		t.Errorf("Message %q is not as expected %q", report.Message, expectedMessage)
+	}
+}
+
+func TestBuildZoneReachability(t *testing.T) {
+	now := time.Now()
+	agents := NcAgentCache{
+		"agent-1": peerAgent("node-1", "10.0.0.1", now,
+			ext_v1.PeerProbeResult{Peer: "agent-2", Reachable: true, RTT: 2},
+			ext_v1.PeerProbeResult{Peer: "agent-3", Reachable: true, RTT: 10},
+		),
+		"agent-2": peerAgent("node-2", "10.0.0.2", now,
+			ext_v1.PeerProbeResult{Peer: "agent-3", Reachable: true, RTT: 20},
+			ext_v1.PeerProbeResult{Peer: "agent-4", Reachable: true, RTT: 1},
+		),
+		"agent-3": peerAgent("node-3", "10.0.0.3", now,
+			ext_v1.PeerProbeResult{Peer: "agent-1", Reachable: false},
+		),
+		"agent-4": peerAgent("node-4", "10.0.0.4", now),
+	}
+	topology := Topology{
+		"node-1": {Zone: "zone-a"},
+		"node-2": {Zone: "zone-a"},
+		"node-3": {Zone: "zone-b"},
+	}
+
+	expected := []ReachabilityCell{
+		{From: "zone-a", To: "zone-a", State: ReachabilityOK, Probes: 1, RTT: 2},
+		{From: "zone-a", To: "zone-b", State: ReachabilityOK, Probes: 2, RTT: 15},
+		{From: "zone-b", To: "zone-a", State: ReachabilityFailed, Probes: 1, Failed: 1},
+	}
+	if cells := BuildZoneReachability(agents, topology, now); !reflect.DeepEqual(cells, expected) {
+		t.Errorf("Zone reachability %+v is not as expected %+v", cells, expected)
+	}
+}
+
+func TestAggregateProbes(t *testing.T) {
+	now := time.Now()
+	probeAgent := func(node string, updated time.Time, probes ...ext_v1.ProbeResult) ext_v1.AgentSpec {
+		agent := agentExample()
+		agent.NodeName = node
+		agent.LastUpdated = updated
+		agent.NetworkProbes = probes
+		return agent
+	}
+	probe := func(total int) ext_v1.ProbeResult {
+		return ext_v1.ProbeResult{URL: "http://example.com", ConnectionResult: 1, Total: total}
+	}
+	agents := NcAgentCache{
+		"agent-1": probeAgent("node-1", now, probe(10)),
+		"agent-2": probeAgent("node-2", now, probe(30)),
+		"agent-3": probeAgent("node-3", now, ext_v1.ProbeResult{URL: "http://example.com"}),
+		"agent-4": probeAgent("node-4", now.Add(-time.Hour), probe(1000)),
+		"agent-5": probeAgent("node-5", now, probe(1000)),
+	}
+	topology := Topology{
+		"node-1": {Zone: "zone-a", Rack: "r1"},
+		"node-2": {Zone: "zone-a", Rack: "r2"},
+		"node-3": {Zone: "zone-a", Rack: "r2"},
+		"node-4": {Zone: "zone-a"},
+	}
+
+	zones, racks := aggregateProbes(agents, topology, now)
+	expectedZones := []ProbeLatency{
+		{Zone: "zone-a", URL: "http://example.com", Probes: 3, Failed: 1, AvgTotalMs: 20, MaxTotalMs: 30},
+	}
+	if !reflect.DeepEqual(zones, expectedZones) {
+		t.Errorf("Zone probes %+v are not as expected %+v", zones, expectedZones)
+	}
+	expectedRacks := []ProbeLatency{
+		{Zone: "zone-a", Rack: "r1", URL: "http://example.com", Probes: 1, AvgTotalMs: 10, MaxTotalMs: 10},
+		{Zone: "zone-a", Rack: "r2", URL: "http://example.com", Probes: 2, Failed: 1, AvgTotalMs: 30, MaxTotalMs: 30},
+	}
+	if !reflect.DeepEqual(racks, expectedRacks) {
+		t.Errorf("Rack probes %+v are not as expected %+v", racks, expectedRacks)
+	}
+}
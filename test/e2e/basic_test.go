@@ -59,8 +59,9 @@ var _ = ginkgo.Describe("Basic", func() {
 			"netchecker-server",
 			[]rbac.PolicyRule{
 				{Verbs: []string{"*"}, APIGroups: []string{"apiextensions.k8s.io"}, Resources: []string{"customresourcedefinitions"}},
-				{Verbs: []string{"*"}, APIGroups: []string{"network-checker.ext"}, Resources: []string{"agents"}},
-				{Verbs: []string{"get", "list"}, APIGroups: []string{""}, Resources: []string{"pods"}},
+				{Verbs: []string{"*"}, APIGroups: []string{"network-checker.ext"}, Resources: []string{"agents", "agents/status"}},
+				{Verbs: []string{"get", "list", "watch"}, APIGroups: []string{""}, Resources: []string{"pods", "nodes"}},
+				{Verbs: []string{"get", "create", "update"}, APIGroups: []string{""}, Resources: []string{"configmaps"}},
 			},
 		)
 		cr, err = clientset.Rbac().ClusterRoles().Create(cr_body)